@@ -0,0 +1,168 @@
+package main
+
+import (
+	"app/internal/data"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// exportDataHandler sends the user a ZIP of everything stored about them: the
+// profile, sessions, API keys, tickets and audit events, each as a JSON file.
+func (app *application) exportDataHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.models.Users.GetByLogin(r.Context(), contextGetUser(r).Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		// The password hash is ours, not personal data, and the TOTP secrets
+		// are already left out of the JSON.
+		user.Password = ""
+
+		sessions, err := app.models.Tokens.GetSessions(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		apiKeys, err := app.models.APIKeys.GetAllForUser(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		tickets, err := app.models.Tickets.GetByLogin(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		// Recorded first, so the export includes its own audit event.
+		app.audit(r, data.AuditDataExport, user.Login, nil)
+		events, err := app.models.Audit.GetAllForUser(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		// The archive is built in memory so a failure halfway can still be
+		// answered with an error. It is small enough for that.
+		buf := new(bytes.Buffer)
+		zw := zip.NewWriter(buf)
+		for _, file := range []struct {
+			name    string
+			content interface{}
+		}{
+			{"profile.json", user},
+			{"sessions.json", sessions},
+			{"api_keys.json", apiKeys},
+			{"tickets.json", tickets},
+			{"audit_events.json", events},
+		} {
+			js, err := json.MarshalIndent(file.content, "", "\t")
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if _, err = f.Write(js); err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+		if err = zw.Close(); err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+user.Login+`-data-`+time.Now().UTC().Format("20060102")+`.zip"`)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(buf.Bytes())
+	})
+}
+
+// deleteAccountHandler deletes the user's own account. It takes the current
+// password, or for accounts that only log in through an OpenID provider, the
+// login typed out.
+func (app *application) deleteAccountHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		r.ParseForm()
+		confirmation := r.PostForm.Get("confirmation")
+
+		var confirmed bool
+		if user.Password == "" {
+			confirmed = subtle.ConstantTimeCompare([]byte(confirmation), []byte(user.Login)) == 1
+		} else {
+			match, wait, err := app.confirmPassword(r, user, confirmation)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if wait > 0 {
+				app.tooManyAttempts(w, r, "profile.page.html", wait)
+				return
+			}
+			confirmed = match
+		}
+		if !confirmed {
+			errMsg := "enter your current password to delete your account"
+			if user.Password == "" {
+				errMsg = "type your login to delete your account"
+			}
+			app.renderStatus(w, r, http.StatusUnauthorized, "profile.page.html", &data.TemplateData{
+				ErrorText: errMsg,
+				Code:      http.StatusUnauthorized,
+			})
+			return
+		}
+
+		err := app.deleteAccount(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditProfileDelete, user.Login, nil)
+
+		clearSessionCookies(w, r)
+		app.session.Put(r, "flash", "Your account has been deleted.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
+
+// deleteAccount deletes a user together with all of their tokens and API keys.
+// Their tickets are kept for accounting, but no longer say whose they were.
+// Audit events are kept too, as the record of what happened to the account.
+//
+// The user goes last, so if a step fails the account is still there to be
+// deleted again, and none of the steps mind having been done before. Deleting
+// the user first could leave keys and tickets behind with no account left to
+// retry from, and a new user taking the login would inherit them.
+func (app *application) deleteAccount(ctx context.Context, login string) error {
+	err := app.models.Tickets.AnonymizeUser(ctx, login)
+	if err != nil {
+		return err
+	}
+	err = app.models.APIKeys.DeleteAllForUser(ctx, login)
+	if err != nil {
+		return err
+	}
+	err = app.models.Tokens.DeleteAllByLogin(ctx, login)
+	if err != nil {
+		return err
+	}
+	err = app.models.Users.DeleteUserByLogin(ctx, login)
+	if errors.Is(err, data.ErrNotFound) {
+		return nil
+	}
+	return err
+}
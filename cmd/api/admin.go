@@ -0,0 +1,281 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/validator"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const adminUsersPageSize = 20
+
+// adminUsersHandler lists the users matching the "q" query parameter, one page
+// at a time.
+func (app *application) adminUsersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qs := r.URL.Query()
+		query := strings.TrimSpace(qs.Get("q"))
+
+		page, err := strconv.Atoi(qs.Get("page"))
+		if err != nil {
+			page = 1
+		}
+		filters := data.Filters{Page: page, PageSize: adminUsersPageSize}
+
+		v := validator.New()
+		if data.ValidateFilters(v, filters); !v.Valid() {
+			filters.Page = 1
+		}
+
+		users, metadata, err := app.models.Users.Search(r.Context(), query, filters)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		for i := range users {
+			users[i].Password = ""
+			users[i].TOTPSecret = ""
+			users[i].RecoveryCodes = nil
+		}
+
+		app.render(w, r, "adminUsers.page.html", &data.TemplateData{
+			Users:    users,
+			Metadata: metadata,
+			Query:    query,
+		})
+	})
+}
+
+// adminUserHandler shows a user with the forms for managing their account.
+func (app *application) adminUserHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		app.renderAdminUser(w, r, user, "", http.StatusOK)
+	})
+}
+
+// adminUpdateUserHandler changes a user's name, email and role.
+func (app *application) adminUpdateUserHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		r.ParseForm()
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		email := strings.TrimSpace(r.PostForm.Get("email"))
+		role := r.PostForm.Get("role")
+
+		v := validator.New()
+		v.Check(name != "", "name", "must be provided")
+		ValidateEmail(v, email)
+		v.Check(data.ValidRole(role), "role", "must be one of "+strings.Join(data.Roles(), ", "))
+		// Admins can't demote themselves, so there is always someone left who
+		// can manage users.
+		v.Check(user.Login != contextGetUser(r).Login || role == user.Role, "role", "can't be changed on your own account")
+		if !v.Valid() {
+			errMsg := ""
+			for k, v := range v.Errors {
+				errMsg += k + " " + v + "\n"
+			}
+			app.renderAdminUser(w, r, user, errMsg, http.StatusUnprocessableEntity)
+			return
+		}
+
+		details := map[string]string{}
+		if name != user.Name {
+			details["name"] = user.Name + " -> " + name
+		}
+		if email != user.Email {
+			details["email"] = user.Email + " -> " + email
+		}
+		if role != user.Role {
+			details["role"] = user.Role + " -> " + role
+		}
+		if len(details) == 0 {
+			http.Redirect(w, r, adminUserPath(user.Login), http.StatusSeeOther)
+			return
+		}
+
+		user.Name = name
+		user.Email = email
+		user.Role = role
+		err := app.models.Users.UpdateUserByLogin(r.Context(), user.Login, data.User{Name: name, Email: email, Role: role})
+		if err != nil {
+			var dup *data.ErrDuplicate
+			if errors.As(err, &dup) && duplicateMessages[dup.Field] != "" {
+				app.renderAdminUser(w, r, user, duplicateMessages[dup.Field], http.StatusConflict)
+				return
+			}
+			app.modelError(w, r, err)
+			return
+		}
+		app.audit(r, data.AuditAdminUserUpdate, user.Login, details)
+
+		http.Redirect(w, r, adminUserPath(user.Login), http.StatusSeeOther)
+	})
+}
+
+// adminUserActivationHandler activates or deactivates an account. Deactivated
+// users can't log in, and their sessions are ended straight away.
+func (app *application) adminUserActivationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		activate := r.PostFormValue("activated") == "true"
+		if !activate && user.Login == contextGetUser(r).Login {
+			app.renderAdminUser(w, r, user, "you can't deactivate your own account", http.StatusUnprocessableEntity)
+			return
+		}
+		if activate == user.Activated {
+			http.Redirect(w, r, adminUserPath(user.Login), http.StatusSeeOther)
+			return
+		}
+
+		err := app.models.Users.SetActivated(r.Context(), user.Login, activate)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		action := data.AuditAdminUserActivate
+		if !activate {
+			action = data.AuditAdminUserDeactivate
+			err = app.models.Tokens.DeleteSessionsByLogin(r.Context(), user.Login, "")
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+		app.audit(r, action, user.Login, nil)
+
+		http.Redirect(w, r, adminUserPath(user.Login), http.StatusSeeOther)
+	})
+}
+
+// adminDeleteUserHandler deletes an account the same way its owner can; see
+// deleteAccount.
+func (app *application) adminDeleteUserHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		if user.Login == contextGetUser(r).Login {
+			app.renderAdminUser(w, r, user, "you can't delete your own account", http.StatusUnprocessableEntity)
+			return
+		}
+
+		err := app.deleteAccount(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditAdminUserDelete, user.Login, map[string]string{"email": user.Email})
+
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+	})
+}
+
+// adminResetPasswordHandler forces a user to choose a new password: the
+// current one stops working, every session and API key is revoked and a reset
+// link is emailed to the user.
+func (app *application) adminResetPasswordHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+
+		hash, err := app.unknownPasswordHash()
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.models.Users.UpdatePassword(r.Context(), user.Login, hash)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.models.Tokens.DeleteSessionsByLogin(r.Context(), user.Login, "")
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.models.APIKeys.DeleteAllForUser(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.sendPasswordReset(r.Context(), user)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditAdminUserResetPassword, user.Login, nil)
+
+		http.Redirect(w, r, adminUserPath(user.Login), http.StatusSeeOther)
+	})
+}
+
+// adminRevokeSessionsHandler logs a user out everywhere.
+func (app *application) adminRevokeSessionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+
+		err := app.models.Tokens.DeleteSessionsByLogin(r.Context(), user.Login, "")
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditAdminUserRevokeSession, user.Login, nil)
+
+		http.Redirect(w, r, adminUserPath(user.Login), http.StatusSeeOther)
+	})
+}
+
+// adminTargetUser looks up the user named in the URL. When there is no such
+// user it writes the response itself and returns false.
+func (app *application) adminTargetUser(w http.ResponseWriter, r *http.Request) (data.User, bool) {
+	user, err := app.models.Users.GetByLogin(r.Context(), mux.Vars(r)["login"])
+	if err != nil {
+		app.modelError(w, r, err)
+		return data.User{}, false
+	}
+	return user, true
+}
+
+func (app *application) renderAdminUser(w http.ResponseWriter, r *http.Request, user data.User, errMsg string, status int) {
+	sessions, err := app.models.Tokens.GetSessions(r.Context(), user.Login)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	user.Password = ""
+	user.TOTPSecret = ""
+	user.RecoveryCodes = nil
+
+	app.renderStatus(w, r, status, "adminUser.page.html", &data.TemplateData{
+		Users:     []data.User{user},
+		Sessions:  sessions,
+		ErrorText: errMsg,
+		Code:      status,
+	})
+}
+
+func adminUserPath(login string) string {
+	return "/admin/users/" + url.PathEscape(login)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/validator"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiKeysHandler lists the user's API keys, with a form for creating another
+// if their role lets them.
+func (app *application) apiKeysHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.renderAPIKeys(w, r, nil, "", http.StatusOK)
+	})
+}
+
+// createAPIKeyHandler creates a key with the chosen name, scopes and lifetime.
+// The page that follows is the only place the key is ever shown.
+func (app *application) createAPIKeyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		r.ParseForm()
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		scopes := r.PostForm["scopes"]
+		days := r.PostForm.Get("expires_in_days")
+
+		allowed := data.APIKeyScopes(*user)
+		v := validator.New()
+		v.Check(name != "", "name", "must be provided")
+		v.Check(len(name) <= 100, "name", "must not be more than 100 bytes long")
+		v.Check(len(scopes) > 0, "scopes", "must include at least one scope")
+		v.Check(validator.Unique(scopes), "scopes", "must not contain duplicate values")
+		for _, scope := range scopes {
+			v.Check(validator.In(scope, allowed...), "scopes", "must only include permissions you have")
+		}
+		v.Check(validator.In(days, "", "30", "90", "365"), "expires_in_days", "must be 30, 90, 365 or never")
+		if !v.Valid() {
+			errMsg := ""
+			for k, v := range v.Errors {
+				errMsg += k + " " + v + "\n"
+			}
+			app.renderAPIKeys(w, r, nil, errMsg, http.StatusUnprocessableEntity)
+			return
+		}
+
+		var expiry time.Time
+		if days != "" {
+			n, _ := strconv.Atoi(days)
+			expiry = time.Now().AddDate(0, 0, n)
+		}
+		key, err := app.models.APIKeys.New(r.Context(), user.Login, name, scopes, expiry)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditAPIKeyCreate, user.Login, map[string]string{
+			"id":     key.ID.Hex(),
+			"name":   key.Name,
+			"scopes": strings.Join(key.Scopes, " "),
+		})
+
+		app.renderAPIKeys(w, r, key, "", http.StatusCreated)
+	})
+}
+
+// revokeAPIKeyHandler deletes one of the user's keys.
+func (app *application) revokeAPIKeyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		id, err := primitive.ObjectIDFromHex(r.PostFormValue("id"))
+		if err != nil {
+			app.renderAPIKeys(w, r, nil, "unknown api key", http.StatusBadRequest)
+			return
+		}
+		err = app.models.APIKeys.Delete(r.Context(), user.Login, id)
+		if err != nil && !errors.Is(err, data.ErrNotFound) {
+			app.serverError(w, err)
+			return
+		}
+		if err == nil {
+			app.audit(r, data.AuditAPIKeyRevoke, user.Login, map[string]string{"id": id.Hex()})
+		}
+		http.Redirect(w, r, "/profile/api-keys", http.StatusSeeOther)
+	})
+}
+
+func (app *application) renderAPIKeys(w http.ResponseWriter, r *http.Request, created *data.APIKey, errMsg string, status int) {
+	user := contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(r.Context(), user.Login)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// The response may hold a key in plaintext, which mustn't be kept anywhere.
+	w.Header().Set("Cache-Control", "no-store")
+	app.renderStatus(w, r, status, "apiKeys.page.html", &data.TemplateData{
+		APIKeys:   keys,
+		NewAPIKey: created,
+		Scopes:    data.APIKeyScopes(*user),
+		ErrorText: errMsg,
+		Code:      status,
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/validator"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	auditPageSize = 50
+	// auditExportLimit caps the entries in one export; narrow the filter to
+	// get older ones.
+	auditExportLimit = 10000
+	// maxUserAgentLength keeps clients from filling the audit log with huge
+	// User-Agent headers.
+	maxUserAgentLength = 512
+)
+
+// audit records a change made by the user behind the request. By the time it
+// is called the change has already been made, so a failure to record it is
+// logged rather than reported to the user.
+func (app *application) audit(r *http.Request, action, target string, details map[string]string) {
+	app.record(r, &data.AuditEntry{
+		Action:  action,
+		Target:  target,
+		Details: details,
+	})
+}
+
+// record fills in when, where from and, unless it is already set, by whom an
+// audit entry was made, and inserts it. Entries without an outcome succeeded.
+func (app *application) record(r *http.Request, entry *data.AuditEntry) {
+	entry.IP = clientIP(r)
+	entry.UserAgent = r.UserAgent()
+	if len(entry.UserAgent) > maxUserAgentLength {
+		entry.UserAgent = entry.UserAgent[:maxUserAgentLength]
+	}
+	if entry.Actor == "" {
+		if user := contextGetUser(r); user != nil {
+			entry.Actor = user.Login
+		}
+	}
+	// The entry is written even if the client has gone away in the meantime,
+	// since a client that hangs up early is exactly what some attacks look
+	// like.
+	if err := app.models.Audit.Insert(context.Background(), entry); err != nil {
+		app.logger.PrintError(err.Error(), "failed to record audit entry "+entry.Action+" for "+entry.Actor)
+	}
+}
+
+// loginRejected records a login with the right credentials that was refused
+// anyway, such as one to an account that isn't activated.
+func (app *application) loginRejected(r *http.Request, login, reason string) {
+	app.record(r, &data.AuditEntry{
+		Actor:   login,
+		Action:  data.AuditLogin,
+		Outcome: data.AuditFailure,
+		Details: map[string]string{"via": r.URL.Path, "reason": reason},
+	})
+}
+
+// signupFailed records a signup refused because the login or email is taken.
+// The visitor has no account, so the entry has no actor.
+func (app *application) signupFailed(r *http.Request, user data.User, reason string) {
+	app.record(r, &data.AuditEntry{
+		Action:  data.AuditSignup,
+		Outcome: data.AuditFailure,
+		Target:  user.Login,
+		Details: map[string]string{"email": user.Email, "reason": reason},
+	})
+}
+
+// auditLogHandler shows a page of the audit log, filtered by the query
+// parameters actor, action, outcome, target, ip, from and to.
+func (app *application) auditLogHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, errMsg := readAuditFilter(r)
+
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			page = 1
+		}
+		filters := data.Filters{Page: page, PageSize: auditPageSize}
+
+		v := validator.New()
+		if data.ValidateFilters(v, filters); !v.Valid() {
+			filters.Page = 1
+		}
+
+		entries, metadata, err := app.models.Audit.GetAll(r.Context(), filter, filters)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		status := http.StatusOK
+		if errMsg != "" {
+			status = http.StatusUnprocessableEntity
+		}
+		app.renderStatus(w, r, status, "audit.page.html", &data.TemplateData{
+			AuditEntries: entries,
+			AuditFilter:  filter,
+			AuditActions: data.AuditActions(),
+			Metadata:     metadata,
+			ErrorText:    errMsg,
+			Code:         status,
+		})
+	})
+}
+
+// auditExportHandler sends the entries the audit log page would show as a JSON
+// file, newest first.
+func (app *application) auditExportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, errMsg := readAuditFilter(r)
+		if errMsg != "" {
+			app.errorJSON(w, http.StatusUnprocessableEntity, errMsg, nil)
+			return
+		}
+
+		entries, truncated, err := app.models.Audit.Export(r.Context(), filter, auditExportLimit)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		headers := http.Header{}
+		headers.Set("Content-Disposition", `attachment; filename="audit-`+time.Now().UTC().Format("20060102-150405")+`.json"`)
+		headers.Set("Cache-Control", "no-store")
+		err = app.writeJSON(w, http.StatusOK, data.Envelope{
+			"entries":   entries,
+			"truncated": truncated,
+		}, headers)
+		if err != nil {
+			app.serverError(w, err)
+		}
+	})
+}
+
+// readAuditFilter reads an audit filter from the query string. Dates are whole
+// days in UTC, both ends included. A date that can't be read is left out of
+// the filter and reported in the returned message.
+func readAuditFilter(r *http.Request) (data.AuditFilter, string) {
+	qs := r.URL.Query()
+	filter := data.AuditFilter{
+		Actor:   strings.TrimSpace(qs.Get("actor")),
+		Action:  qs.Get("action"),
+		Outcome: qs.Get("outcome"),
+		Target:  strings.TrimSpace(qs.Get("target")),
+		IP:      strings.TrimSpace(qs.Get("ip")),
+	}
+
+	v := validator.New()
+	v.Check(filter.Action == "" || validator.In(filter.Action, data.AuditActions()...), "action", "is not a known action")
+	v.Check(validator.In(filter.Outcome, "", data.AuditSuccess, data.AuditFailure), "outcome", "must be success or failure")
+	if from := qs.Get("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		v.Check(err == nil, "from", "must be a date like 2006-01-02")
+		filter.From = t
+	}
+	if to := qs.Get("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		v.Check(err == nil, "to", "must be a date like 2006-01-02")
+		if err == nil {
+			filter.To = t.AddDate(0, 0, 1)
+		}
+	}
+	if v.Valid() {
+		return filter, ""
+	}
+
+	errMsg := ""
+	for k, v := range v.Errors {
+		errMsg += k + " " + v + "\n"
+	}
+	if _, bad := v.Errors["action"]; bad {
+		filter.Action = ""
+	}
+	if _, bad := v.Errors["outcome"]; bad {
+		filter.Outcome = ""
+	}
+	return filter, errMsg
+}
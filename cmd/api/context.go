@@ -0,0 +1,67 @@
+package main
+
+import (
+	"app/internal/data"
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+const (
+	userContextKey    = contextKey("user")
+	sessionContextKey = contextKey("session")
+	csrfContextKey    = contextKey("csrf")
+	apiKeyContextKey  = contextKey("apiKey")
+)
+
+// contextSetUser returns a copy of the request with the authenticated user
+// added to its context.
+func contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the authenticated user, or nil when the request is
+// anonymous.
+func contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// contextSetSession records the access token a browser session authenticated
+// with, so handlers can act on the token family of the current session.
+func contextSetSession(r *http.Request, token *data.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetSession returns the access token of the current browser session,
+// or nil for anonymous and bearer-authenticated requests.
+func contextGetSession(r *http.Request) *data.Token {
+	token, ok := r.Context().Value(sessionContextKey).(*data.Token)
+	if !ok {
+		return nil
+	}
+	return token
+}
+
+// contextSetAPIKey returns a copy of the request with the API key it was
+// authenticated by added to its context.
+func contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key the request was authenticated by, or
+// nil when it wasn't made with one.
+func contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	if !ok {
+		return nil
+	}
+	return key
+}
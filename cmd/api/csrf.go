@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"mime"
+	"net/http"
+)
+
+// CSRF protection uses a per-session random token kept in a cookie. Every form
+// posts it back in the csrf_token field (scripts may use the X-CSRF-Token
+// header instead), and unsafe requests whose token doesn't match the cookie
+// are rejected. Another site can make the browser send the cookie, but it
+// can't read it to put the same value in the form.
+const (
+	csrfCookieName = "csrf_token"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfTokenBytes = 32
+)
+
+func (app *application) csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Cookie")
+
+		token := ""
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && validCSRFToken(cookie.Value) {
+			token = cookie.Value
+		}
+		hadToken := token != ""
+		if !hadToken {
+			var err error
+			token, err = generateCSRFToken()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			http.SetCookie(w, csrfCookie(token, 0))
+		}
+		// The token is kept by pointer so that rotateCSRFToken can hand the
+		// new one to the pages rendered after it.
+		r = r.WithContext(context.WithValue(r.Context(), csrfContextKey, &token))
+
+		if isSafeMethod(r.Method) || csrfExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sent := r.Header.Get(csrfHeaderName)
+		if sent == "" {
+			sent = r.PostFormValue(csrfFieldName)
+		}
+		if !hadToken || subtle.ConstantTimeCompare([]byte(sent), []byte(csrfToken(r))) != 1 {
+			app.logger.PrintWarning("csrf token mismatch", r.Method+" "+r.URL.Path)
+			app.forbidden(w, r, "Your form has expired or was not sent from this site. Please go back, reload the page and try again.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns the CSRF token for the forms of a page.
+func csrfToken(r *http.Request) string {
+	if token, ok := r.Context().Value(csrfContextKey).(*string); ok {
+		return *token
+	}
+	return ""
+}
+
+// rotateCSRFToken replaces the CSRF token whenever a session starts or ends,
+// so a token that leaked before can't be used to forge requests after. Pages
+// rendered later in the same request get the new token.
+func rotateCSRFToken(w http.ResponseWriter, r *http.Request) {
+	token, err := generateCSRFToken()
+	if err != nil {
+		// Without the cookie, the next request gets a new token anyway.
+		http.SetCookie(w, csrfCookie("", -1))
+		return
+	}
+	http.SetCookie(w, csrfCookie(token, 0))
+	if current, ok := r.Context().Value(csrfContextKey).(*string); ok {
+		*current = token
+	}
+}
+
+func csrfCookie(token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// csrfExempt reports whether a request can't be forged cross-site and needs no
+// token: requests authenticated by a bearer token don't rely on cookies, and
+// JSON bodies can't be sent by another site's form, nor by its scripts without
+// a CORS preflight, which we never allow.
+func csrfExempt(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+func generateCSRFToken() (string, error) {
+	b := make([]byte, csrfTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validCSRFToken(token string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(b) == csrfTokenBytes
+}
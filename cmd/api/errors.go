@@ -0,0 +1,134 @@
+package main
+
+import (
+	"app/internal/data"
+	"errors"
+	"net/http"
+)
+
+// databaseError answers a request whose query was cut short, and reports
+// whether err was such an error: a query that ran past its deadline gets a 504,
+// one that couldn't reach the database or was abandoned with the request gets a
+// 503. Handlers don't call it themselves, serverError does.
+func (app *application) databaseError(w http.ResponseWriter, err error) bool {
+	if !isDatabaseError(err) {
+		return false
+	}
+	status := http.StatusServiceUnavailable
+	var timeout *data.TimeoutError
+	if errors.As(err, &timeout) {
+		status = http.StatusGatewayTimeout
+	}
+	app.logger.PrintWarning(err.Error(), "database query cut short")
+	http.Error(w, http.StatusText(status), status)
+	return true
+}
+
+// isDatabaseError reports whether err is a query that was cut short, as
+// opposed to one that found nothing or was refused.
+func isDatabaseError(err error) bool {
+	var (
+		timeout     *data.TimeoutError
+		unavailable *data.UnavailableError
+	)
+	return errors.As(err, &timeout) || errors.As(err, &unavailable)
+}
+
+// modelError answers a request that failed because of an error from the
+// models, with the status it stands for: 404 for a missing document, 409 for a
+// duplicate or conflicting write, 503 or 504 for a query that was cut short
+// and 500 for anything else. API clients get it as JSON, browsers as the error
+// page. Forms that can say more, such as which field is taken, check for the
+// errors they know first.
+func (app *application) modelError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		status  int
+		message string
+		dup     *data.ErrDuplicate
+	)
+	switch {
+	case errors.Is(err, data.ErrNotFound):
+		status, message = http.StatusNotFound, "The page you were looking for doesn't exist."
+	case errors.As(err, &dup):
+		status, message = http.StatusConflict, "That "+dup.Field+" is already in use."
+	case errors.Is(err, data.ErrConflict):
+		status, message = http.StatusConflict, "Someone else changed this at the same time, please try again."
+	default:
+		app.serverError(w, err)
+		return
+	}
+
+	if isAPIRequest(r) {
+		app.errorJSON(w, status, message, nil)
+		return
+	}
+	app.renderStatus(w, r, status, "error.page.html", &data.TemplateData{
+		ErrorText: message,
+		Code:      status,
+	})
+}
+
+// duplicateMessages are what the account forms say when a user's login or
+// email is already taken by someone else.
+var duplicateMessages = map[string]string{
+	"login": "user with such login already exists",
+	"email": "email already in use",
+}
+
+// errorJSON sends a JSON error body of the form {"error": message}. It is used
+// for API clients, which can't follow the HTML redirects the pages use.
+func (app *application) errorJSON(w http.ResponseWriter, status int, message interface{}, headers http.Header) {
+	err := app.writeJSON(w, status, map[string]interface{}{"error": message}, headers)
+	if err != nil {
+		app.serverError(w, err)
+	}
+}
+
+func (app *application) badRequestJSON(w http.ResponseWriter, err error) {
+	app.errorJSON(w, http.StatusBadRequest, err.Error(), nil)
+}
+
+// invalidCredentialsJSON counts a failed login and rejects it without saying
+// whether the login or the password was wrong.
+func (app *application) invalidCredentialsJSON(w http.ResponseWriter, r *http.Request, attempt *loginAttempt, login string, user *data.User) {
+	err := app.loginFailed(r, attempt, login, user)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.errorJSON(w, http.StatusUnauthorized, "invalid authentication credentials", nil)
+}
+
+// invalidAuthenticationTokenJSON rejects a request whose bearer token is
+// missing, malformed, unknown or expired.
+func (app *application) invalidAuthenticationTokenJSON(w http.ResponseWriter) {
+	headers := http.Header{}
+	headers.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	app.errorJSON(w, http.StatusUnauthorized, "invalid or missing authentication token", headers)
+}
+
+func (app *application) authenticationRequiredJSON(w http.ResponseWriter) {
+	headers := http.Header{}
+	headers.Set("WWW-Authenticate", "Bearer")
+	app.errorJSON(w, http.StatusUnauthorized, "you must be authenticated to access this resource", headers)
+}
+
+func (app *application) notPermittedJSON(w http.ResponseWriter) {
+	app.errorJSON(w, http.StatusForbidden, "your user account doesn't have the necessary permissions to access this resource", nil)
+}
+
+// notFound renders the error page with a 404 status.
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+	app.renderStatus(w, r, http.StatusNotFound, "error.page.html", &data.TemplateData{
+		ErrorText: "The page you were looking for doesn't exist.",
+		Code:      http.StatusNotFound,
+	})
+}
+
+// forbidden renders the error page with a 403 status.
+func (app *application) forbidden(w http.ResponseWriter, r *http.Request, message string) {
+	app.renderStatus(w, r, http.StatusForbidden, "error.page.html", &data.TemplateData{
+		ErrorText: message,
+		Code:      http.StatusForbidden,
+	})
+}
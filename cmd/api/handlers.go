@@ -3,15 +3,16 @@ package main
 import (
 	"app/internal/data"
 	"app/internal/validator"
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func (app *application) testCookie() http.Handler {
@@ -31,30 +32,26 @@ func (app *application) testCookie() http.Handler {
 	})
 }
 
-// enter requireAuth middleware
-// pointer template data set to zero value
-// then get user by token
-// add user data to pointer template data
-
-func (app *application) Render(templateName string, templateData *data.TemplateData) http.Handler {
+func (app *application) Render(templateName string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.render(w, r, templateName, templateData)
+		app.render(w, r, templateName, &data.TemplateData{})
 	})
 }
 
 func (app *application) signupHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
-		hashedPw, _ := bcrypt.GenerateFromPassword([]byte(r.Form["password"][0]), 12)
 
 		user := data.User{
-			Email:    r.Form["email"][0],
-			Login:    r.Form["login"][0],
-			Password: string(hashedPw),
-			Name:     r.Form["name"][0],
+			Email:    r.PostForm.Get("email"),
+			Login:    r.PostForm.Get("login"),
+			Password: r.PostForm.Get("password"),
+			Name:     r.PostForm.Get("name"),
+			Role:     data.RoleCustomer,
 		}
-		v := validator.New()
+		v := newValidator(r)
 		ValidateUser(v, &user)
+		app.checkBreached(r, v, user.Password)
 		if !v.Valid() {
 			errMsg := ""
 			for k, v := range v.Errors {
@@ -67,43 +64,172 @@ func (app *application) signupHandler() http.Handler {
 			return
 		}
 
-		err := app.models.Users.Insert(user)
+		// The plaintext password was validated above; only its hash is stored.
+		hashedPw, err := app.passwords.Hash(user.Password)
 		if err != nil {
-			if strings.Contains(err.Error(), "login") {
-				app.render(w, r, "signup.page.html", &data.TemplateData{
-					ErrorText: "user with such login already exists",
-					Code:      409,
-				})
-				return
-			}
-			if strings.Contains(err.Error(), "email") {
+			app.serverError(w, err)
+			return
+		}
+		user.Password = hashedPw
+
+		err = app.models.Users.Insert(r.Context(), user)
+		if err != nil {
+			var dup *data.ErrDuplicate
+			if errors.As(err, &dup) && duplicateMessages[dup.Field] != "" {
+				app.signupFailed(r, user, dup.Field+" taken")
 				app.render(w, r, "signup.page.html", &data.TemplateData{
-					ErrorText: "email already in use",
+					ErrorText: duplicateMessages[dup.Field],
 					Code:      409,
 				})
 				return
 			}
+			app.modelError(w, r, err)
+			return
+		}
+		app.record(r, &data.AuditEntry{
+			Actor:   user.Login,
+			Action:  data.AuditSignup,
+			Target:  user.Login,
+			Details: map[string]string{"email": user.Email},
+		})
 
+		// New accounts start inactive until the user proves they own the email
+		// address by following the link we send to it.
+		err = app.sendActivation(r.Context(), user)
+		if err != nil {
+			app.serverError(w, err)
+			return
 		}
 
-		cookie := http.Cookie{
-			Name:     "token",
-			Value:    user.Login,
-			Expires:  time.Now().Add(365 * 24 * time.Hour),
-			Secure:   true,
-			HttpOnly: true,
-			Path:     "/",
-			SameSite: 4,
+		app.session.Put(r, "flash", "Your account has been created.")
+		http.Redirect(w, r, "/users/activate", http.StatusSeeOther)
+	})
+}
+
+// sendActivation replaces any outstanding activation token of the user with a
+// new one and emails it to them.
+func (app *application) sendActivation(ctx context.Context, user data.User) error {
+	err := app.models.Tokens.DeleteAllForUser(ctx, data.ScopeActivation, user.Login)
+	if err != nil {
+		return err
+	}
+	token, err := app.models.Tokens.New(ctx, user.Login, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(user.Email, "user_welcome.tmpl", map[string]interface{}{
+			"name":          user.Name,
+			"login":         user.Login,
+			"activationURL": app.config.baseURL + "/users/activate?token=" + token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err.Error(), "failed to send activation email")
 		}
+	})
+	return nil
+}
 
-		http.SetCookie(w, &cookie)
-		app.background(func() {
-			app.models.Tokens.Insert(data.Token{
-				Token:     cookie.Value,
-				UserLogin: user.Login,
+// resendActivationHandler sends a new activation link to an account that
+// hasn't been activated yet, for when the first one expired or got lost. Like
+// the forgot password form, it answers the same whether or not the address
+// belongs to such an account.
+func (app *application) resendActivationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		email := r.PostForm.Get("email")
+
+		v := validator.New()
+		if ValidateEmail(v, email); !v.Valid() {
+			app.render(w, r, "activate.page.html", &data.TemplateData{
+				ErrorText: "email " + v.Errors["email"],
+				Code:      422,
 			})
+			return
+		}
+
+		user, err := app.models.Users.GetByEmail(r.Context(), email)
+		if err != nil && !errors.Is(err, data.ErrNotFound) {
+			app.serverError(w, err)
+			return
+		}
+		if err == nil && !user.Activated {
+			err = app.sendActivation(r.Context(), user)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+
+		app.render(w, r, "activate.page.html", &data.TemplateData{
+			ErrorText: "If that address belongs to an account waiting for activation, we've sent it a new link.",
+			Code:      http.StatusAccepted,
 		})
-		http.Redirect(w, r, "http://localhost:"+app.config.port, http.StatusCreated)
+	})
+}
+
+// showActivateHandler shows the page an activation link points to. The link
+// only fills in the form, so that mail scanners prefetching it can't activate
+// the account on the user's behalf.
+func (app *application) showActivateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.render(w, r, "activate.page.html", &data.TemplateData{
+			Token: r.URL.Query().Get("token"),
+		})
+	})
+}
+
+func (app *application) activateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tokenPlaintext := r.PostForm.Get("token")
+
+		v := validator.New()
+		if data.ValidateTokenPlaintext(v, tokenPlaintext); !v.Valid() {
+			app.render(w, r, "activate.page.html", &data.TemplateData{
+				ErrorText: "invalid or expired activation token",
+				Code:      422,
+			})
+			return
+		}
+
+		token, err := app.models.Tokens.GetTokenDocumentByToken(r.Context(), data.ScopeActivation, tokenPlaintext)
+		if err != nil {
+			if errors.Is(err, data.ErrNotFound) {
+				app.render(w, r, "activate.page.html", &data.TemplateData{
+					ErrorText: "invalid or expired activation token",
+					Code:      422,
+				})
+				return
+			}
+			app.serverError(w, err)
+			return
+		}
+
+		user, err := app.models.Users.GetByLogin(r.Context(), token.UserLogin)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.models.Users.SetActivated(r.Context(), user.Login, true)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		err = app.startSession(w, r, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.session.Put(r, "flash", "Your account has been activated.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 }
 
@@ -111,95 +237,308 @@ func (app *application) loginHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 
-		login := r.Form["login"][0]
-		password := r.Form["password"][0]
+		login := r.PostForm.Get("login")
+		password := r.PostForm.Get("password")
 
-		if login == "" || password == "" {
+		v := newValidator(r)
+		v.Check(login != "", "login", "must be provided")
+		v.Check(password != "", "password", "must be provided")
+		if !v.Valid() {
+			errMsg := ""
+			for k, v := range v.Errors {
+				errMsg += k + " " + v + "\n"
+			}
 			app.render(w, r, "login.page.html", &data.TemplateData{
-				ErrorText: "login and/or password empty",
-				Code:      409,
+				ErrorText: errMsg,
+				Code:      422,
 			})
 			return
 		}
-		user, err := app.models.Users.GetByLogin(login)
-		if err == errors.New("mongo: no documents in result") {
+
+		attempt, wait, err := app.beginLogin(r, login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if wait > 0 {
+			app.tooManyAttempts(w, r, "login.page.html", wait)
+			return
+		}
+
+		// Unknown logins and wrong passwords get the same answer, and take the
+		// same time, so the form can't be used to find out which logins exist.
+		user, err := app.models.Users.GetByLogin(r.Context(), login)
+		if err != nil && !errors.Is(err, data.ErrNotFound) {
+			app.serverError(w, err)
+			return
+		}
+		if err != nil {
+			app.passwords.Dummy(password)
+			app.invalidLogin(w, r, attempt, login, nil)
+			return
+		}
+		match, err := app.passwordMatches(r.Context(), &user, password)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !match {
+			app.invalidLogin(w, r, attempt, login, &user)
+			return
+		}
+		if !user.Activated {
+			if err := app.loginPassed(r, attempt); err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.loginRejected(r, user.Login, "not activated")
 			app.render(w, r, "login.page.html", &data.TemplateData{
-				ErrorText: "user not found",
-				Code:      400,
+				ErrorText: "your account is not activated yet, please follow the link we emailed you",
+				Code:      403,
 			})
 			return
 		}
+		if user.TOTPEnabled {
+			// The code is another attempt of its own.
+			if err := app.loginPassed(r, attempt); err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.beginTwoFactorLogin(w, r, user)
+			return
+		}
+		err = app.loginSucceeded(r, attempt, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.startSession(w, r, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-			app.render(w, r, "login.page.html", &data.TemplateData{
-				ErrorText: "wrong password",
-				Code:      409,
+		app.session.Put(r, "flash", "You have been logged in.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
+
+// invalidLogin counts a failed login and renders the login page with the same
+// message whatever went wrong.
+func (app *application) invalidLogin(w http.ResponseWriter, r *http.Request, attempt *loginAttempt, login string, user *data.User) {
+	err := app.loginFailed(r, attempt, login, user)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.render(w, r, "login.page.html", &data.TemplateData{
+		ErrorText: "invalid login or password",
+		Code:      401,
+	})
+}
+
+// forgotPasswordHandler emails a password reset link. The response is the same
+// whether or not the address belongs to an account, so the form can't be used
+// to find out who has one.
+func (app *application) forgotPasswordHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		email := r.PostForm.Get("email")
+
+		v := validator.New()
+		if ValidateEmail(v, email); !v.Valid() {
+			app.render(w, r, "forgot.page.html", &data.TemplateData{
+				ErrorText: "email " + v.Errors["email"],
+				Code:      422,
 			})
 			return
 		}
-		cookie := &http.Cookie{
-			Name:     "token",
-			Value:    user.Login,
-			Expires:  time.Now().Add(365 * 24 * time.Hour),
-			Secure:   true,
-			HttpOnly: true,
-			Path:     "/",
-			SameSite: 4,
+
+		user, err := app.models.Users.GetByEmail(r.Context(), email)
+		if err != nil && !errors.Is(err, data.ErrNotFound) {
+			app.serverError(w, err)
+			return
+		}
+		if err == nil && user.Activated {
+			err = app.sendPasswordReset(r.Context(), user)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
 		}
 
-		http.SetCookie(w, cookie)
-		app.background(func() {
-			app.models.Tokens.Insert(data.Token{
-				Token:     cookie.Value,
-				UserLogin: user.Login,
+		app.render(w, r, "forgot.page.html", &data.TemplateData{
+			ErrorText: "If that address belongs to an account, we've sent it a link to reset the password.",
+			Code:      http.StatusAccepted,
+		})
+	})
+}
+
+// sendPasswordReset replaces any outstanding reset token of the user with a
+// new one and emails it to them.
+func (app *application) sendPasswordReset(ctx context.Context, user data.User) error {
+	err := app.models.Tokens.DeleteAllForUser(ctx, data.ScopePasswordReset, user.Login)
+	if err != nil {
+		return err
+	}
+	token, err := app.models.Tokens.New(ctx, user.Login, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(user.Email, "password_reset.tmpl", map[string]interface{}{
+			"name":     user.Name,
+			"resetURL": app.config.baseURL + "/password/reset?token=" + token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err.Error(), "failed to send password reset email")
+		}
+	})
+	return nil
+}
+
+func (app *application) showResetPasswordHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.render(w, r, "reset.page.html", &data.TemplateData{
+			Token: r.URL.Query().Get("token"),
+		})
+	})
+}
+
+// resetPasswordHandler sets a new password using a reset token. The token can
+// only be used once, and every existing session of the user is ended.
+func (app *application) resetPasswordHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tokenPlaintext := r.PostForm.Get("token")
+		password := r.PostForm.Get("password")
+
+		v := newValidator(r)
+		data.ValidateTokenPlaintext(v, tokenPlaintext)
+		if !v.Valid() {
+			errMsg := ""
+			for k, v := range v.Errors {
+				errMsg += k + " " + v + "\n"
+			}
+			app.render(w, r, "reset.page.html", &data.TemplateData{
+				ErrorText: errMsg,
+				Token:     tokenPlaintext,
+				Code:      422,
 			})
+			return
+		}
+
+		token, err := app.models.Tokens.GetTokenDocumentByToken(r.Context(), data.ScopePasswordReset, tokenPlaintext)
+		if err != nil {
+			if errors.Is(err, data.ErrNotFound) {
+				app.render(w, r, "reset.page.html", &data.TemplateData{
+					ErrorText: "invalid or expired password reset token",
+					Code:      422,
+				})
+				return
+			}
+			app.serverError(w, err)
+			return
+		}
+
+		// The password policy needs the user's details, which are only known
+		// once the token has been looked up.
+		user, err := app.models.Users.GetByLogin(r.Context(), token.UserLogin)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		ValidatePassword(v, password, validator.PersonalInfo{
+			Login: user.Login,
+			Email: user.Email,
+			Name:  user.Name,
 		})
+		app.checkBreached(r, v, password)
+		if !v.Valid() {
+			errMsg := ""
+			for k, v := range v.Errors {
+				errMsg += k + " " + v + "\n"
+			}
+			app.render(w, r, "reset.page.html", &data.TemplateData{
+				ErrorText: errMsg,
+				Token:     tokenPlaintext,
+				Code:      422,
+			})
+			return
+		}
 
-		http.Redirect(w, r, "http://localhost:"+app.config.port, http.StatusOK)
+		hashedPw, err := app.passwords.Hash(password)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.models.Users.UpdatePassword(r.Context(), token.UserLogin, hashedPw)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
 
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopePasswordReset, token.UserLogin)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.models.Tokens.DeleteSessionsByLogin(r.Context(), token.UserLogin, "")
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		clearSessionCookies(w, r)
+		app.record(r, &data.AuditEntry{
+			Actor:  token.UserLogin,
+			Action: data.AuditPasswordReset,
+			Target: token.UserLogin,
+		})
+
+		app.session.Put(r, "flash", "Your password has been reset, please log in.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	})
 }
 
 func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
-
-	cookie, err := r.Cookie("token")
-	if err != nil {
-		http.Redirect(w, r, "http://localhost:"+app.config.port, http.StatusSeeOther)
+	if !hasSessionCookie(r) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	app.background(func() {
-		app.models.Tokens.DeleteToken(cookie.Value)
-	})
-	cookie.MaxAge = -1
-	cookie.Expires = time.Now()
-	cookie.Value = ""
-	http.SetCookie(w, cookie)
-	// app.background(
-	// 	func()func(){
-	// 		app.models.Tokens.GetTokenDocumentByToken(cookie.Value)
-	// 		app.models.Tokens.Drop()
-	// 		return
-	// 	}(),
-	// )
-	// claimsMap := map[string]string{
-	// 	"aud": app.config.port,
-	// 	"iss": user.Login,
-	// 	"exp": fmt.Sprint(time.Now().Add(time.Minute * 1).Unix()),
-	// }
-	// secret := "secret"
-	// header := "HS256"
-	// tokenString, err := jwt.GenerateToken(header, claimsMap, secret)
-
-	http.Redirect(w, r, "http://localhost:"+app.config.port, http.StatusOK)
+	// Revoke the whole token family so the refresh token dies with the access
+	// token. Tokens issued before families existed are deleted one by one.
+	if session := contextGetSession(r); session != nil {
+		app.record(r, &data.AuditEntry{
+			Actor:  session.UserLogin,
+			Action: data.AuditLogout,
+		})
+		app.background(func() {
+			var err error
+			if session.Family != "" {
+				err = app.models.Tokens.DeleteFamily(context.Background(), session.UserLogin, session.Family)
+			} else {
+				err = app.models.Tokens.DeleteToken(context.Background(), session.Plaintext)
+			}
+			if err != nil {
+				app.logger.PrintError(err.Error(), "failed to revoke session of "+session.UserLogin)
+			}
+		})
+	}
+	clearSessionCookies(w, r)
+
+	app.session.Put(r, "flash", "You have been logged out.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
 func (app *application) createTicketHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		price, _ := strconv.Atoi(r.Form["price"][0])
 		amount, _ := strconv.Atoi(r.Form["amount"][0])
 
-		app.models.Tickets.Insert(data.Ticket{
+		_, err := app.models.Tickets.Insert(r.Context(), data.Ticket{
 			UserLogin: r.Form["login"][0],
 			Products: []data.Product{
 				data.Product{
@@ -209,6 +548,9 @@ func (app *application) createTicketHandler() http.Handler {
 				},
 			},
 		})
+		if err != nil {
+			app.modelError(w, r, err)
+		}
 	})
 }
 
@@ -217,12 +559,15 @@ func (app *application) showTicketHandler() http.Handler {
 		vars := mux.Vars(r)
 		ticketID := vars["id"]
 
-		ticket, err := app.models.Tickets.GetById(ticketID)
+		ticket, err := app.models.Tickets.GetById(r.Context(), ticketID)
+		// Someone else's ticket is reported the same way as a missing one, so
+		// customers can't probe for ticket ids.
+		user := contextGetUser(r)
+		if err == nil && ticket.UserLogin != user.Login && !can(r, data.PermissionTicketsReadAll) {
+			err = data.ErrNotFound
+		}
 		if err != nil {
-			fmt.Println(err)
-			app.render(w, r, "tickets.page.html", &data.TemplateData{
-				ErrorText: "No tickets yet",
-			})
+			app.modelError(w, r, err)
 			return
 		}
 		app.render(w, r, "tickets.page.html", &data.TemplateData{
@@ -234,12 +579,18 @@ func (app *application) showTicketHandler() http.Handler {
 }
 func (app *application) GetAllTickets() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tickets, err := app.models.Tickets.GetLatest()
+		// Customers only ever see their own tickets; cashiers and admins see
+		// everyone's.
+		user := contextGetUser(r)
+		var tickets []data.Ticket
+		var err error
+		if can(r, data.PermissionTicketsReadAll) {
+			tickets, err = app.models.Tickets.GetLatest(r.Context())
+		} else {
+			tickets, err = app.models.Tickets.GetByLogin(r.Context(), user.Login)
+		}
 		if err != nil {
-			fmt.Println(err)
-			app.render(w, r, "tickets.page.html", &data.TemplateData{
-				ErrorText: "No tickets yet",
-			})
+			app.modelError(w, r, err)
 			return
 		}
 		app.render(w, r, "tickets.page.html", &data.TemplateData{
@@ -254,7 +605,260 @@ func (app *application) GroceryStorehandle() http.Handler {
 	})
 }
 
-// GetByLogin(string)
-// GetAllUsers() ([]User, error)
-// DeleteUserByLogin(login string)
-// UpdateUserByLogin(login string, newUser User)
+// createAuthenticationTokenHandler exchanges a login and password for a signed
+// JWT that API clients send as "Authorization: Bearer <token>", plus a refresh
+// token for getting the next one.
+func (app *application) createAuthenticationTokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Login    string `json:"login"`
+			Password string `json:"password"`
+			TOTP     string `json:"totp"`
+		}
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestJSON(w, err)
+			return
+		}
+
+		v := validator.New()
+		v.Check(input.Login != "", "login", "must be provided")
+		// Only new passwords go through the password policy; one set before
+		// the policy was tightened must still work.
+		v.Check(input.Password != "", "password", "must be provided")
+		if !v.Valid() {
+			app.errorJSON(w, http.StatusUnprocessableEntity, v.Errors, nil)
+			return
+		}
+
+		attempt, wait, err := app.beginLogin(r, input.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if wait > 0 {
+			headers := http.Header{}
+			headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			app.errorJSON(w, http.StatusTooManyRequests, "too many failed attempts, try again later", headers)
+			return
+		}
+
+		user, err := app.models.Users.GetByLogin(r.Context(), input.Login)
+		if err != nil && !errors.Is(err, data.ErrNotFound) {
+			app.serverError(w, err)
+			return
+		}
+		if err != nil {
+			app.passwords.Dummy(input.Password)
+			app.invalidCredentialsJSON(w, r, attempt, input.Login, nil)
+			return
+		}
+		match, err := app.passwordMatches(r.Context(), &user, input.Password)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !match {
+			app.invalidCredentialsJSON(w, r, attempt, input.Login, &user)
+			return
+		}
+		if !user.Activated {
+			if err := app.loginPassed(r, attempt); err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.loginRejected(r, user.Login, "not activated")
+			app.errorJSON(w, http.StatusForbidden, "your user account must be activated to access this resource", nil)
+			return
+		}
+		if user.TOTPEnabled {
+			ok, err := app.verifySecondFactor(r, &user, input.TOTP)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if !ok {
+				if err := app.loginFailed(r, attempt, user.Login, &user); err != nil {
+					app.serverError(w, err)
+					return
+				}
+				app.errorJSON(w, http.StatusUnauthorized, "a valid totp code is required", nil)
+				return
+			}
+		}
+		err = app.loginSucceeded(r, attempt, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		session, err := app.newSession(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		refresh, err := app.newRefreshToken(r.Context(), user.Login, session, nil)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.writeTokenResponse(w, http.StatusCreated, user.Login, refresh)
+	})
+}
+
+// refreshTokenHandler swaps a refresh token for a new access token and a new
+// refresh token. API clients post {"refresh_token": "..."} and get the tokens
+// back as JSON; browsers send the refresh cookie and get new cookies.
+func (app *application) refreshTokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		fromCookie := false
+		if cookie, err := r.Cookie(refreshCookieName); err == nil && r.ContentLength == 0 {
+			input.RefreshToken = cookie.Value
+			fromCookie = true
+		} else if err := app.readJSON(w, r, &input); err != nil {
+			app.badRequestJSON(w, err)
+			return
+		}
+
+		v := validator.New()
+		if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+			app.errorJSON(w, http.StatusUnprocessableEntity, v.Errors, nil)
+			return
+		}
+
+		if fromCookie {
+			_, _, err := app.refreshCookieSession(w, r, input.RefreshToken)
+			if err != nil {
+				app.refreshError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		old, refresh, err := app.refreshSession(r.Context(), input.RefreshToken)
+		if err != nil {
+			app.refreshError(w, r, err)
+			return
+		}
+		app.writeTokenResponse(w, http.StatusOK, old.UserLogin, refresh)
+	})
+}
+
+func (app *application) refreshError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, data.ErrTokenReused):
+		app.logger.PrintWarning("refresh token reused, session revoked", r.RemoteAddr)
+		clearSessionCookies(w, r)
+		app.invalidAuthenticationTokenJSON(w)
+	case errors.Is(err, data.ErrNotFound):
+		app.invalidAuthenticationTokenJSON(w)
+	default:
+		app.serverError(w, err)
+	}
+}
+
+// writeTokenResponse sends a fresh JWT access token for login along with the
+// plaintext of its refresh token.
+func (app *application) writeTokenResponse(w http.ResponseWriter, status int, login string, refresh *data.Token) {
+	token, expiry, err := app.signAccessToken(login)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.writeJSON(w, status, data.Envelope{
+		"authentication_token": token,
+		"token_type":           "Bearer",
+		"expiry":               expiry,
+		"refresh_token":        refresh.Plaintext,
+		"refresh_expiry":       refresh.Expiry,
+	}, nil)
+	if err != nil {
+		app.serverError(w, err)
+	}
+}
+
+// jwksMaxAge is how long verifiers may cache the JWKS document. New signing
+// keys are published for at least that long before they sign anything.
+const jwksMaxAge = 5 * time.Minute
+
+// jwksHandler publishes the public keys used to sign our tokens so that other
+// services can verify them without sharing a secret.
+func (app *application) jwksHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := http.Header{}
+		headers.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+
+		err := app.writeJSON(w, http.StatusOK, app.keys.JWKS(), headers)
+		if err != nil {
+			app.serverError(w, err)
+		}
+	})
+}
+
+// sessionsHandler lists every device the user is logged in on.
+func (app *application) sessionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		sessions, err := app.models.Tokens.GetSessions(r.Context(), user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		td := &data.TemplateData{Sessions: sessions}
+		if session := contextGetSession(r); session != nil {
+			td.CurrentSession = session.Family
+		}
+		app.render(w, r, "sessions.page.html", td)
+	})
+}
+
+// revokeSessionHandler logs the user out of a single session.
+func (app *application) revokeSessionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		r.ParseForm()
+		id, err := primitive.ObjectIDFromHex(r.PostForm.Get("id"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		err = app.models.Tokens.DeleteSession(r.Context(), user.Login, id)
+		if err != nil && !errors.Is(err, data.ErrNotFound) {
+			app.serverError(w, err)
+			return
+		}
+		if err == nil {
+			app.audit(r, data.AuditSessionRevoke, user.Login, map[string]string{"id": id.Hex()})
+		}
+		http.Redirect(w, r, "/profile/sessions", http.StatusSeeOther)
+	})
+}
+
+// revokeOtherSessionsHandler logs the user out everywhere except the session
+// making the request.
+func (app *application) revokeOtherSessionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		keep := ""
+		if session := contextGetSession(r); session != nil {
+			keep = session.Family
+		}
+		err := app.models.Tokens.DeleteSessionsByLogin(r.Context(), user.Login, keep)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditSessionRevokeOthers, user.Login, nil)
+		http.Redirect(w, r, "/profile/sessions", http.StatusSeeOther)
+	})
+}
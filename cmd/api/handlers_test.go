@@ -0,0 +1,674 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/mailer"
+	"app/internal/password"
+	"app/internal/totp"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPassword = "Tr0ub4dor&3xQ!"
+
+// wantText fails the test unless the page res shows text.
+func wantText(t *testing.T, res testResponse, text string) {
+	t.Helper()
+
+	if !strings.Contains(res.body, html.EscapeString(text)) {
+		t.Errorf("page doesn't say %q:\n%s", text, res.body)
+	}
+}
+
+var activationLink = regexp.MustCompile(`/users/activate\?token=(\S+)`)
+
+func TestSignup(t *testing.T) {
+	app := newTestApplication(t)
+	c := newTestServer(t, app)
+
+	form := url.Values{
+		"login":    {"alice"},
+		"email":    {"alice@example.com"},
+		"name":     {"Alice"},
+		"password": {testPassword},
+	}
+	res := c.postForm(t, "/signup", form)
+	if res.status != http.StatusSeeOther || res.header.Get("Location") != "/users/activate" {
+		t.Fatalf("got status %d to %q; want 303 to /users/activate", res.status, res.header.Get("Location"))
+	}
+
+	user, err := app.models.Users.GetByLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Activated {
+		t.Error("new user is activated before following the link")
+	}
+	if user.Password == testPassword {
+		t.Error("password is stored in plaintext")
+	}
+
+	// The new account can't log in until it is activated.
+	res = c.postForm(t, "/login", url.Values{"login": {"alice"}, "password": {testPassword}})
+	wantText(t, res, "your account is not activated yet, please follow the link we emailed you")
+
+	app.wg.Wait()
+	msg, ok := app.mailer.(*mailer.Memory).Last("alice@example.com")
+	if !ok {
+		t.Fatal("no activation email sent")
+	}
+	m := activationLink.FindStringSubmatch(msg.PlainBody)
+	if m == nil {
+		t.Fatalf("no activation link in the email:\n%s", msg.PlainBody)
+	}
+
+	res = c.postForm(t, "/users/activate", url.Values{"token": {m[1]}})
+	if res.status != http.StatusSeeOther || c.cookie(accessCookieName) == "" {
+		t.Fatalf("activating: got status %d without a session", res.status)
+	}
+	if res := c.get(t, "/profile"); res.status != http.StatusOK {
+		t.Errorf("profile after activating: got status %d; want 200", res.status)
+	}
+
+	// The link works only once.
+	other := newTestServer(t, app)
+	res = other.postForm(t, "/users/activate", url.Values{"token": {m[1]}})
+	wantText(t, res, "invalid or expired activation token")
+}
+
+func TestSignupRejected(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	// Pwned Passwords knows a password the embedded list doesn't.
+	const breached = "Mxq7#Pwned!"
+	hash := fmt.Sprintf("%X", sha1.Sum([]byte(breached)))
+	pwned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/range/"+hash[:5] {
+			fmt.Fprintf(w, "%s:12\r\n", hash[5:])
+		}
+	}))
+	t.Cleanup(pwned.Close)
+	app.pwned = password.NewPwned(pwned.URL+"/range/", pwned.Client())
+
+	tests := []struct {
+		name  string
+		login string
+		email string
+		pw    string
+		want  string
+	}{
+		{"login taken", "alice", "other@example.com", testPassword, duplicateMessages["login"]},
+		{"email taken", "bob", "alice@example.com", testPassword, duplicateMessages["email"]},
+		{"common password", "bob", "bob@example.com", "Password1", "is too common, it appears in lists of breached passwords"},
+		{"breached password", "bob", "bob@example.com", breached, "is too common, it appears in lists of breached passwords"},
+		{"password contains login", "bobby", "bob@example.com", "bobby-Rocks-42!", "must not contain your login"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestServer(t, app)
+			res := c.postForm(t, "/signup", url.Values{
+				"login":    {tt.login},
+				"email":    {tt.email},
+				"name":     {"Someone"},
+				"password": {tt.pw},
+			})
+			if res.status != http.StatusOK {
+				t.Errorf("got status %d; want the form again", res.status)
+			}
+			wantText(t, res, tt.want)
+		})
+	}
+
+	users, err := app.models.Users.GetAllUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Errorf("got %d users; want only alice", len(users))
+	}
+}
+
+// Forms with fields left out are answered with the validation messages rather
+// than a server error.
+func TestMissingFields(t *testing.T) {
+	app := newTestApplication(t)
+	c := newTestServer(t, app)
+
+	res := c.postForm(t, "/signup", url.Values{"login": {"alice"}})
+	if res.status != http.StatusOK {
+		t.Errorf("signup: got status %d; want the form again", res.status)
+	}
+	wantText(t, res, "email must be provided")
+	wantText(t, res, "name must be provided")
+
+	res = c.postForm(t, "/login", url.Values{})
+	if res.status != http.StatusOK {
+		t.Errorf("login: got status %d; want the form again", res.status)
+	}
+	wantText(t, res, "login must be provided")
+	wantText(t, res, "password must be provided")
+}
+
+func TestLogin(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	c := newTestServer(t, app)
+
+	// Anonymous visitors are sent to log in.
+	res := c.get(t, "/profile")
+	if res.status != http.StatusSeeOther || res.header.Get("Location") != "/login" {
+		t.Fatalf("anonymous: got status %d to %q; want 303 to /login", res.status, res.header.Get("Location"))
+	}
+
+	// Wrong passwords and unknown logins get the same answer.
+	for _, form := range []url.Values{
+		{"login": {"alice"}, "password": {"wrong password"}},
+		{"login": {"nobody"}, "password": {testPassword}},
+	} {
+		res := c.postForm(t, "/login", form)
+		wantText(t, res, "invalid login or password")
+		if c.cookie(accessCookieName) != "" {
+			t.Fatalf("%s: got a session", form.Get("login"))
+		}
+	}
+
+	c.login(t, "alice", testPassword)
+	res = c.get(t, "/profile")
+	if res.status != http.StatusOK {
+		t.Fatalf("profile: got status %d; want 200", res.status)
+	}
+	wantText(t, res, "alice@example.com")
+}
+
+func TestLoginThrottled(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	c := newTestServer(t, app)
+	for i := 0; i < app.limiters.login.FreeAttempts; i++ {
+		res := c.postForm(t, "/login", url.Values{"login": {"alice"}, "password": {"wrong password"}})
+		wantText(t, res, "invalid login or password")
+	}
+
+	// Once the free attempts are used up even the right password has to wait.
+	res := c.postForm(t, "/login", url.Values{"login": {"alice"}, "password": {testPassword}})
+	if res.status != http.StatusTooManyRequests {
+		t.Fatalf("got status %d; want 429", res.status)
+	}
+	if res.header.Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	if c.cookie(accessCookieName) != "" {
+		t.Error("got a session while throttled")
+	}
+}
+
+// tokenResponse is the body of the token endpoints.
+type tokenResponse struct {
+	AuthenticationToken string `json:"authentication_token"`
+	RefreshToken        string `json:"refresh_token"`
+}
+
+func decodeTokens(t *testing.T, res testResponse) tokenResponse {
+	t.Helper()
+
+	var tokens tokenResponse
+	if err := json.Unmarshal([]byte(res.body), &tokens); err != nil {
+		t.Fatalf("%v: %s", err, res.body)
+	}
+	if tokens.AuthenticationToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("missing tokens: %s", res.body)
+	}
+	return tokens
+}
+
+func TestRefreshToken(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	c := newTestServer(t, app)
+
+	res := c.postJSON(t, "/tokens/authentication", map[string]string{"login": "alice", "password": "wrong password"}, "")
+	if res.status != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got status %d; want 401", res.status)
+	}
+
+	res = c.postJSON(t, "/tokens/authentication", map[string]string{"login": "alice", "password": testPassword}, "")
+	if res.status != http.StatusCreated {
+		t.Fatalf("authentication: got status %d; want 201: %s", res.status, res.body)
+	}
+	first := decodeTokens(t, res)
+
+	res = c.postJSON(t, "/tokens/refresh", map[string]string{"refresh_token": first.RefreshToken}, "")
+	if res.status != http.StatusOK {
+		t.Fatalf("refresh: got status %d; want 200: %s", res.status, res.body)
+	}
+	second := decodeTokens(t, res)
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("refresh token wasn't rotated")
+	}
+
+	// The new access token works as a bearer token.
+	req, err := http.NewRequest(http.MethodGet, c.ts.URL+"/receipt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+second.AuthenticationToken)
+	if res := c.do(t, req); res.status != http.StatusOK {
+		t.Errorf("bearer request: got status %d; want 200", res.status)
+	}
+
+	// A request that raced the rotation gets the same replacement.
+	res = c.postJSON(t, "/tokens/refresh", map[string]string{"refresh_token": first.RefreshToken}, "")
+	if res.status != http.StatusOK {
+		t.Fatalf("refresh within the grace: got status %d; want 200: %s", res.status, res.body)
+	}
+	if again := decodeTokens(t, res); again.RefreshToken != second.RefreshToken {
+		t.Error("refresh within the grace got a different replacement")
+	}
+
+	// Past the grace, a refresh token used twice has been stolen, so the whole
+	// session goes.
+	app.config.session.refreshGrace = 0
+	res = c.postJSON(t, "/tokens/refresh", map[string]string{"refresh_token": first.RefreshToken}, "")
+	if res.status != http.StatusUnauthorized {
+		t.Fatalf("reused token: got status %d; want 401", res.status)
+	}
+	res = c.postJSON(t, "/tokens/refresh", map[string]string{"refresh_token": second.RefreshToken}, "")
+	if res.status != http.StatusUnauthorized {
+		t.Errorf("token of the revoked session: got status %d; want 401", res.status)
+	}
+}
+
+func TestRefreshCookie(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	c := newTestServer(t, app)
+	c.login(t, "alice", testPassword)
+	old := c.cookie(refreshCookieName)
+
+	// Browsers refresh with the cookie, and need the CSRF token to do so.
+	req, err := http.NewRequest(http.MethodPost, c.ts.URL+"/tokens/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := c.do(t, req); res.status != http.StatusForbidden {
+		t.Fatalf("without CSRF token: got status %d; want 403", res.status)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, c.ts.URL+"/tokens/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(csrfHeaderName, c.cookie(csrfCookieName))
+	if res := c.do(t, req); res.status != http.StatusNoContent {
+		t.Fatalf("got status %d; want 204", res.status)
+	}
+	if c.cookie(refreshCookieName) == old {
+		t.Error("refresh cookie wasn't rotated")
+	}
+	if res := c.get(t, "/profile"); res.status != http.StatusOK {
+		t.Errorf("profile after refreshing: got status %d; want 200", res.status)
+	}
+}
+
+func TestTickets(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+	insertUser(t, app, "bob", "bob@example.com", testPassword, data.RoleCustomer)
+	insertUser(t, app, "carol", "carol@example.com", testPassword, data.RoleCashier)
+
+	for _, ticket := range []data.Ticket{
+		{ID: "ticket-alice", UserLogin: "alice", Total: 350, Products: []data.Product{{Name: "milk", Price: 175, Amount: 2}}},
+		{ID: "ticket-bob", UserLogin: "bob", Total: 120, Products: []data.Product{{Name: "bread", Price: 120, Amount: 1}}},
+	} {
+		if _, err := app.models.Tickets.Insert(context.Background(), ticket); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	anonymous := newTestServer(t, app)
+	if res := anonymous.get(t, "/receipt"); res.status != http.StatusSeeOther {
+		t.Errorf("anonymous: got status %d; want 303 to log in", res.status)
+	}
+
+	alice := newTestServer(t, app)
+	alice.login(t, "alice", testPassword)
+
+	// Customers see their own tickets only, and someone else's is as good as
+	// missing.
+	res := alice.get(t, "/receipt")
+	if res.status != http.StatusOK {
+		t.Fatalf("list: got status %d; want 200", res.status)
+	}
+	wantText(t, res, "ticket-alice")
+	if strings.Contains(res.body, "ticket-bob") {
+		t.Error("customer sees another customer's ticket")
+	}
+	if res := alice.get(t, "/receipt/ticket-alice"); res.status != http.StatusOK {
+		t.Errorf("own ticket: got status %d; want 200", res.status)
+	}
+	for _, id := range []string{"ticket-bob", "no-such-ticket"} {
+		if res := alice.get(t, "/receipt/"+id); res.status != http.StatusNotFound {
+			t.Errorf("%s: got status %d; want 404", id, res.status)
+		}
+	}
+	if res := alice.get(t, "/product"); res.status != http.StatusForbidden {
+		t.Errorf("customer creating tickets: got status %d; want 403", res.status)
+	}
+
+	// Cashiers see everyone's.
+	carol := newTestServer(t, app)
+	carol.login(t, "carol", testPassword)
+	res = carol.get(t, "/receipt")
+	wantText(t, res, "ticket-alice")
+	wantText(t, res, "ticket-bob")
+	if res := carol.get(t, "/receipt/ticket-bob"); res.status != http.StatusOK {
+		t.Errorf("cashier: got status %d; want 200", res.status)
+	}
+	if res := carol.get(t, "/product"); res.status != http.StatusOK {
+		t.Errorf("cashier creating tickets: got status %d; want 200", res.status)
+	}
+}
+
+func TestCreateTicket(t *testing.T) {
+	app := newTestApplication(t)
+
+	form := url.Values{"login": {"alice"}, "productName": {"milk"}, "price": {"175"}, "amount": {"2"}}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	app.createTicketHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want 200", rr.Code)
+	}
+
+	tickets, err := app.models.Tickets.GetByLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) != 1 {
+		t.Fatalf("got %d tickets; want 1", len(tickets))
+	}
+	want := data.Product{Name: "milk", Price: 175, Amount: 2}
+	if got := tickets[0].Products; len(got) != 1 || got[0] != want {
+		t.Errorf("got products %+v; want %+v", got, want)
+	}
+}
+
+func TestEnrollTwoFactor(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	c := newTestServer(t, app)
+	c.login(t, "alice", testPassword)
+
+	res := c.postForm(t, "/profile/2fa/enroll", url.Values{})
+	if res.status != http.StatusOK {
+		t.Fatalf("enroll: got status %d; want 200: %s", res.status, res.body)
+	}
+	user, err := app.models.Users.GetByLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := app.cipher.DecryptString(user.TOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The page has a QR code to scan and the key to type in, but not the
+	// provisioning URI as text.
+	if !strings.Contains(res.body, "<svg") {
+		t.Error("page has no QR code")
+	}
+	wantText(t, res, secret)
+	if strings.Contains(res.body, "otpauth://") {
+		t.Error("page shows the provisioning URI")
+	}
+
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = c.postForm(t, "/profile/2fa/confirm", url.Values{"code": {code}})
+	if res.status != http.StatusSeeOther {
+		t.Fatalf("confirm: got status %d; want 303: %s", res.status, res.body)
+	}
+	user, err = app.models.Users.GetByLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.TOTPEnabled {
+		t.Error("two-factor authentication wasn't turned on")
+	}
+}
+
+func TestAdminResetPassword(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "admin", "admin@example.com", testPassword, data.RoleAdmin)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+	ctx := context.Background()
+	if _, err := app.models.APIKeys.New(ctx, "alice", "script", []string{data.PermissionTicketsReadOwn}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestServer(t, app)
+	c.login(t, "admin", testPassword)
+	res := c.postForm(t, "/admin/users/alice/reset-password", url.Values{})
+	if res.status != http.StatusSeeOther {
+		t.Fatalf("got status %d; want 303: %s", res.status, res.body)
+	}
+
+	// The old password stops working, but the account still has one: it
+	// mustn't pass for an account that only logs in through a provider.
+	user, err := app.models.Users.GetByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Password == "" {
+		t.Error("reset left an empty password hash")
+	}
+	if match, _, _ := app.passwords.Verify(testPassword, user.Password); match {
+		t.Error("old password still matches")
+	}
+	keys, err := app.models.APIKeys.GetAllForUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got %d API keys after the reset; want none", len(keys))
+	}
+	if _, ok := app.mailer.(*mailer.Memory).Last("alice@example.com"); !ok {
+		t.Error("no reset email sent")
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	c := newTestServer(t, app)
+	c.login(t, "alice", testPassword)
+
+	form := url.Values{"login": {"alice"}, "email": {"alice@example.com"}, "name": {"Alice Liddell"}}
+	res := c.postForm(t, "/profile", form)
+	if res.status != http.StatusSeeOther || res.header.Get("Location") != "/profile" {
+		t.Fatalf("got status %d to %q; want 303 to /profile: %s", res.status, res.header.Get("Location"), res.body)
+	}
+	res = c.get(t, "/profile")
+	wantText(t, res, "Your profile has been updated.")
+	wantText(t, res, "Alice Liddell")
+
+	// Guessing the current password to change the email is throttled like
+	// logging in.
+	form.Set("email", "mallory@example.com")
+	form.Set("current_password", "wrong password")
+	for i := 0; i < app.limiters.login.FreeAttempts; i++ {
+		res := c.postForm(t, "/profile", form)
+		wantText(t, res, "enter your current password to change your login, email or password")
+	}
+	form.Set("current_password", testPassword)
+	res = c.postForm(t, "/profile", form)
+	if res.status != http.StatusTooManyRequests {
+		t.Fatalf("got status %d; want 429", res.status)
+	}
+	if res.header.Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	user, err := app.models.Users.GetByLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" {
+		t.Errorf("got email %q while throttled; want alice@example.com", user.Email)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCashier)
+	key, err := app.models.APIKeys.New(context.Background(), "alice", "script", []string{data.PermissionTicketsReadOwn}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestServer(t, app)
+	request := func(method, path string) testResponse {
+		t.Helper()
+		req, err := http.NewRequest(method, c.ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key.Plaintext)
+		return c.do(t, req)
+	}
+
+	// The key works where its scope is accepted.
+	if res := request(http.MethodGet, "/receipt"); res.status != http.StatusOK {
+		t.Errorf("receipts: got status %d; want 200", res.status)
+	}
+	// But not on the routes that don't take keys, nor on ones that need a
+	// scope it doesn't have, even though alice's role would allow them.
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/profile"},
+		{http.MethodPost, "/profile/delete"},
+		{http.MethodGet, "/profile/data"},
+		{http.MethodPost, "/profile/2fa/enroll"},
+		{http.MethodGet, "/profile/sessions"},
+		{http.MethodPost, "/profile/api-keys/revoke"},
+		{http.MethodPost, "/product"},
+	} {
+		if res := request(route.method, route.path); res.status != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d; want 403", route.method, route.path, res.status)
+		}
+	}
+	if _, err := app.models.Users.GetByLogin(context.Background(), "alice"); err != nil {
+		t.Errorf("alice after the key tried to delete her: %v", err)
+	}
+}
+
+func TestListAPIKeysWithoutPermission(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+	key, err := app.models.APIKeys.New(context.Background(), "alice", "old script", []string{data.PermissionTicketsReadOwn}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Customers can't make keys, but they can see and revoke the ones they
+	// have, say from when they were a cashier.
+	c := newTestServer(t, app)
+	c.login(t, "alice", testPassword)
+	res := c.get(t, "/profile/api-keys")
+	if res.status != http.StatusOK {
+		t.Fatalf("list: got status %d; want 200", res.status)
+	}
+	wantText(t, res, "old script")
+	if strings.Contains(res.body, "Create key") {
+		t.Error("page offers to create a key")
+	}
+
+	res = c.postForm(t, "/profile/api-keys/revoke", url.Values{"id": {key.ID.Hex()}})
+	if res.status != http.StatusSeeOther {
+		t.Fatalf("revoke: got status %d; want 303", res.status)
+	}
+	keys, err := app.models.APIKeys.GetAllForUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got %d keys after revoking; want none", len(keys))
+	}
+
+	res = c.postForm(t, "/profile/api-keys", url.Values{"name": {"new"}, "scopes": {data.PermissionTicketsReadOwn}})
+	if res.status != http.StatusForbidden {
+		t.Errorf("create: got status %d; want 403", res.status)
+	}
+}
+
+// failingAPIKeys is an API key repository whose DeleteAllForUser fails while
+// fail is set.
+type failingAPIKeys struct {
+	data.APIKeyRepository
+	fail bool
+}
+
+func (f *failingAPIKeys) DeleteAllForUser(ctx context.Context, login string) error {
+	if f.fail {
+		return errors.New("database unavailable")
+	}
+	return f.APIKeyRepository.DeleteAllForUser(ctx, login)
+}
+
+func TestDeleteAccountRetry(t *testing.T) {
+	app := newTestApplication(t)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+	ctx := context.Background()
+	if _, err := app.models.Tickets.Insert(ctx, data.Ticket{ID: "1", UserLogin: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.models.APIKeys.New(ctx, "alice", "script", []string{data.PermissionTicketsReadOwn}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	keys := &failingAPIKeys{APIKeyRepository: app.models.APIKeys, fail: true}
+	app.models.APIKeys = keys
+
+	// A deletion that fails halfway leaves the account to try again from.
+	if err := app.deleteAccount(ctx, "alice"); err == nil {
+		t.Fatal("got no error from the failing deletion")
+	}
+	if _, err := app.models.Users.GetByLogin(ctx, "alice"); err != nil {
+		t.Fatalf("alice after the failed deletion: %v", err)
+	}
+
+	keys.fail = false
+	for i := 0; i < 2; i++ {
+		if err := app.deleteAccount(ctx, "alice"); err != nil {
+			t.Fatalf("deletion %d: %v", i+1, err)
+		}
+	}
+	if _, err := app.models.Users.GetByLogin(ctx, "alice"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("looking alice up: got error %v; want ErrNotFound", err)
+	}
+	if left, err := app.models.APIKeys.GetAllForUser(ctx, "alice"); err != nil || len(left) != 0 {
+		t.Errorf("got %d API keys, error %v; want none", len(left), err)
+	}
+	if left, err := app.models.Tickets.GetByLogin(ctx, "alice"); err != nil || len(left) != 0 {
+		t.Errorf("got %d tickets still alice's, error %v; want none", len(left), err)
+	}
+}
@@ -4,12 +4,21 @@ import (
 	"app/internal/data"
 	"app/internal/validator"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 )
 
 func (app *application) render(w http.ResponseWriter, r *http.Request, name string, td *data.TemplateData) {
+	app.renderStatus(w, r, http.StatusOK, name, td)
+}
+
+// renderStatus is render with another status than 200 OK. The status must not
+// be written beforehand: the session is saved along with the header, so the
+// flash message popped here would come back on the next page.
+func (app *application) renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, td *data.TemplateData) {
 	// Retrieve the appropriate template set from the cache based on the page name
 	// (like 'home.page.gohtml'). If no entry exists in the cache with the provided name,
 	// call the serverError helper method.
@@ -29,9 +38,19 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 	if td.Code == 0 {
 		td.Code = 200
 	}
-	// td.Flash = app.session.PopString(r, "flash")
-	// td.IsAuthenticated = app.isAuthenticated(r)
-	// td.CSRFToken = nosurf.Token(r)
+	td.Flash = app.session.Pop(r, "flash")
+	td.CSRFToken = csrfToken(r)
+	for _, p := range app.providers {
+		td.Providers = append(td.Providers, data.LoginProvider{Name: p.Name, DisplayName: p.DisplayName})
+	}
+	if user := contextGetUser(r); user != nil {
+		td.User = *user
+		td.HasPassword = user.Password != ""
+		td.User.Password = ""
+		td.User.TOTPSecret = ""
+		td.User.RecoveryCodes = nil
+		td.IsAuthenticated = true
+	}
 
 	err := ts.Execute(buff, td)
 	if err != nil {
@@ -41,6 +60,7 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 
 	// Write the contents of the buffer to the http.ResponseWriter. Again, this is another place
 	// where we pass our http.ResponseWriter to a function that take an io.Writer
+	w.WriteHeader(status)
 	if _, err = buff.WriteTo(w); err != nil {
 		app.serverError(w, err)
 		return
@@ -48,27 +68,89 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 }
 
 func (app *application) serverError(w http.ResponseWriter, err error) {
+	if app.databaseError(w, err) {
+		return
+	}
 	app.logger.PrintError(err.Error(), "server error")
 
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+// writeJSON encodes data as JSON and writes it with the given status code and
+// any additional headers.
+func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+	return nil
+}
+
+// readJSON decodes a JSON request body of at most 1MB into dst, rejecting
+// unknown fields and trailing data.
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		return fmt.Errorf("body contains badly-formed JSON: %w", err)
+	}
+	if dec.More() {
+		return errors.New("body must only contain a single JSON value")
+	}
+	return nil
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(len(email) < 5000, "email", "must not be more than 5000 bytes long")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
-func ValidatePassword(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+
+// ValidatePassword checks a new password against the password policy. The
+// user's login, email and name go in info so the password can't contain them.
+func ValidatePassword(v *validator.Validator, password string, info validator.PersonalInfo) {
+	v.CheckPassword(password, info)
 }
+
+// checkBreached adds the same error as the embedded common password list to v
+// when password turns up in the Pwned Passwords corpus. It is only asked about
+// passwords that passed the rest of the policy. If it can't be reached the
+// password goes ahead, so an outage there doesn't stop signups, and the
+// embedded list is all that applies.
+func (app *application) checkBreached(r *http.Request, v *validator.Validator, password string) {
+	if _, exists := v.Errors["password"]; exists || app.pwned == nil || password == "" {
+		return
+	}
+	breached, err := app.pwned.Breached(r.Context(), password)
+	if err != nil {
+		app.logger.PrintError(err.Error(), "failed to check password against pwned passwords")
+		return
+	}
+	v.Check(!breached, "password", v.Message("password.common"))
+}
+
 func ValidateUser(v *validator.Validator, user *data.User) {
 	v.Check(user.Login != "", "login", "must be provided")
 	v.Check(len(user.Login) <= 500, "name", "must not be more than 500 bytes long")
 	v.Check(user.Name != "", "name", "must be provided")
 	ValidateEmail(v, user.Email)
-	ValidatePassword(v, user.Password)
+	ValidatePassword(v, user.Password, validator.PersonalInfo{
+		Login: user.Login,
+		Email: user.Email,
+		Name:  user.Name,
+	})
 	// If the password hash is ever nil, this will be due to a logic error in our
 	// codebase (probably because we forgot to set a password for the user). It's a
 	// useful sanity check to include here, but it's not a problem with the data
@@ -76,6 +158,18 @@ func ValidateUser(v *validator.Validator, user *data.User) {
 	// raise a panic instead.
 }
 
+// newValidator returns a validator writing its messages in the language the
+// client prefers.
+func newValidator(r *http.Request) *validator.Validator {
+	v := validator.New()
+	v.Lang = validator.Language(r.Header.Get("Accept-Language"))
+	return v
+}
+
+// background runs fn in a goroutine that the server waits for on shutdown. fn
+// usually runs after the response has been sent, when the request's context is
+// already cancelled, so the queries it makes use context.Background() and rely
+// on the models' default deadlines instead.
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 
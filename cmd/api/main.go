@@ -2,11 +2,22 @@ package main
 
 import (
 	"app/internal/data"
+	"app/internal/encrypt"
+	"app/internal/jwt"
+	"app/internal/mailer"
+	"app/internal/oidc"
+	"app/internal/password"
+	"app/internal/session"
+	"app/internal/throttle"
 	"app/internal/woodlog"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"net/http"
 	"os"
 	"sync"
 	"time"
@@ -15,21 +26,84 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type application struct {
 	config        config
 	models        data.Models
+	keys          *jwt.KeySet
+	providers     []*oidc.Provider
+	mailer        mailer.Mailer
+	cipher        *encrypt.Cipher
+	passwords     *password.Manager
+	pwned         *password.Pwned // nil when new passwords are only checked against the embedded list
+	session       *session.Manager
 	logger        *woodlog.Logger
 	templateCache map[string]*template.Template
 
+	limiters struct {
+		ip    *throttle.Limiter
+		login *throttle.Limiter
+	}
+
 	wg sync.WaitGroup
 }
 
 type config struct {
-	port string
-	db   struct {
-		dns string
+	port          string
+	baseURL       string
+	encryptionKey string
+	admin         string
+	dev           bool
+	db            struct {
+		dns      string
+		backend  string
+		timeouts data.Timeouts
+	}
+	session struct {
+		accessTTL   time.Duration
+		maxLifetime time.Duration
+		idleTimeout time.Duration
+		// refreshGrace is how long a rotated refresh token still gets the same
+		// replacement instead of being taken for a stolen one.
+		refreshGrace time.Duration
+		store        string
+	}
+	mailer struct {
+		backend string
+		dir     string
+		sender  string
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+	}
+	throttle struct {
+		store string
+	}
+	password struct {
+		hasher            string
+		bcryptCost        int
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+		pwnedURL          string
+	}
+	oidc struct {
+		config string
+	}
+	jwt struct {
+		keys   string
+		issuer string
+		ttl    time.Duration
+		alg    string
+		rotate time.Duration
+		// rotateSet is whether -jwt-rotate was given on the command line.
+		rotateSet bool
+		retain    time.Duration
 	}
 }
 
@@ -40,6 +114,60 @@ func main() {
 	fmt.Println(os.Getenv("PORT"))
 	// flag.StringVar(&config.db.dns, "uri", os.Getenv("MONGOURI"), "mongo uri")
 	flag.StringVar(&config.db.dns, "uri", "mongodb://localhost:27017/advanced", "mongo uri")
+	flag.StringVar(&config.db.backend, "db-backend", data.BackendMongo, "where data is stored (mongo|memory); memory needs no database and forgets everything on exit")
+	flag.DurationVar(&config.db.timeouts.Read, "db-read-timeout", data.DefaultTimeouts.Read, "deadline of queries that look up a single document (0 for none)")
+	flag.DurationVar(&config.db.timeouts.Write, "db-write-timeout", data.DefaultTimeouts.Write, "deadline of inserts, updates and deletes (0 for none)")
+	flag.DurationVar(&config.db.timeouts.List, "db-list-timeout", data.DefaultTimeouts.List, "deadline of searches, listings and exports (0 for none)")
+
+	flag.StringVar(&config.baseURL, "base-url", os.Getenv("BASE_URL"), "public URL of the app, used in emailed links (default http://localhost:<port>)")
+
+	flag.StringVar(&config.encryptionKey, "encryption-key", os.Getenv("ENCRYPTION_KEY"), "hex encoded 32 byte key for encrypting secrets at rest")
+
+	flag.BoolVar(&config.dev, "dev", false, "development mode: generate throwaway jwt signing and encryption keys when none are configured")
+
+	flag.StringVar(&config.admin, "admin", os.Getenv("ADMIN_LOGIN"), "login of a user to grant the admin role at startup")
+
+	flag.StringVar(&config.mailer.backend, "mailer", "file", "mailer backend (smtp|file|memory)")
+	flag.StringVar(&config.mailer.dir, "mail-dir", "./tmp/mail", "directory the file mailer writes emails to")
+	flag.StringVar(&config.mailer.sender, "mail-sender", "Grocery Store <no-reply@grocery.local>", "sender of emails")
+	flag.StringVar(&config.smtp.host, "smtp-host", os.Getenv("SMTP_HOST"), "smtp host")
+	flag.IntVar(&config.smtp.port, "smtp-port", 587, "smtp port")
+	flag.StringVar(&config.smtp.username, "smtp-username", os.Getenv("SMTP_USERNAME"), "smtp username")
+	flag.StringVar(&config.smtp.password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "smtp password")
+
+	flag.DurationVar(&config.session.accessTTL, "access-ttl", 15*time.Minute, "lifetime of session access tokens")
+	flag.DurationVar(&config.session.maxLifetime, "session-max-lifetime", 30*24*time.Hour, "absolute maximum lifetime of a session")
+	flag.DurationVar(&config.session.idleTimeout, "session-idle-timeout", 7*24*time.Hour, "how long a session survives without activity")
+	flag.DurationVar(&config.session.refreshGrace, "refresh-grace", 30*time.Second, "how long a rotated refresh token still gets the same replacement, for requests that refresh at the same time")
+	flag.StringVar(&config.session.store, "session-store", "cookie", "where session values such as flash messages are kept (cookie|mongo)")
+
+	flag.StringVar(&config.password.hasher, "password-hasher", "argon2id", "algorithm new passwords are hashed with (argon2id|bcrypt)")
+	flag.IntVar(&config.password.bcryptCost, "bcrypt-cost", 12, "bcrypt cost")
+	flag.UintVar(&config.password.argon2Memory, "argon2-memory", uint(password.DefaultArgon2id.Memory), "argon2id memory in KiB")
+	flag.UintVar(&config.password.argon2Iterations, "argon2-iterations", uint(password.DefaultArgon2id.Iterations), "argon2id iterations")
+	flag.UintVar(&config.password.argon2Parallelism, "argon2-parallelism", uint(password.DefaultArgon2id.Parallelism), "argon2id degree of parallelism")
+	flag.StringVar(&config.password.pwnedURL, "pwned-passwords-url", password.DefaultPwnedURL, "Pwned Passwords range endpoint new passwords are checked against (empty to only use the embedded list)")
+
+	flag.StringVar(&config.throttle.store, "throttle-store", "", "where failed login counters are kept (memory|mongo) (default the -db-backend)")
+
+	flag.StringVar(&config.oidc.config, "oidc-config", os.Getenv("OIDC_CONFIG"), "JSON file listing the OpenID Connect providers users can log in with")
+
+	flag.StringVar(&config.jwt.keys, "jwt-keys", os.Getenv("JWT_KEYS_FILE"), "PEM file of jwt signing keys, the first one signs (default the JWT_KEYS environment variable)")
+	flag.StringVar(&config.jwt.issuer, "jwt-issuer", "goproject", "jwt issuer and audience")
+	flag.DurationVar(&config.jwt.ttl, "jwt-ttl", 15*time.Minute, "lifetime of jwt access tokens")
+	flag.StringVar(&config.jwt.alg, "jwt-alg", jwt.EdDSA, "algorithm of generated jwt signing keys (RS256|EdDSA)")
+	flag.DurationVar(&config.jwt.rotate, "jwt-rotate", 24*time.Hour, "rotation interval of generated jwt signing keys (0 to disable); keys loaded from -jwt-keys or JWT_KEYS aren't rotated")
+	flag.DurationVar(&config.jwt.retain, "jwt-retain", 48*time.Hour, "how long retired jwt keys stay valid for verification")
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "jwt-rotate" {
+			config.jwt.rotateSet = true
+		}
+	})
+
+	if config.baseURL == "" {
+		config.baseURL = "http://localhost:" + config.port
+	}
 
 	logger := *woodlog.New(os.Stdout, 0)
 
@@ -48,14 +176,97 @@ func main() {
 		logger.PrintFatal(err.Error(), "failed to create template cache")
 	}
 
-	db := mustOpenDB(config.db.dns)
-	defer db.Client().Disconnect(context.TODO())
+	keys, rotate, err := newKeySet(config, &logger)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "failed to load jwt signing keys")
+	}
+	stopRotation := keys.StartRotation(rotate, func(err error) {
+		logger.PrintError(err.Error(), "failed to rotate jwt signing key")
+	})
+	defer stopRotation()
+
+	cipher, err := newCipher(config, &logger)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "invalid encryption key")
+	}
+
+	passwords, err := newPasswordManager(config)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "invalid password hashing settings")
+	}
+
+	mail, err := newMailer(config)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "failed to create mailer")
+	}
+
+	providers, err := newProviders(config)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "failed to load oidc providers")
+	}
+
+	// The memory backend runs the whole app without any infrastructure, so
+	// Mongo isn't even connected to.
+	var db *mongo.Database
+	if config.db.backend == data.BackendMongo {
+		db = mustOpenDB(config.db.dns)
+		defer db.Client().Disconnect(context.TODO())
+	}
+
+	models, err := data.NewModels(config.db.backend, db, config.db.timeouts)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "failed to create models")
+	}
+
+	sessions, err := newSessionManager(config, cipher, db, &logger)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "failed to create session store")
+	}
 
 	app := application{
 		templateCache: templateCache,
 		config:        config,
 		logger:        &logger,
-		models:        data.NewModels(db),
+		models:        models,
+		keys:          keys,
+		providers:     providers,
+		mailer:        mail,
+		cipher:        cipher,
+		passwords:     passwords,
+		session:       sessions,
+	}
+	if config.password.pwnedURL != "" {
+		app.pwned = password.NewPwned(config.password.pwnedURL, &http.Client{Timeout: 5 * time.Second})
+	}
+
+	// There is no way to become an admin from the app itself until there is a
+	// first admin, so one is named at startup.
+	if config.admin != "" {
+		err = app.models.Users.UpdateRole(context.Background(), config.admin, data.RoleAdmin)
+		if err != nil {
+			logger.PrintFatal(err.Error(), "failed to grant the admin role to "+config.admin)
+		}
+	}
+
+	store, err := newThrottleStore(config, db)
+	if err != nil {
+		logger.PrintFatal(err.Error(), "failed to create login throttle store")
+	}
+	app.limiters.ip = &throttle.Limiter{
+		Store:        store,
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		Window:       time.Hour,
+	}
+	app.limiters.login = &throttle.Limiter{
+		Store:        store,
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		LockAfter:    10,
+		LockFor:      15 * time.Minute,
+		Window:       24 * time.Hour,
 	}
 
 	err = app.serve()
@@ -64,6 +275,181 @@ func main() {
 	}
 }
 
+// newKeySet loads the jwt signing keys from the -jwt-keys file or the JWT_KEYS
+// environment variable, and returns how often they should be rotated.
+// Generated keys die with the process, taking every token they signed with
+// them, so they are only used as a fallback with -dev.
+//
+// Loaded keys are never rotated: every instance sharing them would generate a
+// next key of its own, and within a day they would reject each other's tokens.
+// They are rotated by replacing the file instead.
+func newKeySet(cfg config, logger *woodlog.Logger) (*jwt.KeySet, time.Duration, error) {
+	pemData := []byte(os.Getenv("JWT_KEYS"))
+	if cfg.jwt.keys != "" {
+		var err error
+		pemData, err = os.ReadFile(cfg.jwt.keys)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if len(pemData) == 0 {
+		if !cfg.dev {
+			return nil, 0, errors.New("no jwt signing keys configured, set -jwt-keys or JWT_KEYS, or run with -dev")
+		}
+		logger.PrintWarning("no jwt signing keys configured, using temporary ones", "set -jwt-keys")
+		keys, err := jwt.NewKeySet(cfg.jwt.alg, jwksMaxAge, cfg.jwt.retain)
+		return keys, cfg.jwt.rotate, err
+	}
+
+	if cfg.jwt.rotateSet && cfg.jwt.rotate != 0 {
+		return nil, 0, errors.New("-jwt-rotate can't be used with keys loaded from -jwt-keys or JWT_KEYS, rotate them by replacing the keys instead")
+	}
+	keys, err := jwt.ParsePrivateKeys(pemData)
+	if err != nil {
+		return nil, 0, err
+	}
+	keySet, err := jwt.LoadKeySet(keys, jwksMaxAge, cfg.jwt.retain)
+	return keySet, 0, err
+}
+
+// newCipher returns the cipher for secrets stored in the database, keyed by
+// -encryption-key.
+func newCipher(cfg config, logger *woodlog.Logger) (*encrypt.Cipher, error) {
+	key, err := hex.DecodeString(cfg.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	// A temporary key makes every secret encrypted with it, such as TOTP
+	// seeds, unreadable after a restart, so it is only acceptable with -dev.
+	if len(key) == 0 {
+		if !cfg.dev {
+			return nil, errors.New("no encryption key configured, set ENCRYPTION_KEY or run with -dev")
+		}
+		logger.PrintWarning("no encryption key configured, using a temporary one", "set ENCRYPTION_KEY")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return encrypt.New(key)
+}
+
+// newPasswordManager returns the password hasher configured by the -password-*
+// flags. Hashes made by the other algorithm are still accepted, and replaced
+// with the configured one when their owner next logs in.
+func newPasswordManager(cfg config) (*password.Manager, error) {
+	if cfg.password.bcryptCost < bcrypt.MinCost || cfg.password.bcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if cfg.password.argon2Memory < 8*1024 || cfg.password.argon2Iterations < 1 ||
+		cfg.password.argon2Parallelism < 1 || cfg.password.argon2Parallelism > 255 {
+		return nil, fmt.Errorf("argon2id needs at least 8 MiB of memory, one iteration and a parallelism of 1 to 255")
+	}
+
+	bc := password.Bcrypt{Cost: cfg.password.bcryptCost}
+	a2 := password.DefaultArgon2id
+	a2.Memory = uint32(cfg.password.argon2Memory)
+	a2.Iterations = uint32(cfg.password.argon2Iterations)
+	a2.Parallelism = uint8(cfg.password.argon2Parallelism)
+
+	switch cfg.password.hasher {
+	case "argon2id":
+		return password.NewManager(a2, bc), nil
+	case "bcrypt":
+		return password.NewManager(bc, a2), nil
+	default:
+		return nil, fmt.Errorf("unknown password hasher %q", cfg.password.hasher)
+	}
+}
+
+// newProviders returns the OpenID providers listed in the file given by
+// -oidc-config, if any.
+func newProviders(cfg config) ([]*oidc.Provider, error) {
+	if cfg.oidc.config == "" {
+		return nil, nil
+	}
+	configs, err := oidc.LoadConfig(cfg.oidc.config)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var providers []*oidc.Provider
+	for _, c := range configs {
+		c.RedirectURL = cfg.baseURL + "/auth/oidc/" + c.Name + "/callback"
+		providers = append(providers, oidc.NewProvider(c, client))
+	}
+	return providers, nil
+}
+
+// newThrottleStore returns where failed logins are counted. Only the Mongo
+// store makes the limits hold across several instances of the app. Unless
+// chosen otherwise, the counters are kept where the rest of the data is.
+func newThrottleStore(cfg config, db *mongo.Database) (throttle.Store, error) {
+	backend := cfg.throttle.store
+	if backend == "" {
+		backend = cfg.db.backend
+	}
+	switch backend {
+	case "memory":
+		return throttle.NewMemoryStore(), nil
+	case "mongo":
+		if db == nil {
+			return nil, errors.New("the mongo throttle store needs -db-backend=mongo")
+		}
+		store := throttle.NewMongoStore(db, cfg.db.timeouts)
+		_, err := store.Collection.Indexes().CreateMany(context.Background(), store.Indexes())
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown throttle store %q", backend)
+	}
+}
+
+// newSessionManager returns the store of session values. The cookie store needs
+// no database, but its sessions can't be ended on the server.
+func newSessionManager(cfg config, cipher *encrypt.Cipher, db *mongo.Database, logger *woodlog.Logger) (*session.Manager, error) {
+	var store session.Store
+	switch cfg.session.store {
+	case "cookie":
+		store = session.NewCookieStore(cipher)
+	case "mongo":
+		if db == nil {
+			return nil, errors.New("the mongo session store needs -db-backend=mongo")
+		}
+		mongoStore := session.NewMongoStore(db, cfg.db.timeouts)
+		_, err := mongoStore.Collection.Indexes().CreateMany(context.Background(), mongoStore.Indexes())
+		if err != nil {
+			return nil, err
+		}
+		store = mongoStore
+	default:
+		return nil, fmt.Errorf("unknown session store %q", cfg.session.store)
+	}
+
+	manager := session.New(store, cfg.session.idleTimeout)
+	manager.ErrorFunc = func(err error) {
+		logger.PrintError(err.Error(), "failed to load or save session")
+	}
+	return manager, nil
+}
+
+func newMailer(cfg config) (mailer.Mailer, error) {
+	switch cfg.mailer.backend {
+	case "smtp":
+		return mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.mailer.sender)
+	case "file":
+		return mailer.NewFileDrop(cfg.mailer.dir, cfg.mailer.sender)
+	case "memory":
+		return mailer.NewMemory(cfg.mailer.sender), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer backend %q", cfg.mailer.backend)
+	}
+}
+
 // fix later: hardcoded collection name
 func mustOpenDB(dsn string) *mongo.Database {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
@@ -73,21 +459,42 @@ func mustOpenDB(dsn string) *mongo.Database {
 	if err != nil {
 		panic(err)
 	}
-	_, err = db.Database("novye").Collection("users").Indexes().CreateMany(
+	users := data.UserModel{DB: db.Database("novye")}
+	_, err = users.DB.Collection("users").Indexes().CreateMany(context.Background(), users.Indexes())
+	if err != nil {
+		panic(err)
+	}
+	// Accounts created before activation existed have no activated field. They
+	// were usable all along, so they are activated rather than locked out.
+	_, err = db.Database("novye").Collection("users").UpdateMany(
+		context.Background(),
+		bson.M{"activated": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"activated": true}},
+	)
+	if err != nil {
+		panic(err)
+	}
+	// Let Mongo remove expired tokens on its own. Sliding expiration works by
+	// moving the expiry field forward, so the index always follows it.
+	_, err = db.Database("novye").Collection("tokens").Indexes().CreateOne(
 		context.Background(),
-		[]mongo.IndexModel{
-			{
-				Keys:    bson.D{{Key: "login", Value: 1}},
-				Options: options.Index().SetUnique(true),
-			},
-			{
-				Keys:    bson.D{{Key: "email", Value: 1}},
-				Options: options.Index().SetUnique(true),
-			},
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiry", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
 		},
 	)
 	if err != nil {
 		panic(err)
 	}
+	audit := data.AuditModel{DB: db.Database("novye")}
+	_, err = audit.DB.Collection("audit").Indexes().CreateMany(context.Background(), audit.Indexes())
+	if err != nil {
+		panic(err)
+	}
+	apiKeys := data.APIKeyModel{DB: db.Database("novye")}
+	_, err = apiKeys.DB.Collection("api_keys").Indexes().CreateMany(context.Background(), apiKeys.Indexes())
+	if err != nil {
+		panic(err)
+	}
 	return db.Database("novye")
 }
@@ -2,8 +2,14 @@ package main
 
 import (
 	"app/internal/data"
+	"app/internal/jwt"
+	"app/internal/validator"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func secureHeaders(next http.Handler) http.Handler {
@@ -35,53 +41,290 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// requireAuth only lets through authenticated users. Requests made with an
+// API key are turned away: a key only works on the routes that accept one of
+// its scopes, see requireAuthOrKey.
 func (app *application) requireAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenCookie, err := r.Cookie("token")
-		if err != nil {
-			http.Redirect(w, r, "http://localhost:"+app.config.port, http.StatusSeeOther)
-			return
-		}
-		_, err = app.models.Tokens.GetTokenDocumentByToken(tokenCookie.Value)
-		if err != nil {
-			app.logoutHandler(w, r)
-			return
+	return app.requireAuthOrKey()(next)
+}
+
+// requireAuthOrKey is requireAuth for routes that API keys may use too, if
+// they have one of scopes. A key's scopes only cap what its owner's role
+// allows, so routes guarded by a permission still need requirePermission:
+//
+//	alice.New(app.requireAuthOrKey(data.PermissionAuditRead), app.requirePermission(data.PermissionAuditRead))
+func (app *application) requireAuthOrKey(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contextGetUser(r) == nil {
+				if isAPIRequest(r) {
+					app.authenticationRequiredJSON(w)
+					return
+				}
+				if hasSessionCookie(r) {
+					// The cookies are there but didn't authenticate anyone, so
+					// they are stale; clear them on the way out.
+					app.logoutHandler(w, r)
+					return
+				}
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+
+			if key := contextGetAPIKey(r); key != nil && !hasAnyScope(key, scopes) {
+				if isAPIRequest(r) {
+					app.notPermittedJSON(w)
+					return
+				}
+				app.forbidden(w, r, "You don't have permission to see this page.")
+				return
+			}
+
+			// Activity keeps the session alive until its absolute deadline.
+			if session := contextGetSession(r); session != nil {
+				app.extendSession(session)
+			}
+
+			w.Header().Add("Cache-Control", "no-store")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasAnyScope(key *data.APIKey, scopes []string) bool {
+	for _, scope := range scopes {
+		if key.HasScope(scope) {
+			return true
 		}
+	}
+	return false
+}
 
-		w.Header().Add("Cache-Control", "no-store")
-		next.ServeHTTP(w, r)
-	})
+// requirePermission only lets through users whose role grants the permission
+// code. It expects an authenticated user, so it goes after requireAuth:
+//
+//	dynamicMiddleware.Append(app.requirePermission(data.PermissionTicketsReadAll))
+func (app *application) requirePermission(code string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !can(r, code) {
+				if isAPIRequest(r) {
+					app.notPermittedJSON(w)
+					return
+				}
+				app.forbidden(w, r, "You don't have permission to see this page.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func (app *application) authenticate(td *data.TemplateData, next http.Handler) http.Handler {
+// can reports whether the request may use the permission code: the user's
+// role has to grant it, and so does the scope of the API key the request was
+// made with, if any.
+func can(r *http.Request, code string) bool {
+	user := contextGetUser(r)
+	if user == nil || !user.Can(code) {
+		return false
+	}
+	if key := contextGetAPIKey(r); key != nil && !key.HasScope(code) {
+		return false
+	}
+	return true
+}
+
+// authenticate adds the user identified by the request's credentials to the
+// request context. API clients send "Authorization: Bearer <token>", where the
+// token is a JWT signed by app.keys, an authentication token from the tokens
+// collection or an API key; browsers send the token cookie, and the refresh
+// cookie once the access token has expired. A request with a bad bearer token
+// is rejected outright, while a bad or missing cookie just leaves the request
+// anonymous. If the database can't tell whether the credentials are good, the
+// request fails rather than going ahead anonymously.
+func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		td.User.Email = ""
-		td.User.Login = ""
-		td.User.Name = ""
-		td.User.CreateDate = ""
-		td.IsAuthenticated = false
-		tokenCookie, err := r.Cookie("token")
-		if err != nil {
-			next.ServeHTTP(w, r)
+		w.Header().Add("Vary", "Authorization")
+
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader != "" {
+			headerParts := strings.Split(authorizationHeader, " ")
+			if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+				app.invalidAuthenticationTokenJSON(w)
+				return
+			}
+
+			if data.IsAPIKey(headerParts[1]) {
+				user, key, err := app.userForAPIKey(r.Context(), headerParts[1])
+				if isDatabaseError(err) {
+					app.serverError(w, err)
+					return
+				}
+				if err != nil {
+					app.invalidAuthenticationTokenJSON(w)
+					return
+				}
+				next.ServeHTTP(w, contextSetAPIKey(contextSetUser(r, user), key))
+				return
+			}
+
+			user, err := app.userForBearerToken(r.Context(), headerParts[1])
+			if isDatabaseError(err) {
+				app.serverError(w, err)
+				return
+			}
+			if err != nil {
+				app.invalidAuthenticationTokenJSON(w)
+				return
+			}
+			next.ServeHTTP(w, contextSetUser(r, user))
 			return
 		}
-		TokenDocument, err := app.models.Tokens.GetTokenDocumentByToken(tokenCookie.Value)
-		if err != nil {
+
+		if tokenCookie, err := r.Cookie(accessCookieName); err == nil {
+			user, token, err := app.userForToken(r.Context(), tokenCookie.Value)
+			if isDatabaseError(err) {
+				app.serverError(w, err)
+				return
+			}
+			if err == nil {
+				next.ServeHTTP(w, contextSetSession(contextSetUser(r, user), token))
+				return
+			}
+		}
+
+		// The access token is missing or no longer valid, so try to carry on the
+		// session with the refresh token. Static files don't need a user, and the
+		// refresh endpoint rotates the token itself.
+		refreshCookie, err := r.Cookie(refreshCookieName)
+		if err != nil || strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/tokens/refresh" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		user, err := app.models.Users.GetByLogin(TokenDocument.UserLogin)
+		user, token, err := app.refreshCookieSession(w, r, refreshCookie.Value)
+		if isDatabaseError(err) {
+			app.serverError(w, err)
+			return
+		}
 		if err != nil {
+			if errors.Is(err, data.ErrTokenReused) {
+				app.logger.PrintWarning("refresh token reused, session revoked", r.RemoteAddr)
+				clearSessionCookies(w, r)
+			}
 			next.ServeHTTP(w, r)
 			return
-		} else {
-			td.User.Email = user.Email
-			td.User.Login = user.Login
-			td.User.Name = user.Name
-			td.User.CreateDate = user.CreateDate
-			td.IsAuthenticated = true
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, contextSetSession(contextSetUser(r, user), token))
 	})
 }
+
+// refreshCookieSession rotates the refresh token of a browser session, sets the
+// new pair of token cookies and returns the user with their new access token.
+func (app *application) refreshCookieSession(w http.ResponseWriter, r *http.Request, refreshPlaintext string) (*data.User, *data.Token, error) {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, refreshPlaintext); !v.Valid() {
+		return nil, nil, errors.New("invalid refresh token")
+	}
+	old, refresh, err := app.refreshSession(r.Context(), refreshPlaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, err := app.newAccessToken(r.Context(), old.UserLogin, continueSession(old), old.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := app.models.Users.GetByLogin(r.Context(), old.UserLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	app.setSessionCookies(w, access, refresh)
+	return &user, access, nil
+}
+
+var errAccountInactive = errors.New("account is not activated")
+
+// userForBearerToken resolves a bearer token to its user. Anything with the
+// three dot-separated segments of a JWT is verified against our signing keys;
+// everything else is treated as a tokens collection token.
+func (app *application) userForBearerToken(ctx context.Context, token string) (*data.User, error) {
+	if strings.Count(token, ".") != 2 {
+		user, _, err := app.userForToken(ctx, token)
+		return user, err
+	}
+
+	claims, err := app.keys.Verify(token, jwt.Options{
+		Issuer:   app.config.jwt.issuer,
+		Audience: app.config.jwt.issuer,
+		Leeway:   time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	user, err := app.models.Users.GetByLogin(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	// A JWT stays valid until it expires, so the account is checked as well in
+	// case an admin has deactivated it in the meantime.
+	if !user.Activated {
+		return nil, errAccountInactive
+	}
+	return &user, nil
+}
+
+// userForToken resolves an authentication token from the tokens collection to
+// its user, also returning the token document itself.
+func (app *application) userForToken(ctx context.Context, tokenPlaintext string) (*data.User, *data.Token, error) {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, tokenPlaintext); !v.Valid() {
+		return nil, nil, errors.New("invalid authentication token")
+	}
+	token, err := app.models.Tokens.GetTokenDocumentByToken(ctx, data.ScopeAuthentication, tokenPlaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	token.Plaintext = tokenPlaintext
+	user, err := app.models.Users.GetByLogin(ctx, token.UserLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.Activated {
+		return nil, nil, errAccountInactive
+	}
+	return &user, &token, nil
+}
+
+// userForAPIKey resolves an API key to its owner, also returning the key
+// itself so its scopes can be checked. The time the key was last used is
+// written at most once a minute.
+func (app *application) userForAPIKey(ctx context.Context, plaintext string) (*data.User, *data.APIKey, error) {
+	key, err := app.models.APIKeys.GetByPlaintext(ctx, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := app.models.Users.GetByLogin(ctx, key.UserLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.Activated {
+		return nil, nil, errAccountInactive
+	}
+	if time.Since(key.LastUsed) > time.Minute {
+		app.background(func() {
+			if err := app.models.APIKeys.Touch(context.Background(), key.ID); err != nil {
+				app.logger.PrintError(err.Error(), "failed to record api key use")
+			}
+		})
+	}
+	return &user, &key, nil
+}
+
+// isAPIRequest reports whether the client expects JSON rather than HTML pages,
+// either because it authenticates with a bearer token or because it asks for
+// JSON explicitly.
+func isAPIRequest(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
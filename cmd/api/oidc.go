@@ -0,0 +1,356 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/oidc"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	oidcStateCookieName = "oidc_state"
+	// oidcStateTTL is how long the user has to log in at the provider.
+	oidcStateTTL = 10 * time.Minute
+	// oidcReauthTTL is how recently a user without a password must have logged
+	// in at their provider to change their login, email or password.
+	oidcReauthTTL = 5 * time.Minute
+)
+
+var errNoVerifiedEmail = errors.New("the provider didn't share a verified email address")
+
+// oidcState is what the login remembers while the user is away at the
+// provider. It travels in a cookie encrypted with app.cipher, so it can't be
+// read or forged by the client.
+type oidcState struct {
+	Provider string    `json:"provider"`
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Expires  time.Time `json:"expires"`
+	// Next is the local path to go to after logging in.
+	Next string `json:"next,omitempty"`
+}
+
+// oidcLoginHandler sends the user to the provider's login page. The next query
+// parameter names the page to come back to, which is how users without a
+// password re-authenticate before changing their profile.
+func (app *application) oidcLoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider := app.provider(mux.Vars(r)["provider"])
+		if provider == nil {
+			app.notFound(w, r)
+			return
+		}
+
+		st := oidcState{Provider: provider.Name, Expires: time.Now().Add(oidcStateTTL)}
+		// Only paths on this site, or the redirect would send users anywhere.
+		if next := r.URL.Query().Get("next"); strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.Contains(next, "\\") {
+			st.Next = next
+		}
+		for _, s := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+			v, err := oidc.RandomString()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			*s = v
+		}
+
+		authURL, err := provider.AuthCodeURL(r.Context(), st.State, st.Nonce, oidc.CodeChallenge(st.Verifier))
+		if err != nil {
+			app.logger.PrintError(err.Error(), "oidc discovery failed for "+provider.Name)
+			app.oidcLoginFailed(w, r, "Logging in with "+provider.DisplayName+" isn't available right now.", http.StatusBadGateway)
+			return
+		}
+
+		js, err := json.Marshal(st)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		value, err := app.cipher.Encrypt(js)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		http.SetCookie(w, oidcStateCookie(value, int(oidcStateTTL.Seconds())))
+
+		http.Redirect(w, r, authURL, http.StatusSeeOther)
+	})
+}
+
+// oidcCallbackHandler finishes a login at a provider: it checks the state,
+// exchanges the code for the user's ID token, finds or creates the matching
+// user and starts a session for them just like a password login does.
+func (app *application) oidcCallbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider := app.provider(mux.Vars(r)["provider"])
+		if provider == nil {
+			app.notFound(w, r)
+			return
+		}
+
+		// The state is single use, whatever happens next.
+		http.SetCookie(w, oidcStateCookie("", -1))
+
+		st, ok := app.readOIDCState(r)
+		q := r.URL.Query()
+		if !ok || st.Provider != provider.Name || time.Now().After(st.Expires) ||
+			subtle.ConstantTimeCompare([]byte(st.State), []byte(q.Get("state"))) != 1 {
+			app.oidcLoginFailed(w, r, "Your login has expired, please try again.", http.StatusBadRequest)
+			return
+		}
+		if q.Get("error") != "" {
+			app.oidcLoginFailed(w, r, "Logging in with "+provider.DisplayName+" was cancelled.", http.StatusUnauthorized)
+			return
+		}
+
+		idToken, err := provider.Exchange(r.Context(), q.Get("code"), st.Verifier, st.Nonce)
+		if err != nil {
+			app.logger.PrintWarning(err.Error(), "oidc login failed for "+provider.Name)
+			app.oidcLoginFailed(w, r, "Logging in with "+provider.DisplayName+" failed, please try again.", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := app.userForIdentity(r.Context(), provider.Name, idToken)
+		if err != nil {
+			if errors.Is(err, errNoVerifiedEmail) {
+				app.oidcLoginFailed(w, r, provider.DisplayName+" didn't share a verified email address with us, so we can't create your account.", http.StatusUnauthorized)
+				return
+			}
+			app.serverError(w, err)
+			return
+		}
+
+		if !user.Activated {
+			app.loginRejected(r, user.Login, "not activated")
+			app.oidcLoginFailed(w, r, "your account is not activated yet, please follow the link we emailed you", http.StatusForbidden)
+			return
+		}
+		if user.TOTPEnabled {
+			app.beginTwoFactorLogin(w, r, user)
+			return
+		}
+		err = app.loginSucceeded(r, nil, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.startSession(w, r, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.session.Put(r, "oidc_login", fmt.Sprintf("%s %d", user.Login, time.Now().Unix()))
+		app.session.Put(r, "flash", "You have been logged in.")
+
+		next := st.Next
+		if next == "" {
+			next = "/"
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	})
+}
+
+// recentOIDCLogin reports whether the user logged in at an OpenID provider in
+// this browser within oidcReauthTTL.
+func (app *application) recentOIDCLogin(r *http.Request, user *data.User) bool {
+	var login string
+	var at int64
+	_, err := fmt.Sscanf(app.session.Get(r, "oidc_login"), "%s %d", &login, &at)
+	if err != nil || login != user.Login {
+		return false
+	}
+	return time.Since(time.Unix(at, 0)) < oidcReauthTTL
+}
+
+// userForIdentity returns the user linked to the account at the provider. On
+// a first login the account is linked to the user with the same verified email
+// address, see claimUnactivated for ones that weren't activated yet, or a new
+// user is created for it.
+func (app *application) userForIdentity(ctx context.Context, provider string, idToken *oidc.IDToken) (data.User, error) {
+	user, err := app.models.Users.GetByIdentity(ctx, provider, idToken.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrNotFound) {
+		return data.User{}, err
+	}
+
+	// Only an address the provider has verified can prove the user owns the
+	// account that has it.
+	if idToken.Email == "" || !idToken.EmailVerified {
+		return data.User{}, errNoVerifiedEmail
+	}
+	identity := data.Identity{
+		Provider: provider,
+		Subject:  idToken.Subject,
+		Email:    idToken.Email,
+		LinkedAt: time.Now(),
+	}
+
+	user, err = app.models.Users.GetByEmail(ctx, idToken.Email)
+	if err == nil {
+		if !user.Activated {
+			err = app.claimUnactivated(ctx, &user)
+			if err != nil {
+				return data.User{}, err
+			}
+		}
+		err = app.models.Users.AddIdentity(ctx, user.Login, identity)
+		if err != nil {
+			return data.User{}, err
+		}
+		user.Identities = append(user.Identities, identity)
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrNotFound) {
+		return data.User{}, err
+	}
+
+	login, err := app.newLoginFor(ctx, idToken)
+	if err != nil {
+		return data.User{}, err
+	}
+	name := idToken.Name
+	if name == "" {
+		name = login
+	}
+	// Users created this way have no password. They can set one with the
+	// forgot password form if they want to log in without the provider.
+	user = data.User{
+		Login:      login,
+		Email:      idToken.Email,
+		Name:       name,
+		Activated:  true,
+		Role:       data.RoleCustomer,
+		Identities: []data.Identity{identity},
+	}
+	err = app.models.Users.Insert(ctx, user)
+	if err != nil {
+		return data.User{}, err
+	}
+	return user, nil
+}
+
+// claimUnactivated hands an account that was never activated over to the owner
+// of its email address, who has just proven that at their provider. Whoever
+// signed up with the address may not have been them, so the password that was
+// registered goes, along with the pending activation link and anything else
+// issued for the account. Otherwise that person could pre-register the account,
+// wait for its owner to log in with a provider and log in with their password
+// afterwards. The owner can set a password with the forgot password form.
+func (app *application) claimUnactivated(ctx context.Context, user *data.User) error {
+	err := app.models.Users.UpdatePassword(ctx, user.Login, "")
+	if err != nil {
+		return err
+	}
+	err = app.models.Tokens.DeleteAllByLogin(ctx, user.Login)
+	if err != nil {
+		return err
+	}
+	err = app.models.APIKeys.DeleteAllForUser(ctx, user.Login)
+	if err != nil {
+		return err
+	}
+	err = app.models.Users.SetActivated(ctx, user.Login, true)
+	if err != nil {
+		return err
+	}
+	user.Password = ""
+	user.Activated = true
+	return nil
+}
+
+var loginUnsafeRX = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// newLoginFor picks an unused login for a new user, based on their username at
+// the provider or their email address.
+func (app *application) newLoginFor(ctx context.Context, idToken *oidc.IDToken) (string, error) {
+	base := idToken.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(idToken.Email, "@", 2)[0]
+	}
+	base = loginUnsafeRX.ReplaceAllString(strings.ToLower(base), "")
+	if len(base) > 30 {
+		base = base[:30]
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+
+	login := base
+	for i := 0; i < 5; i++ {
+		_, err := app.models.Users.GetByLogin(ctx, login)
+		if errors.Is(err, data.ErrNotFound) {
+			return login, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		login = fmt.Sprintf("%s%04d", base, n.Int64())
+	}
+	return "", fmt.Errorf("no free login found for %q", base)
+}
+
+func (app *application) readOIDCState(r *http.Request) (oidcState, bool) {
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		return oidcState{}, false
+	}
+	js, err := app.cipher.Decrypt(cookie.Value)
+	if err != nil {
+		return oidcState{}, false
+	}
+	var st oidcState
+	if err := json.Unmarshal(js, &st); err != nil {
+		return oidcState{}, false
+	}
+	return st, true
+}
+
+// oidcStateCookie is Lax rather than Strict like the session cookies, because
+// it has to come back with the redirect from the provider's site.
+func oidcStateCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    value,
+		Path:     "/auth/oidc/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (app *application) oidcLoginFailed(w http.ResponseWriter, r *http.Request, message string, status int) {
+	app.renderStatus(w, r, status, "login.page.html", &data.TemplateData{
+		ErrorText: message,
+		Code:      status,
+	})
+}
+
+// provider returns the OpenID provider with the given name, or nil.
+func (app *application) provider(name string) *oidc.Provider {
+	for _, p := range app.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
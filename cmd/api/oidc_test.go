@@ -0,0 +1,322 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/jwt"
+	"app/internal/oidc"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a minimal OpenID provider: it serves discovery, its key and a
+// token endpoint that issues an ID token for every login authorized through
+// authorize, once the client shows the PKCE verifier of that login.
+type testIssuer struct {
+	*httptest.Server
+	key ed25519.PrivateKey
+
+	mu     sync.Mutex
+	logins map[string]testIssuerLogin
+}
+
+type testIssuerLogin struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key, logins: map[string]testIssuerLogin{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 iss.URL,
+			"authorization_endpoint": iss.URL + "/authorize",
+			"token_endpoint":         iss.URL + "/token",
+			"jwks_uri":               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwt.JWKS{Keys: []jwt.JWK{{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			Alg: jwt.EdDSA,
+			Kid: "issuer-key",
+			X:   base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		iss.mu.Lock()
+		login, ok := iss.logins[r.PostForm.Get("code")]
+		delete(iss.logins, r.PostForm.Get("code"))
+		iss.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || oidc.CodeChallenge(r.PostForm.Get("code_verifier")) != login.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     iss.sign(t, login.claims),
+		})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": jwt.EdDSA, "typ": "JWT", "kid": "issuer-key"})
+	if err != nil {
+		t.Error(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(iss.key, []byte(input)))
+}
+
+// authorize plays the user logging in at the issuer: given the URL the app
+// sent them to, it returns the query the issuer sends them back with. The ID
+// token will carry claims on top of the ones every token needs.
+func (iss *testIssuer) authorize(t *testing.T, authURL string, claims map[string]interface{}) url.Values {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "grocery-store" {
+		t.Fatalf("bad authorization request %s", authURL)
+	}
+
+	full := map[string]interface{}{
+		"iss":   iss.URL,
+		"aud":   "grocery-store",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+	code := "code-" + q.Get("state")
+	iss.mu.Lock()
+	iss.logins[code] = testIssuerLogin{challenge: q.Get("code_challenge"), claims: full}
+	iss.mu.Unlock()
+
+	return url.Values{"state": {q.Get("state")}, "code": {code}}
+}
+
+// withIssuer makes iss the app's provider "test".
+func withIssuer(app *application, iss *testIssuer) {
+	app.providers = []*oidc.Provider{oidc.NewProvider(oidc.Config{
+		Name:        "test",
+		DisplayName: "Test",
+		Issuer:      iss.URL,
+		ClientID:    "grocery-store",
+		Scopes:      []string{"openid", "email", "profile"},
+		RedirectURL: app.config.baseURL + "/auth/oidc/test/callback",
+	}, iss.Client())}
+}
+
+// oidcLogin starts a login with the test provider and returns the issuer's
+// redirect back to the app.
+func (c *testClient) oidcLogin(t *testing.T, iss *testIssuer, next string, claims map[string]interface{}) url.Values {
+	t.Helper()
+
+	res := c.get(t, "/auth/oidc/test?next="+url.QueryEscape(next))
+	if res.status != http.StatusSeeOther {
+		t.Fatalf("starting login: got status %d; want 303: %s", res.status, res.body)
+	}
+	return iss.authorize(t, res.header.Get("Location"), claims)
+}
+
+func TestOIDCLinksAccountByEmail(t *testing.T) {
+	app := newTestApplication(t)
+	iss := newTestIssuer(t)
+	withIssuer(app, iss)
+	insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+	c := newTestServer(t, app)
+	back := c.oidcLogin(t, iss, "/profile", map[string]interface{}{
+		"sub":            "alice-at-test",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	})
+	res := c.get(t, "/auth/oidc/test/callback?"+back.Encode())
+	if res.status != http.StatusSeeOther || res.header.Get("Location") != "/profile" {
+		t.Fatalf("got status %d to %q; want 303 to /profile: %s", res.status, res.header.Get("Location"), res.body)
+	}
+	if res := c.get(t, "/profile"); res.status != http.StatusOK {
+		t.Errorf("profile: got status %d; want 200", res.status)
+	}
+
+	// The identity now belongs to alice, and no one else was created.
+	user, err := app.models.Users.GetByIdentity(context.Background(), "test", "alice-at-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Login != "alice" {
+		t.Errorf("identity linked to %q; want alice", user.Login)
+	}
+	users, err := app.models.Users.GetAllUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Errorf("got %d users; want only alice", len(users))
+	}
+}
+
+func TestOIDCClaimsUnactivatedAccount(t *testing.T) {
+	app := newTestApplication(t)
+	iss := newTestIssuer(t)
+	withIssuer(app, iss)
+
+	// Someone signed up with alice's address before she ever logged in, but
+	// couldn't activate the account.
+	c := newTestServer(t, app)
+	res := c.postForm(t, "/signup", url.Values{
+		"login":    {"alice"},
+		"email":    {"alice@example.com"},
+		"name":     {"Alice"},
+		"password": {testPassword},
+	})
+	if res.status != http.StatusSeeOther {
+		t.Fatalf("signup: got status %d; want 303: %s", res.status, res.body)
+	}
+
+	back := c.oidcLogin(t, iss, "/profile", map[string]interface{}{
+		"sub":            "alice-at-test",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	})
+	res = c.get(t, "/auth/oidc/test/callback?"+back.Encode())
+	if res.status != http.StatusSeeOther || c.cookie(accessCookieName) == "" {
+		t.Fatalf("got status %d without a session: %s", res.status, res.body)
+	}
+
+	// Alice has the account now, and the password it was registered with no
+	// longer works.
+	user, err := app.models.Users.GetByIdentity(context.Background(), "test", "alice-at-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Login != "alice" || !user.Activated || user.Password != "" {
+		t.Errorf("got user %+v; want alice, activated and without a password", user)
+	}
+	other := newTestServer(t, app)
+	res = other.postForm(t, "/login", url.Values{"login": {"alice"}, "password": {testPassword}})
+	if other.cookie(accessCookieName) != "" {
+		t.Errorf("logged in with the registered password: status %d", res.status)
+	}
+}
+
+func TestOIDCCreatesUser(t *testing.T) {
+	app := newTestApplication(t)
+	iss := newTestIssuer(t)
+	withIssuer(app, iss)
+
+	c := newTestServer(t, app)
+	back := c.oidcLogin(t, iss, "", map[string]interface{}{
+		"sub":                "bob-at-test",
+		"email":              "bob@example.com",
+		"email_verified":     true,
+		"preferred_username": "Bob",
+	})
+	res := c.get(t, "/auth/oidc/test/callback?"+back.Encode())
+	if res.status != http.StatusSeeOther || c.cookie(accessCookieName) == "" {
+		t.Fatalf("got status %d without a session: %s", res.status, res.body)
+	}
+
+	user, err := app.models.Users.GetByLogin(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Activated || user.Email != "bob@example.com" || user.Role != data.RoleCustomer {
+		t.Errorf("got user %+v; want an activated customer with the provider's email", user)
+	}
+}
+
+func TestOIDCCallbackRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		// tamper changes the issuer's redirect back to the app.
+		tamper func(back url.Values)
+		status int
+		want   string
+	}{
+		{
+			name:   "state mismatch",
+			claims: map[string]interface{}{"sub": "alice-at-test", "email": "alice@example.com", "email_verified": true},
+			tamper: func(back url.Values) { back.Set("state", "forged") },
+			status: http.StatusBadRequest,
+			want:   "Your login has expired, please try again.",
+		},
+		{
+			name:   "wrong code",
+			claims: map[string]interface{}{"sub": "alice-at-test", "email": "alice@example.com", "email_verified": true},
+			tamper: func(back url.Values) { back.Set("code", "stolen") },
+			status: http.StatusUnauthorized,
+			want:   "Logging in with Test failed, please try again.",
+		},
+		{
+			name:   "unverified email",
+			claims: map[string]interface{}{"sub": "alice-at-test", "email": "alice@example.com", "email_verified": false},
+			tamper: func(url.Values) {},
+			status: http.StatusUnauthorized,
+			want:   "Test didn't share a verified email address with us, so we can't create your account.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			iss := newTestIssuer(t)
+			withIssuer(app, iss)
+			insertUser(t, app, "alice", "alice@example.com", testPassword, data.RoleCustomer)
+
+			c := newTestServer(t, app)
+			back := c.oidcLogin(t, iss, "/profile", tt.claims)
+			tt.tamper(back)
+			res := c.get(t, "/auth/oidc/test/callback?"+back.Encode())
+			if res.status != tt.status {
+				t.Errorf("got status %d; want %d", res.status, tt.status)
+			}
+			wantText(t, res, tt.want)
+			if c.cookie(accessCookieName) != "" {
+				t.Error("got a session")
+			}
+
+			// Nothing was linked to alice on the way.
+			if _, err := app.models.Users.GetByIdentity(context.Background(), "test", "alice-at-test"); !errors.Is(err, data.ErrNotFound) {
+				t.Errorf("looking up the identity: got error %v; want ErrNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"app/internal/data"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+// passwordMatches reports whether plaintext is the user's password. When it
+// is, and the stored hash was made with another algorithm or with outdated
+// parameters, the hash is replaced by one made with the current settings. The
+// plaintext is only ever available at this point, so this is how old hashes
+// get upgraded.
+func (app *application) passwordMatches(ctx context.Context, user *data.User, plaintext string) (bool, error) {
+	match, rehash, err := app.passwords.Verify(plaintext, user.Password)
+	if err != nil || !match {
+		return false, err
+	}
+	if rehash {
+		hash, err := app.passwords.Hash(plaintext)
+		if err == nil {
+			err = app.models.Users.UpdatePassword(ctx, user.Login, hash)
+		}
+		// The login goes ahead with the old hash if this fails; it is tried
+		// again next time.
+		if err != nil {
+			app.logger.PrintError(err.Error(), "failed to rehash password of "+user.Login)
+		} else {
+			user.Password = hash
+		}
+	}
+	return true, nil
+}
+
+// unknownPasswordHash returns the hash of a random password that is thrown
+// away, for an account that must not be logged in to with a password until
+// its owner sets a new one. An empty hash would do that too, but would turn
+// the account into one that only logs in through an OpenID provider.
+func (app *application) unknownPasswordHash() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return app.passwords.Hash(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// confirmPassword checks the password a logged in user gives to confirm a
+// change. Someone who finds a logged in browser could guess it there instead
+// of at /login, so the guesses are throttled the same way and count towards
+// locking the account. A nonzero wait means the user has to wait that long
+// before trying again.
+func (app *application) confirmPassword(r *http.Request, user *data.User, plaintext string) (bool, time.Duration, error) {
+	attempt, wait, err := app.beginLogin(r, user.Login)
+	if err != nil || wait > 0 {
+		return false, wait, err
+	}
+	match, err := app.passwordMatches(r.Context(), user, plaintext)
+	if err != nil {
+		return false, 0, err
+	}
+	if !match {
+		return false, 0, app.loginFailed(r, attempt, user.Login, user)
+	}
+	return true, 0, app.loginPassed(r, attempt)
+}
+
+// reauthenticate reports whether the user has proven who they are again, before
+// a change someone who finds a logged in browser shouldn't be able to make.
+// Users with a password give the password, see confirmPassword. Users without
+// one, who log in through an OpenID provider, give a two-factor code if they
+// have that set up, and otherwise must have logged in at their provider within
+// oidcReauthTTL.
+func (app *application) reauthenticate(r *http.Request, user *data.User, password, code string) (bool, time.Duration, error) {
+	if user.Password != "" {
+		return app.confirmPassword(r, user, password)
+	}
+	if user.TOTPEnabled {
+		match, err := app.verifySecondFactor(r, user, code)
+		return match, 0, err
+	}
+	return app.recentOIDCLogin(r, user), 0, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"app/internal/data"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// profileHandler shows the profile form filled in with the user's details.
+func (app *application) profileHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.render(w, r, "profile.page.html", &data.TemplateData{})
+	})
+}
+
+// updateProfileHandler saves the profile form. The name can be changed freely,
+// but changing the email, login or password takes the current password, or for
+// users without one another proof of identity (see reauthenticate), so someone
+// who finds a logged in browser can't take over the account.
+func (app *application) updateProfileHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		r.ParseForm()
+		login := strings.TrimSpace(r.PostForm.Get("login"))
+		email := strings.TrimSpace(r.PostForm.Get("email"))
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		newPassword := r.PostForm.Get("new_password")
+		currentPassword := r.PostForm.Get("current_password")
+
+		v := newValidator(r)
+		ValidateUser(v, &data.User{
+			Login:    login,
+			Email:    email,
+			Name:     name,
+			Password: newPassword,
+		})
+		// Leaving the new password blank keeps the current one.
+		if newPassword == "" {
+			delete(v.Errors, "password")
+		}
+		app.checkBreached(r, v, newPassword)
+		if !v.Valid() {
+			errMsg := ""
+			for k, v := range v.Errors {
+				errMsg += k + " " + v + "\n"
+			}
+			app.render(w, r, "profile.page.html", &data.TemplateData{
+				ErrorText: errMsg,
+				Code:      422,
+			})
+			return
+		}
+
+		// Only the fields that change are filled in; UpdateUserByLogin leaves
+		// the empty ones alone.
+		var changes data.User
+		if login != user.Login {
+			changes.Login = login
+		}
+		if email != user.Email {
+			changes.Email = email
+		}
+		if name != user.Name {
+			changes.Name = name
+		}
+
+		if changes.Login != "" || changes.Email != "" || newPassword != "" {
+			match, wait, err := app.reauthenticate(r, user, currentPassword, r.PostForm.Get("code"))
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if wait > 0 {
+				app.tooManyAttempts(w, r, "profile.page.html", wait)
+				return
+			}
+			if !match {
+				errMsg := "enter your current password to change your login, email or password"
+				switch {
+				case user.Password == "" && user.TOTPEnabled:
+					errMsg = "enter an authentication code to change your login, email or password"
+				case user.Password == "":
+					errMsg = "log in with your provider again to change your login, email or password"
+				}
+				app.render(w, r, "profile.page.html", &data.TemplateData{
+					ErrorText: errMsg,
+					Code:      401,
+				})
+				return
+			}
+		}
+		if newPassword != "" {
+			hashedPw, err := app.passwords.Hash(newPassword)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			changes.Password = hashedPw
+		}
+
+		err := app.models.Users.UpdateUserByLogin(r.Context(), user.Login, changes)
+		if err != nil {
+			var dup *data.ErrDuplicate
+			if errors.As(err, &dup) && duplicateMessages[dup.Field] != "" {
+				app.render(w, r, "profile.page.html", &data.TemplateData{
+					ErrorText: duplicateMessages[dup.Field],
+					Code:      409,
+				})
+				return
+			}
+			app.modelError(w, r, err)
+			return
+		}
+
+		// Tokens, tickets and API keys refer to their user by login, so they
+		// move along with it. The session cookies stay valid that way too.
+		oldLogin := user.Login
+		if changes.Login != "" {
+			err = app.models.Tokens.RenameUser(r.Context(), user.Login, changes.Login)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			err = app.models.Tickets.RenameUser(r.Context(), user.Login, changes.Login)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			err = app.models.APIKeys.RenameUser(r.Context(), user.Login, changes.Login)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			user.Login = changes.Login
+		}
+
+		// A new password ends every other session, in case the old one was
+		// known to someone else.
+		if changes.Password != "" {
+			keep := ""
+			if session := contextGetSession(r); session != nil {
+				keep = session.Family
+			}
+			err = app.models.Tokens.DeleteSessionsByLogin(r.Context(), user.Login, keep)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+
+		details := map[string]string{}
+		if changes.Login != "" {
+			details["login"] = oldLogin + " -> " + changes.Login
+		}
+		if changes.Email != "" {
+			details["email"] = user.Email + " -> " + changes.Email
+		}
+		if changes.Name != "" {
+			details["name"] = user.Name + " -> " + changes.Name
+		}
+		if changes.Password != "" {
+			details["password"] = "changed"
+		}
+		if len(details) > 0 {
+			app.audit(r, data.AuditProfileUpdate, user.Login, details)
+		}
+
+		app.session.Put(r, "flash", "Your profile has been updated.")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	})
+}
@@ -9,26 +9,83 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	standardMiddleware := alice.New(app.recoverPanic, app.logRequest, secureHeaders)
+	standardMiddleware := alice.New(app.recoverPanic, app.logRequest, secureHeaders, app.session.LoadAndSave, app.authenticate, app.csrf)
 	dynamicMiddleware := alice.New(app.requireAuth)
+	// Routes guarded by a permission can be used with API keys that have it
+	// as a scope; the rest only with a session or an authentication token.
+	permitted := func(code string) alice.Chain {
+		return alice.New(app.requireAuthOrKey(code), app.requirePermission(code))
+	}
+	adminMiddleware := permitted(data.PermissionUsersManage)
+	auditMiddleware := permitted(data.PermissionAuditRead)
+	ticketsMiddleware := alice.New(app.requireAuthOrKey(data.PermissionTicketsReadOwn, data.PermissionTicketsReadAll))
 
 	r := mux.NewRouter()
-	templateData := &data.TemplateData{}
 
-	r.Handle("/", app.authenticate(templateData, app.Render("home.page.html", templateData))).Methods("GET")
+	r.Handle("/", app.Render("home.page.html")).Methods("GET")
 	r.Handle("/testCookie", app.testCookie())
 
-	r.Handle("/signup", app.authenticate(templateData, app.Render("signup.page.html", templateData))).Methods("GET")
-	r.Handle("/login", app.authenticate(templateData, app.Render("login.page.html", templateData))).Methods("GET")
-	r.Handle("/signup", app.authenticate(templateData, app.signupHandler())).Methods("POST")
-	r.Handle("/login", app.authenticate(templateData, app.loginHandler())).Methods("POST")
+	r.Handle("/signup", app.Render("signup.page.html")).Methods("GET")
+	r.Handle("/login", app.Render("login.page.html")).Methods("GET")
+	r.Handle("/signup", app.signupHandler()).Methods("POST")
+	r.Handle("/login", app.loginHandler()).Methods("POST")
+
+	r.Handle("/users/activate", app.showActivateHandler()).Methods("GET")
+	r.Handle("/users/activate", app.activateHandler()).Methods("POST")
+	r.Handle("/users/activate/resend", app.resendActivationHandler()).Methods("POST")
+
+	r.Handle("/auth/oidc/{provider}", app.oidcLoginHandler()).Methods("GET")
+	r.Handle("/auth/oidc/{provider}/callback", app.oidcCallbackHandler()).Methods("GET")
+
+	r.Handle("/login/2fa", app.loginTwoFactorHandler()).Methods("POST")
+
+	r.Handle("/password/forgot", app.Render("forgot.page.html")).Methods("GET")
+	r.Handle("/password/forgot", app.forgotPasswordHandler()).Methods("POST")
+	r.Handle("/password/reset", app.showResetPasswordHandler()).Methods("GET")
+	r.Handle("/password/reset", app.resetPasswordHandler()).Methods("POST")
 
 	r.Handle("/logout", dynamicMiddleware.ThenFunc(app.logoutHandler)).Methods("POST")
 
-	r.Handle("/receipt/:id", app.showTicketHandler())
-	r.Handle("/receipt", app.GetAllTickets())
+	r.Handle("/profile", dynamicMiddleware.Then(app.profileHandler())).Methods("GET")
+	r.Handle("/profile", dynamicMiddleware.Then(app.updateProfileHandler())).Methods("POST")
+	r.Handle("/profile/data", dynamicMiddleware.Then(app.exportDataHandler())).Methods("GET")
+	r.Handle("/profile/delete", dynamicMiddleware.Then(app.deleteAccountHandler())).Methods("POST")
+
+	r.Handle("/profile/2fa", dynamicMiddleware.Then(app.twoFactorHandler())).Methods("GET")
+	r.Handle("/profile/2fa/enroll", dynamicMiddleware.Then(app.enrollTwoFactorHandler())).Methods("POST")
+	r.Handle("/profile/2fa/confirm", dynamicMiddleware.Then(app.confirmTwoFactorHandler())).Methods("POST")
+	r.Handle("/profile/2fa/disable", dynamicMiddleware.Then(app.disableTwoFactorHandler())).Methods("POST")
+
+	r.Handle("/profile/sessions", dynamicMiddleware.Then(app.sessionsHandler())).Methods("GET")
+	r.Handle("/profile/sessions/revoke", dynamicMiddleware.Then(app.revokeSessionHandler())).Methods("POST")
+	r.Handle("/profile/sessions/revoke-others", dynamicMiddleware.Then(app.revokeOtherSessionsHandler())).Methods("POST")
+
+	r.Handle("/admin/users", adminMiddleware.Then(app.adminUsersHandler())).Methods("GET")
+	r.Handle("/admin/users/{login}", adminMiddleware.Then(app.adminUserHandler())).Methods("GET")
+	r.Handle("/admin/users/{login}", adminMiddleware.Then(app.adminUpdateUserHandler())).Methods("POST")
+	r.Handle("/admin/users/{login}/activation", adminMiddleware.Then(app.adminUserActivationHandler())).Methods("POST")
+	r.Handle("/admin/users/{login}/delete", adminMiddleware.Then(app.adminDeleteUserHandler())).Methods("POST")
+	r.Handle("/admin/users/{login}/reset-password", adminMiddleware.Then(app.adminResetPasswordHandler())).Methods("POST")
+	r.Handle("/admin/users/{login}/revoke-sessions", adminMiddleware.Then(app.adminRevokeSessionsHandler())).Methods("POST")
+
+	r.Handle("/admin/audit", auditMiddleware.Then(app.auditLogHandler())).Methods("GET")
+	r.Handle("/admin/audit/export", auditMiddleware.Then(app.auditExportHandler())).Methods("GET")
+
+	// Everyone can see and revoke their keys, even once their role no longer
+	// lets them make new ones.
+	r.Handle("/profile/api-keys", dynamicMiddleware.Then(app.apiKeysHandler())).Methods("GET")
+	r.Handle("/profile/api-keys", dynamicMiddleware.Append(app.requirePermission(data.PermissionAPIKeysManage)).Then(app.createAPIKeyHandler())).Methods("POST")
+	r.Handle("/profile/api-keys/revoke", dynamicMiddleware.Then(app.revokeAPIKeyHandler())).Methods("POST")
+
+	r.Handle("/tokens/authentication", app.createAuthenticationTokenHandler()).Methods("POST")
+	r.Handle("/tokens/refresh", app.refreshTokenHandler()).Methods("POST")
+
+	r.Handle("/receipt/{id}", ticketsMiddleware.Then(app.showTicketHandler()))
+	r.Handle("/receipt", ticketsMiddleware.Then(app.GetAllTickets()))
+
+	r.Handle("/product", permitted(data.PermissionTicketsCreate).Then(app.GroceryStorehandle()))
 
-	r.Handle("/product", app.GroceryStorehandle())
+	r.Handle("/.well-known/jwks.json", app.jwksHandler()).Methods("GET")
 
 	// gorilla mux file server
 	fileServer := http.FileServer(http.Dir("./ui/static"))
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,12 +13,19 @@ import (
 
 func (app *application) serve() error {
 
+	// Request contexts derive from baseCtx, so the queries of requests still
+	// running when the graceful shutdown gives up are cancelled rather than
+	// outliving the server.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	srv := &http.Server{
 		Addr:         ":" + app.config.port,
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
 	}
 
 	shutdownError := make(chan error)
@@ -46,6 +54,7 @@ func (app *application) serve() error {
 		// because the shutdown didn't complete before the 5-second context deadline is
 		// hit). We relay this return value to the shutdownError channel.
 		err := srv.Shutdown(ctx)
+		cancelRequests()
 		if err != nil {
 			shutdownError <- err
 		}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/jwt"
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Sessions are made of short-lived access tokens and refresh tokens. Every
+// refresh rotates the refresh token, and all tokens issued from one login share
+// a token family so the whole session can be revoked at once. Browsers keep
+// both tokens in cookies; API clients get a signed JWT as their access token
+// and hold on to the refresh token themselves.
+//
+// A session ends after idleTimeout without activity, and in any case once
+// maxLifetime has passed since login. The refresh token carries the idle
+// deadline, which requireAuth pushes forward on activity.
+const (
+	accessCookieName  = "token"
+	refreshCookieName = "refresh_token"
+)
+
+// startSession starts a new token family for the user and sets its tokens as
+// cookies. Only the hashes of the tokens are stored.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, login string) error {
+	session, err := app.newSession(r)
+	if err != nil {
+		return err
+	}
+	access, err := app.newAccessToken(r.Context(), login, session, nil)
+	if err != nil {
+		return err
+	}
+	refresh, err := app.newRefreshToken(r.Context(), login, session, nil)
+	if err != nil {
+		return err
+	}
+
+	app.setSessionCookies(w, access, refresh)
+	rotateCSRFToken(w, r)
+	return nil
+}
+
+// refreshSession rotates a refresh token and returns the rotated token along
+// with its replacement. A token rotated within refreshGrace gets the same
+// replacement again, for requests that raced each other to refresh; one
+// rotated longer ago gets its family revoked and data.ErrTokenReused.
+func (app *application) refreshSession(ctx context.Context, refreshPlaintext string) (data.Token, *data.Token, error) {
+	return app.models.Tokens.Rotate(ctx, refreshPlaintext, app.config.session.idleTimeout, app.config.session.refreshGrace)
+}
+
+// extendSession pushes the idle deadline of the session forward. It writes at
+// most once a minute per session, in the background, to spare the database a
+// write per request.
+func (app *application) extendSession(token *data.Token) {
+	if token.Family == "" || time.Since(token.LastSeen) < time.Minute {
+		return
+	}
+	app.background(func() {
+		err := app.models.Tokens.Extend(context.Background(), token.UserLogin, token.Family, app.idleDeadline(token.Session))
+		if err != nil {
+			app.logger.PrintError(err.Error(), "failed to extend session")
+		}
+	})
+}
+
+func (app *application) newAccessToken(ctx context.Context, login string, session data.Session, parent []byte) (*data.Token, error) {
+	expiry := capExpiry(time.Now().Add(app.config.session.accessTTL), session)
+	return app.models.Tokens.NewForFamily(ctx, login, time.Until(expiry), data.ScopeAuthentication, session, parent)
+}
+
+func (app *application) newRefreshToken(ctx context.Context, login string, session data.Session, parent []byte) (*data.Token, error) {
+	return app.models.Tokens.NewForFamily(ctx, login, time.Until(app.idleDeadline(session)), data.ScopeRefresh, session, parent)
+}
+
+// idleDeadline is when the session ends if it isn't used again.
+func (app *application) idleDeadline(session data.Session) time.Time {
+	return capExpiry(time.Now().Add(app.config.session.idleTimeout), session)
+}
+
+// capExpiry keeps an expiry within the absolute lifetime of the session.
+func capExpiry(expiry time.Time, session data.Session) time.Time {
+	if !session.MaxExpiry.IsZero() && session.MaxExpiry.Before(expiry) {
+		return session.MaxExpiry
+	}
+	return expiry
+}
+
+// newSession describes a new token family started from the client of r.
+func (app *application) newSession(r *http.Request) (data.Session, error) {
+	family, err := data.NewFamily()
+	if err != nil {
+		return data.Session{}, err
+	}
+	now := time.Now()
+	return data.Session{
+		Family:    family,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		CreatedAt: now,
+		LastSeen:  now,
+		MaxExpiry: now.Add(app.config.session.maxLifetime),
+	}, nil
+}
+
+// continueSession carries the session of a rotated token over to the tokens
+// that replace it.
+func continueSession(old data.Token) data.Session {
+	session := old.Session
+	session.LastSeen = time.Now()
+	return session
+}
+
+// clientIP returns the IP address of the client without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// signAccessToken returns a JWT access token for API clients.
+func (app *application) signAccessToken(login string) (string, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(app.config.jwt.ttl)
+	token, err := app.keys.Sign(jwt.Claims{
+		Issuer:    app.config.jwt.issuer,
+		Audience:  jwt.Audience{app.config.jwt.issuer},
+		Subject:   login,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: expiry.Unix(),
+	})
+	return token, expiry, err
+}
+
+func hasSessionCookie(r *http.Request) bool {
+	for _, name := range []string{accessCookieName, refreshCookieName} {
+		if _, err := r.Cookie(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setSessionCookies sets the token cookies. The refresh cookie is kept until
+// the absolute end of the session, because its idle deadline moves on activity
+// and the tokens collection is what decides whether it is still valid.
+func (app *application) setSessionCookies(w http.ResponseWriter, access, refresh *data.Token) {
+	refreshExpiry := refresh.MaxExpiry
+	if refreshExpiry.IsZero() {
+		refreshExpiry = refresh.Expiry
+	}
+	http.SetCookie(w, sessionCookie(accessCookieName, access.Plaintext, access.Expiry))
+	http.SetCookie(w, sessionCookie(refreshCookieName, refresh.Plaintext, refreshExpiry))
+}
+
+func clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{accessCookieName, refreshCookieName} {
+		cookie := sessionCookie(name, "", time.Unix(0, 0))
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+	rotateCSRFToken(w, r)
+}
+
+func sessionCookie(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/encrypt"
+	"app/internal/jwt"
+	"app/internal/mailer"
+	"app/internal/password"
+	"app/internal/session"
+	"app/internal/throttle"
+	"app/internal/woodlog"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestApplication returns an application on the memory backend, with
+// throwaway keys, a memory mailer and the cheapest password hashing, so that
+// handlers can be tested without any infrastructure.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	templateCache, err := data.NewTemplateCache("../../ui/html/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwt.NewKeySet(jwt.EdDSA, jwksMaxAge, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := encrypt.New(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	models, err := data.NewModels(data.BackendMemory, nil, data.DefaultTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		templateCache: templateCache,
+		logger:        woodlog.New(io.Discard, woodlog.LevelOff),
+		models:        models,
+		keys:          keys,
+		mailer:        mailer.NewMemory("Grocery Store <no-reply@grocery.local>"),
+		cipher:        cipher,
+		passwords:     password.NewManager(password.Bcrypt{Cost: bcrypt.MinCost}),
+		session:       session.New(session.NewCookieStore(cipher), time.Hour),
+	}
+	app.config.baseURL = "https://grocery.local"
+	app.config.session.accessTTL = 15 * time.Minute
+	app.config.session.idleTimeout = time.Hour
+	app.config.session.refreshGrace = 30 * time.Second
+	app.config.session.maxLifetime = 24 * time.Hour
+	app.config.jwt.issuer = "grocery-test"
+	app.config.jwt.ttl = 15 * time.Minute
+
+	store := throttle.NewMemoryStore()
+	t.Cleanup(store.Close)
+	app.limiters.ip = &throttle.Limiter{Store: store, FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: time.Minute, Window: time.Hour}
+	app.limiters.login = &throttle.Limiter{Store: store, FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, LockAfter: 10, LockFor: time.Minute, Window: time.Hour}
+
+	// Background work, such as sending emails, is done before the test
+	// looks at its results.
+	t.Cleanup(app.wg.Wait)
+	return app
+}
+
+// insertUser adds an activated user with the given role and password.
+func insertUser(t *testing.T, app *application, login, email, plaintext string, role string) data.User {
+	t.Helper()
+
+	hash, err := app.passwords.Hash(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := data.User{Login: login, Email: email, Name: login, Password: hash, Activated: true, Role: role}
+	if err := app.models.Users.Insert(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// testClient is a browser for a test server: it keeps cookies, sends the CSRF
+// token with forms and doesn't follow redirects, so tests can check them.
+type testClient struct {
+	*http.Client
+	ts *httptest.Server
+}
+
+// newTestServer serves the app's routes over TLS, since every cookie the app
+// sets is Secure, and returns a client for it.
+func newTestServer(t *testing.T, app *application) *testClient {
+	t.Helper()
+
+	ts := httptest.NewTLSServer(app.routes())
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ts.Client()
+	client.Jar = jar
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &testClient{Client: client, ts: ts}
+}
+
+// testResponse is what tests look at of a response.
+type testResponse struct {
+	status int
+	header http.Header
+	body   string
+}
+
+func (c *testClient) do(t *testing.T, req *http.Request) testResponse {
+	t.Helper()
+
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testResponse{status: res.StatusCode, header: res.Header, body: string(body)}
+}
+
+func (c *testClient) get(t *testing.T, path string) testResponse {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, c.ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.do(t, req)
+}
+
+// postForm posts form like a page of the app would, with the CSRF token.
+func (c *testClient) postForm(t *testing.T, path string, form url.Values) testResponse {
+	t.Helper()
+
+	token := c.cookie(csrfCookieName)
+	if token == "" {
+		c.get(t, "/")
+		token = c.cookie(csrfCookieName)
+	}
+	form.Set(csrfFieldName, token)
+
+	req, err := http.NewRequest(http.MethodPost, c.ts.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(t, req)
+}
+
+// postJSON posts v as JSON like an API client, with an optional bearer
+// token. API clients don't keep cookies.
+func (c *testClient) postJSON(t *testing.T, path string, v interface{}, bearer string) testResponse {
+	t.Helper()
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.ts.URL+path, bytes.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	res, err := c.Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testResponse{status: res.StatusCode, header: res.Header, body: string(body)}
+}
+
+// cookie returns the value of the named cookie the client would send to the
+// site, or "".
+func (c *testClient) cookie(name string) string {
+	u, _ := url.Parse(c.ts.URL + "/")
+	for _, cookie := range c.Jar.Cookies(u) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// login logs the client in with the login form and fails the test if that
+// doesn't work.
+func (c *testClient) login(t *testing.T, login, plaintext string) {
+	t.Helper()
+
+	res := c.postForm(t, "/login", url.Values{"login": {login}, "password": {plaintext}})
+	if res.status != http.StatusSeeOther || c.cookie(accessCookieName) == "" {
+		t.Fatalf("logging in as %s: got status %d without a session", login, res.status)
+	}
+}
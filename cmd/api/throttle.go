@@ -0,0 +1,132 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/throttle"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failed logins are counted per client IP and per account. Both counters slow
+// down further attempts with exponential backoff, and the account counter
+// also locks the account for a while once it gets too high.
+func loginThrottleKeys(r *http.Request, login string) (ipKey, loginKey string) {
+	return "ip:" + clientIP(r), accountThrottleKey(login)
+}
+
+func accountThrottleKey(login string) string {
+	return "login:" + strings.ToLower(login)
+}
+
+// loginAttempt is a login that got past both limiters. It counts as failed
+// for both of them until loginSucceeded or loginPassed says otherwise.
+type loginAttempt struct {
+	ip, login throttle.Record
+}
+
+// beginLogin lets a login as login go ahead, or returns how long the client
+// has to wait before it may try again.
+func (app *application) beginLogin(r *http.Request, login string) (*loginAttempt, time.Duration, error) {
+	ipKey, loginKey := loginThrottleKeys(r, login)
+
+	ipRec, wait, err := app.limiters.ip.Attempt(r.Context(), ipKey)
+	if err != nil || wait > 0 {
+		return nil, wait, err
+	}
+	loginRec, wait, err := app.limiters.login.Attempt(r.Context(), loginKey)
+	if err != nil || wait > 0 {
+		// No password gets tried, so the IP attempt doesn't count.
+		if err := app.limiters.ip.Forgive(r.Context(), ipKey); err != nil {
+			app.logger.PrintError(err.Error(), "failed to forgive login attempt")
+		}
+		return nil, wait, err
+	}
+	return &loginAttempt{ip: ipRec, login: loginRec}, 0, nil
+}
+
+// loginFailed records a failed login. user is nil when the login doesn't
+// belong to an account. When the failure locks an existing account, its owner
+// is told by email.
+func (app *application) loginFailed(r *http.Request, attempt *loginAttempt, login string, user *data.User) error {
+	if _, _, err := app.limiters.ip.Fail(r.Context(), attempt.ip); err != nil {
+		return err
+	}
+	rec, locked, err := app.limiters.login.Fail(r.Context(), attempt.login)
+	if err != nil {
+		return err
+	}
+
+	entry := &data.AuditEntry{
+		Actor:   login,
+		Action:  data.AuditLogin,
+		Outcome: data.AuditFailure,
+		Details: map[string]string{"via": r.URL.Path, "reason": "invalid credentials"},
+	}
+	if user == nil {
+		entry.Details["reason"] = "unknown login"
+	}
+	if locked {
+		entry.Details["locked"] = "true"
+	}
+	app.record(r, entry)
+
+	if locked && user != nil {
+		app.logger.PrintWarning("account locked after failed logins", user.Login)
+		email, name := user.Email, user.Name
+		app.background(func() {
+			err := app.mailer.Send(email, "account_locked.tmpl", map[string]interface{}{
+				"name":     name,
+				"failures": rec.Failures,
+				"ip":       clientIP(r),
+				"until":    rec.LockedUntil.UTC().Format("02 Jan 2006 at 15:04 MST"),
+				"resetURL": app.config.baseURL + "/password/forgot",
+			})
+			if err != nil {
+				app.logger.PrintError(err.Error(), "failed to send account locked email")
+			}
+		})
+	}
+	return nil
+}
+
+// loginPassed takes back an attempt whose credentials were right, but that
+// doesn't log the user in yet, such as one that goes on to ask for a
+// two-factor code.
+func (app *application) loginPassed(r *http.Request, attempt *loginAttempt) error {
+	if err := app.limiters.ip.Forgive(r.Context(), attempt.ip.Key); err != nil {
+		return err
+	}
+	return app.limiters.login.Forgive(r.Context(), attempt.login.Key)
+}
+
+// loginSucceeded records the login and clears the failures of the account.
+// attempt is nil for logins that didn't go through beginLogin. Apart from
+// taking back the attempt itself, the IP counter is left alone, otherwise an
+// attacker could reset it by logging in to their own account between guesses.
+func (app *application) loginSucceeded(r *http.Request, attempt *loginAttempt, login string) error {
+	app.record(r, &data.AuditEntry{
+		Actor:   login,
+		Action:  data.AuditLogin,
+		Details: map[string]string{"via": r.URL.Path},
+	})
+	if attempt != nil {
+		if err := app.limiters.ip.Forgive(r.Context(), attempt.ip.Key); err != nil {
+			return err
+		}
+	}
+	return app.limiters.login.Reset(r.Context(), accountThrottleKey(login))
+}
+
+// tooManyAttempts renders page with a 429 and a Retry-After header.
+func (app *application) tooManyAttempts(w http.ResponseWriter, r *http.Request, page string, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	app.renderStatus(w, r, http.StatusTooManyRequests, page, &data.TemplateData{
+		ErrorText: fmt.Sprintf("too many failed attempts, try again in %s", (time.Duration(seconds) * time.Second).String()),
+		Code:      http.StatusTooManyRequests,
+	})
+}
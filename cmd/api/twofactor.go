@@ -0,0 +1,362 @@
+package main
+
+import (
+	"app/internal/data"
+	"app/internal/qr"
+	"app/internal/totp"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "Grocery Store"
+	recoveryCodeCount = 10
+)
+
+// beginTwoFactorLogin is called by loginHandler once the password of a user
+// with two-factor authentication has checked out. Instead of a session the user
+// gets a short-lived token that stands for the half-finished login, and is
+// asked for their code.
+func (app *application) beginTwoFactorLogin(w http.ResponseWriter, r *http.Request, user data.User) {
+	token, err := app.models.Tokens.New(r.Context(), user.Login, 5*time.Minute, data.ScopeTwoFactor)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.render(w, r, "login2fa.page.html", &data.TemplateData{
+		Token: token.Plaintext,
+	})
+}
+
+// loginTwoFactorHandler finishes a login started by beginTwoFactorLogin.
+func (app *application) loginTwoFactorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tokenPlaintext := r.PostForm.Get("token")
+		code := r.PostForm.Get("code")
+
+		token, err := app.models.Tokens.GetTokenDocumentByToken(r.Context(), data.ScopeTwoFactor, tokenPlaintext)
+		if err != nil {
+			if errors.Is(err, data.ErrNotFound) {
+				app.render(w, r, "login.page.html", &data.TemplateData{
+					ErrorText: "your login attempt has expired, please log in again",
+					Code:      401,
+				})
+				return
+			}
+			app.serverError(w, err)
+			return
+		}
+
+		attempt, wait, err := app.beginLogin(r, token.UserLogin)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if wait > 0 {
+			app.tooManyAttempts(w, r, "login.page.html", wait)
+			return
+		}
+
+		user, err := app.models.Users.GetByLogin(r.Context(), token.UserLogin)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		ok, err := app.verifySecondFactor(r, &user, code)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !ok {
+			if err := app.loginFailed(r, attempt, user.Login, &user); err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.render(w, r, "login2fa.page.html", &data.TemplateData{
+				ErrorText: "invalid authentication code",
+				Token:     tokenPlaintext,
+				Code:      401,
+			})
+			return
+		}
+
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeTwoFactor, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.loginSucceeded(r, attempt, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.startSession(w, r, user.Login)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.session.Put(r, "flash", "You have been logged in.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
+
+// verifySecondFactor checks a TOTP code, or failing that a recovery code.
+// Either is used up by a successful check: a TOTP code can't be used again, nor
+// can any code from before it, and a recovery code is removed.
+func (app *application) verifySecondFactor(r *http.Request, user *data.User, code string) (bool, error) {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+	if !user.TOTPEnabled || code == "" {
+		return false, nil
+	}
+
+	if len(code) == totp.Digits {
+		secret, err := app.cipher.DecryptString(user.TOTPSecret)
+		if err != nil {
+			return false, err
+		}
+		step, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return app.useTOTPStep(r.Context(), user, step)
+	}
+
+	for i, encrypted := range user.RecoveryCodes {
+		recoveryCode, err := app.cipher.DecryptString(encrypted)
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(recoveryCode), []byte(code)) == 1 {
+			// Only one of two requests racing with the same code gets to
+			// remove it.
+			err = app.models.Users.UseRecoveryCode(r.Context(), user.Login, encrypted)
+			if errors.Is(err, data.ErrNotFound) {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			user.RecoveryCodes = append(append([]string{}, user.RecoveryCodes[:i]...), user.RecoveryCodes[i+1:]...)
+			// The user isn't necessarily logged in yet, so they are named as
+			// the actor.
+			app.record(r, &data.AuditEntry{
+				Actor:   user.Login,
+				Action:  data.AuditRecoveryCodeUse,
+				Target:  user.Login,
+				Details: map[string]string{"remaining": strconv.Itoa(len(user.RecoveryCodes))},
+			})
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// useTOTPStep records the step of a valid TOTP code, and reports false if it
+// had already been used.
+func (app *application) useTOTPStep(ctx context.Context, user *data.User, step int64) (bool, error) {
+	err := app.models.Users.UseTOTPStep(ctx, user.Login, step)
+	if errors.Is(err, data.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	user.LastTOTPStep = step
+	return true, nil
+}
+
+func (app *application) twoFactorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.render(w, r, "twofactor.page.html", &data.TemplateData{})
+	})
+}
+
+// enrollTwoFactorHandler generates a new secret and recovery codes and shows
+// them once. Two-factor authentication is only switched on after the user has
+// proven their app works by confirming a code.
+func (app *application) enrollTwoFactorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+		if user.TOTPEnabled {
+			http.Redirect(w, r, "/profile/2fa", http.StatusSeeOther)
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		encryptedSecret, err := app.cipher.EncryptString(secret)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		encryptedCodes := make([]string, len(codes))
+		for i, code := range codes {
+			encryptedCodes[i], err = app.cipher.EncryptString(code)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+
+		err = app.models.Users.UpdateTwoFactor(r.Context(), user.Login, encryptedSecret, false, encryptedCodes)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		setup, err := twoFactorSetup(user.Login, secret, codes)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.render(w, r, "twofactor.page.html", &data.TemplateData{
+			TwoFactor: setup,
+		})
+	})
+}
+
+// twoFactorSetup returns what the user needs to add secret to their app: a QR
+// code of its provisioning URI, and the secret itself for typing in by hand.
+func twoFactorSetup(login, secret string, codes []string) (data.TwoFactorSetup, error) {
+	code, err := qr.Encode(totp.ProvisioningURI(totpIssuer, login, secret), qr.M)
+	if err != nil {
+		return data.TwoFactorSetup{}, err
+	}
+	return data.TwoFactorSetup{
+		// The SVG is built from modules only, nothing of the URI is copied
+		// into it as markup.
+		QRCode:        template.HTML(code.SVG()),
+		Secret:        secret,
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// confirmTwoFactorHandler switches two-factor authentication on once the user
+// enters a valid code for the pending secret.
+func (app *application) confirmTwoFactorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+		if user.TOTPEnabled || user.TOTPSecret == "" {
+			http.Redirect(w, r, "/profile/2fa", http.StatusSeeOther)
+			return
+		}
+
+		r.ParseForm()
+		code := strings.TrimSpace(r.PostForm.Get("code"))
+
+		secret, err := app.cipher.DecryptString(user.TOTPSecret)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		step, ok := totp.Validate(secret, code, time.Now())
+		if ok {
+			ok, err = app.useTOTPStep(r.Context(), user, step)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+		if !ok {
+			// Show the same secret and codes again so the user can retry.
+			codes := make([]string, len(user.RecoveryCodes))
+			for i, encrypted := range user.RecoveryCodes {
+				codes[i], err = app.cipher.DecryptString(encrypted)
+				if err != nil {
+					app.serverError(w, err)
+					return
+				}
+			}
+			setup, err := twoFactorSetup(user.Login, secret, codes)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.render(w, r, "twofactor.page.html", &data.TemplateData{
+				ErrorText: "invalid authentication code",
+				Code:      422,
+				TwoFactor: setup,
+			})
+			return
+		}
+
+		err = app.models.Users.UpdateTwoFactor(r.Context(), user.Login, user.TOTPSecret, true, user.RecoveryCodes)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditTwoFactorEnable, user.Login, nil)
+		http.Redirect(w, r, "/profile/2fa", http.StatusSeeOther)
+	})
+}
+
+// disableTwoFactorHandler turns two-factor authentication off. The user has to
+// re-authenticate with their password, if they have one, and a current code
+// first.
+func (app *application) disableTwoFactorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := contextGetUser(r)
+
+		r.ParseForm()
+		password := r.PostForm.Get("password")
+		code := r.PostForm.Get("code")
+
+		// Users without a password, who log in through an OpenID provider,
+		// only have the code to prove who they are.
+		if user.Password != "" {
+			match, wait, err := app.confirmPassword(r, user, password)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if wait > 0 {
+				app.tooManyAttempts(w, r, "twofactor.page.html", wait)
+				return
+			}
+			if !match {
+				app.render(w, r, "twofactor.page.html", &data.TemplateData{
+					ErrorText: "wrong password",
+					Code:      401,
+				})
+				return
+			}
+		}
+		ok, err := app.verifySecondFactor(r, user, code)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !ok {
+			app.render(w, r, "twofactor.page.html", &data.TemplateData{
+				ErrorText: "invalid authentication code",
+				Code:      401,
+			})
+			return
+		}
+
+		err = app.models.Users.UpdateTwoFactor(r.Context(), user.Login, "", false, nil)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, data.AuditTwoFactorDisable, user.Login, nil)
+		http.Redirect(w, r, "/profile/2fa", http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,200 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeyPrefix starts every API key, which tells keys apart from the other
+// bearer tokens and makes them easy to spot if one is leaked.
+const APIKeyPrefix = "gsk_"
+
+type APIKeyModel struct {
+	DB       *mongo.Database
+	Timeouts Timeouts
+}
+
+// APIKey lets scripts call the app as a user without a browser session. Like
+// tokens, only the SHA-256 hash of a key is stored; the key itself is shown to
+// the user once, when it is created. The collection has a TTL index on expiry,
+// so keys that expire are removed by Mongo; keys without an expiry are kept
+// until they are revoked.
+type APIKey struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Plaintext string             `bson:"-" json:"key,omitempty"`
+	Hash      []byte             `bson:"hash" json:"-"`
+	// Hint is the start of the key, to help the user tell their keys apart.
+	Hint      string    `bson:"hint" json:"hint"`
+	Name      string    `bson:"name" json:"name"`
+	UserLogin string    `bson:"userLogin" json:"-"`
+	Scopes    []string  `bson:"scopes" json:"scopes"`
+	CreatedAt time.Time `bson:"createdAt" json:"created_at"`
+	Expiry    time.Time `bson:"expiry,omitempty" json:"expiry,omitempty"`
+	LastUsed  time.Time `bson:"lastUsed,omitempty" json:"last_used,omitempty"`
+}
+
+// HasScope reports whether the key may be used for the permission code.
+func (k *APIKey) HasScope(code string) bool {
+	return Permissions(k.Scopes).Include(code)
+}
+
+// IsAPIKey reports whether a bearer token looks like an API key.
+func IsAPIKey(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APIKeyPrefix)
+}
+
+// APIKeyScopes returns the scopes the user may give their keys: any of their
+// own permissions, except managing keys, so a key can't make more keys.
+func APIKeyScopes(user User) []string {
+	var scopes []string
+	for _, p := range user.Permissions() {
+		if p != PermissionAPIKeysManage {
+			scopes = append(scopes, p)
+		}
+	}
+	return scopes
+}
+
+func generateAPIKey(login, name string, scopes []string, expiry time.Time) (*APIKey, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+	plaintext := APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	return &APIKey{
+		Plaintext: plaintext,
+		Hash:      hashToken(plaintext),
+		Hint:      plaintext[:len(APIKeyPrefix)+6],
+		Name:      name,
+		UserLogin: login,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		Expiry:    expiry,
+	}, nil
+}
+
+// New creates and inserts an API key for the user. A zero expiry means the key
+// doesn't expire.
+func (a *APIKeyModel) New(ctx context.Context, login, name string, scopes []string, expiry time.Time) (*APIKey, error) {
+	ctx, cancel := a.Timeouts.write(ctx)
+	defer cancel()
+
+	key, err := generateAPIKey(login, name, scopes, expiry)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.DB.Collection("api_keys").InsertOne(ctx, key)
+	if err != nil {
+		return nil, TranslateError(err)
+	}
+	if id, ok := res.InsertedID.(primitive.ObjectID); ok {
+		key.ID = id
+	}
+	return key, nil
+}
+
+// GetByPlaintext looks up a key that hasn't expired by the hash of its
+// plaintext.
+func (a *APIKeyModel) GetByPlaintext(ctx context.Context, plaintext string) (APIKey, error) {
+	ctx, cancel := a.Timeouts.read(ctx)
+	defer cancel()
+
+	var key APIKey
+	filter := bson.M{
+		"hash": hashToken(plaintext),
+		"$or": []bson.M{
+			{"expiry": bson.M{"$exists": false}},
+			{"expiry": bson.M{"$gt": time.Now()}},
+		},
+	}
+	err := a.DB.Collection("api_keys").FindOne(ctx, filter).Decode(&key)
+	return key, TranslateError(err)
+}
+
+// GetAllForUser returns the keys of a user, newest first.
+func (a *APIKeyModel) GetAllForUser(ctx context.Context, login string) ([]APIKey, error) {
+	ctx, cancel := a.Timeouts.list(ctx)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := a.DB.Collection("api_keys").Find(ctx, bson.M{"userLogin": login}, opts)
+	if err != nil {
+		return nil, TranslateError(err)
+	}
+	var keys []APIKey
+	if err = cursor.All(ctx, &keys); err != nil {
+		return nil, TranslateError(err)
+	}
+	return keys, nil
+}
+
+// Touch records that a key was used just now.
+func (a *APIKeyModel) Touch(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := a.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := a.DB.Collection("api_keys").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastUsed": time.Now()}})
+	return TranslateError(err)
+}
+
+// Delete revokes one of the user's keys.
+func (a *APIKeyModel) Delete(ctx context.Context, login string, id primitive.ObjectID) error {
+	ctx, cancel := a.Timeouts.write(ctx)
+	defer cancel()
+
+	res, err := a.DB.Collection("api_keys").DeleteOne(ctx, bson.M{"_id": id, "userLogin": login})
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteAllForUser revokes every key of a user.
+func (a *APIKeyModel) DeleteAllForUser(ctx context.Context, login string) error {
+	ctx, cancel := a.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := a.DB.Collection("api_keys").DeleteMany(ctx, bson.M{"userLogin": login})
+	return TranslateError(err)
+}
+
+// RenameUser moves every key of a user over to their new login.
+func (a *APIKeyModel) RenameUser(ctx context.Context, oldLogin, newLogin string) error {
+	ctx, cancel := a.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := a.DB.Collection("api_keys").UpdateMany(ctx,
+		bson.M{"userLogin": oldLogin},
+		bson.M{"$set": bson.M{"userLogin": newLogin}},
+	)
+	return TranslateError(err)
+}
+
+// Indexes returns the indexes of the api_keys collection.
+func (a *APIKeyModel) Indexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userLogin", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expiry", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryAPIKeyModel is the in-memory APIKeyRepository. Keys past their expiry
+// are dropped as new ones come in, as the TTL index on api_keys would.
+type MemoryAPIKeyModel struct {
+	mu   sync.Mutex
+	keys []APIKey
+}
+
+func (a *MemoryAPIKeyModel) New(ctx context.Context, login, name string, scopes []string, expiry time.Time) (*APIKey, error) {
+	if err := done(ctx); err != nil {
+		return nil, err
+	}
+	key, err := generateAPIKey(login, name, scopes, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	kept := a.keys[:0]
+	for _, other := range a.keys {
+		if other.Expiry.IsZero() || other.Expiry.After(now) {
+			kept = append(kept, other)
+		}
+	}
+	a.keys = kept
+	for _, other := range a.keys {
+		if bytes.Equal(other.Hash, key.Hash) {
+			return nil, &ErrDuplicate{Field: "hash"}
+		}
+	}
+
+	key.ID = primitive.NewObjectID()
+	var stored APIKey
+	clone(key, &stored)
+	a.keys = append(a.keys, stored)
+	return key, nil
+}
+
+func (a *MemoryAPIKeyModel) GetByPlaintext(ctx context.Context, plaintext string) (APIKey, error) {
+	if err := done(ctx); err != nil {
+		return APIKey{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	hash := hashToken(plaintext)
+	now := time.Now()
+	for _, stored := range a.keys {
+		if bytes.Equal(stored.Hash, hash) && (stored.Expiry.IsZero() || stored.Expiry.After(now)) {
+			var key APIKey
+			clone(stored, &key)
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (a *MemoryAPIKeyModel) GetAllForUser(ctx context.Context, login string) ([]APIKey, error) {
+	if err := done(ctx); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var keys []APIKey
+	for _, stored := range a.keys {
+		if stored.UserLogin == login {
+			var key APIKey
+			clone(stored, &key)
+			keys = append(keys, key)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (a *MemoryAPIKeyModel) Touch(ctx context.Context, id primitive.ObjectID) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := range a.keys {
+		if a.keys[i].ID == id {
+			a.keys[i].LastUsed = time.Now()
+			break
+		}
+	}
+	return nil
+}
+
+func (a *MemoryAPIKeyModel) Delete(ctx context.Context, login string, id primitive.ObjectID) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, key := range a.keys {
+		if key.ID == id && key.UserLogin == login {
+			a.keys = append(a.keys[:i], a.keys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (a *MemoryAPIKeyModel) DeleteAllForUser(ctx context.Context, login string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	kept := a.keys[:0]
+	for _, key := range a.keys {
+		if key.UserLogin != login {
+			kept = append(kept, key)
+		}
+	}
+	a.keys = kept
+	return nil
+}
+
+func (a *MemoryAPIKeyModel) RenameUser(ctx context.Context, oldLogin, newLogin string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := range a.keys {
+		if a.keys[i].UserLogin == oldLogin {
+			a.keys[i].UserLogin = newLogin
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package data
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit actions. They are named "<area>.<object>.<verb>".
+const (
+	AuditLogin         = "auth.session.login"
+	AuditLogout        = "auth.session.logout"
+	AuditSignup        = "auth.account.signup"
+	AuditPasswordReset = "auth.password.reset"
+	AuditProfileUpdate = "account.profile.update"
+	AuditProfileDelete = "account.profile.delete"
+	AuditDataExport    = "account.data.export"
+
+	AuditTwoFactorEnable     = "account.two_factor.enable"
+	AuditTwoFactorDisable    = "account.two_factor.disable"
+	AuditRecoveryCodeUse     = "auth.recovery_code.use"
+	AuditAPIKeyCreate        = "account.api_key.create"
+	AuditAPIKeyRevoke        = "account.api_key.revoke"
+	AuditSessionRevoke       = "account.session.revoke"
+	AuditSessionRevokeOthers = "account.session.revoke_others"
+
+	AuditAdminUserUpdate        = "admin.user.update"
+	AuditAdminUserActivate      = "admin.user.activate"
+	AuditAdminUserDeactivate    = "admin.user.deactivate"
+	AuditAdminUserDelete        = "admin.user.delete"
+	AuditAdminUserResetPassword = "admin.user.reset_password"
+	AuditAdminUserRevokeSession = "admin.user.revoke_sessions"
+)
+
+// AuditActions returns every audit action, for choosing one to filter by.
+func AuditActions() []string {
+	return []string{
+		AuditLogin,
+		AuditLogout,
+		AuditSignup,
+		AuditPasswordReset,
+		AuditProfileUpdate,
+		AuditProfileDelete,
+		AuditDataExport,
+		AuditTwoFactorEnable,
+		AuditTwoFactorDisable,
+		AuditRecoveryCodeUse,
+		AuditAPIKeyCreate,
+		AuditAPIKeyRevoke,
+		AuditSessionRevoke,
+		AuditSessionRevokeOthers,
+		AuditAdminUserUpdate,
+		AuditAdminUserActivate,
+		AuditAdminUserDeactivate,
+		AuditAdminUserDelete,
+		AuditAdminUserResetPassword,
+		AuditAdminUserRevokeSession,
+	}
+}
+
+// Outcomes of an audited action.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+type AuditModel struct {
+	DB       *mongo.Database
+	Timeouts Timeouts
+}
+
+// AuditEntry records who did what to whom. Entries are only ever inserted,
+// never changed or deleted, so the audit collection is a trail of every change
+// made and every attempt to log in.
+type AuditEntry struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Time      time.Time          `bson:"time" json:"time"`
+	Actor     string             `bson:"actor" json:"actor"`
+	Action    string             `bson:"action" json:"action"`
+	Outcome   string             `bson:"outcome" json:"outcome"`
+	Target    string             `bson:"target,omitempty" json:"target,omitempty"`
+	IP        string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string             `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	// Details holds what changed, e.g. the old and new value of a field, or
+	// why the action failed.
+	Details map[string]string `bson:"details,omitempty" json:"details,omitempty"`
+}
+
+func (a *AuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	ctx, cancel := a.Timeouts.write(ctx)
+	defer cancel()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = AuditSuccess
+	}
+	res, err := a.DB.Collection("audit").InsertOne(ctx, entry)
+	if err != nil {
+		return TranslateError(err)
+	}
+	if id, ok := res.InsertedID.(primitive.ObjectID); ok {
+		entry.ID = id
+	}
+	return nil
+}
+
+// AuditFilter selects audit entries. Empty fields match everything; From and
+// To bound the time of the entries, To itself excluded.
+type AuditFilter struct {
+	Actor   string
+	Action  string
+	Outcome string
+	Target  string
+	IP      string
+	From    time.Time
+	To      time.Time
+}
+
+func (f AuditFilter) query() bson.M {
+	query := bson.M{}
+	for field, value := range map[string]string{
+		"actor":   f.Actor,
+		"action":  f.Action,
+		"outcome": f.Outcome,
+		"target":  f.Target,
+		"ip":      f.IP,
+	} {
+		if value != "" {
+			query[field] = value
+		}
+	}
+	between := bson.M{}
+	if !f.From.IsZero() {
+		between["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		between["$lt"] = f.To
+	}
+	if len(between) > 0 {
+		query["time"] = between
+	}
+	return query
+}
+
+// FromDate and ToDate return the dates the filter was made from, as they are
+// entered in a date input. To is the day after the last day included.
+func (f AuditFilter) FromDate() string {
+	if f.From.IsZero() {
+		return ""
+	}
+	return f.From.Format("2006-01-02")
+}
+
+func (f AuditFilter) ToDate() string {
+	if f.To.IsZero() {
+		return ""
+	}
+	return f.To.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// Values returns the filter as the query parameters of the audit log page.
+func (f AuditFilter) Values() url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"actor":   f.Actor,
+		"action":  f.Action,
+		"outcome": f.Outcome,
+		"target":  f.Target,
+		"ip":      f.IP,
+		"from":    f.FromDate(),
+		"to":      f.ToDate(),
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values
+}
+
+// PageURL links to a page of the audit log with the same filter.
+func (f AuditFilter) PageURL(page int) string {
+	values := f.Values()
+	values.Set("page", strconv.Itoa(page))
+	return "/admin/audit?" + values.Encode()
+}
+
+// ExportURL links to the JSON export of the entries the filter selects.
+func (f AuditFilter) ExportURL() string {
+	return "/admin/audit/export?" + f.Values().Encode()
+}
+
+// GetAll returns a page of the entries the filter selects, newest first.
+func (a *AuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]AuditEntry, Metadata, error) {
+	ctx, cancel := a.Timeouts.list(ctx)
+	defer cancel()
+
+	collection := a.DB.Collection("audit")
+	query := filter.query()
+
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, Metadata{}, TranslateError(err)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(filters.offset()).
+		SetLimit(filters.limit())
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, Metadata{}, TranslateError(err)
+	}
+	var entries []AuditEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, Metadata{}, TranslateError(err)
+	}
+	return entries, calculateMetadata(total, filters.Page, filters.PageSize), nil
+}
+
+// Export returns up to limit of the entries the filter selects, newest first,
+// and whether there were more than that.
+func (a *AuditModel) Export(ctx context.Context, filter AuditFilter, limit int) ([]AuditEntry, bool, error) {
+	ctx, cancel := a.Timeouts.list(ctx)
+	defer cancel()
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(limit) + 1)
+	cursor, err := a.DB.Collection("audit").Find(ctx, filter.query(), opts)
+	if err != nil {
+		return nil, false, TranslateError(err)
+	}
+	entries := []AuditEntry{}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, false, TranslateError(err)
+	}
+	if len(entries) > limit {
+		return entries[:limit], true, nil
+	}
+	return entries, false, nil
+}
+
+// GetAllForUser returns every entry the user is the actor or the target of,
+// newest first.
+func (a *AuditModel) GetAllForUser(ctx context.Context, login string) ([]AuditEntry, error) {
+	ctx, cancel := a.Timeouts.list(ctx)
+	defer cancel()
+
+	query := bson.M{"$or": []bson.M{{"actor": login}, {"target": login}}}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	cursor, err := a.DB.Collection("audit").Find(ctx, query, opts)
+	if err != nil {
+		return nil, TranslateError(err)
+	}
+	entries := []AuditEntry{}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, TranslateError(err)
+	}
+	return entries, nil
+}
+
+// Indexes returns the indexes the audit queries need: by time for the whole
+// log, and by actor and target for looking up one user's events.
+func (a *AuditModel) Indexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "target", Value: 1}, {Key: "time", Value: -1}}},
+	}
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryAuditModel is the in-memory AuditRepository.
+type MemoryAuditModel struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (a *MemoryAuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = AuditSuccess
+	}
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	var stored AuditEntry
+	clone(entry, &stored)
+	a.entries = append(a.entries, stored)
+	return nil
+}
+
+// matches reports whether the entry is one the filter selects.
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	for _, field := range []struct{ want, got string }{
+		{f.Actor, entry.Actor},
+		{f.Action, entry.Action},
+		{f.Outcome, entry.Outcome},
+		{f.Target, entry.Target},
+		{f.IP, entry.IP},
+	} {
+		if field.want != "" && field.want != field.got {
+			return false
+		}
+	}
+	if !f.From.IsZero() && entry.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !entry.Time.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// newestFirst returns copies of the entries match returns true for, newest
+// first.
+func (a *MemoryAuditModel) newestFirst(match func(AuditEntry) bool) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := []AuditEntry{}
+	for _, stored := range a.entries {
+		if match(stored) {
+			var entry AuditEntry
+			clone(stored, &entry)
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.After(entries[j].Time)
+		}
+		return entries[i].ID.Hex() > entries[j].ID.Hex()
+	})
+	return entries
+}
+
+func (a *MemoryAuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]AuditEntry, Metadata, error) {
+	if err := done(ctx); err != nil {
+		return nil, Metadata{}, err
+	}
+	entries := a.newestFirst(filter.matches)
+	start, end := page(len(entries), filters)
+	return entries[start:end], calculateMetadata(int64(len(entries)), filters.Page, filters.PageSize), nil
+}
+
+func (a *MemoryAuditModel) Export(ctx context.Context, filter AuditFilter, limit int) ([]AuditEntry, bool, error) {
+	if err := done(ctx); err != nil {
+		return nil, false, err
+	}
+	entries := a.newestFirst(filter.matches)
+	if len(entries) > limit {
+		return entries[:limit], true, nil
+	}
+	return entries, false, nil
+}
+
+func (a *MemoryAuditModel) GetAllForUser(ctx context.Context, login string) ([]AuditEntry, error) {
+	if err := done(ctx); err != nil {
+		return nil, err
+	}
+	return a.newestFirst(func(entry AuditEntry) bool {
+		return entry.Actor == login || entry.Target == login
+	}), nil
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// The models return these errors, whatever the backend, so callers never need
+// to know about the driver's own.
+var (
+	// ErrNotFound is returned when the document a query is about doesn't
+	// exist.
+	ErrNotFound = errors.New("data: not found")
+	// ErrConflict is returned when a write clashes with a concurrent one and
+	// is abandoned. It may well succeed if tried again.
+	ErrConflict = errors.New("data: conflicting write")
+)
+
+// ErrDuplicate is returned when a write would give a document the same value
+// as another one in a field that has to be unique, such as a user's login or
+// email. Field is the top-level field, like "login" or "identities".
+type ErrDuplicate struct {
+	Field string
+	Err   error
+}
+
+func (e *ErrDuplicate) Error() string {
+	return "data: duplicate " + e.Field
+}
+
+func (e *ErrDuplicate) Unwrap() error {
+	return e.Err
+}
+
+// writeConflictCode is the code of Mongo's WriteConflict error.
+const writeConflictCode = 112
+
+// TimeoutError is returned by the models when a query doesn't finish before
+// its deadline, either the default one of its kind or an earlier one set by
+// the caller.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "data: query timed out: " + e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// UnavailableError is returned by the models when a query couldn't be
+// answered because the database can't be reached, or was abandoned because the
+// caller's context was cancelled, as happens when the client goes away or the
+// server shuts down.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return "data: database unavailable: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// TranslateError turns the errors of the driver into those of this package:
+// a missing document into ErrNotFound, a broken unique index into an
+// *ErrDuplicate, a write conflict into ErrConflict, and a query that was cut
+// short into a *TimeoutError or an *UnavailableError. Other errors, including
+// those that are translated already, are returned as they are.
+func TranslateError(err error) error {
+	var (
+		timeout     *TimeoutError
+		unavailable *UnavailableError
+		selection   topology.ServerSelectionError
+		server      mongo.ServerError
+	)
+	switch {
+	case err == nil, errors.As(err, &timeout), errors.As(err, &unavailable):
+		return err
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return &ErrDuplicate{Field: duplicateField(err), Err: err}
+	case errors.As(err, &server) && server.HasErrorCode(writeConflictCode):
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	case errors.As(err, &selection), errors.Is(err, mongo.ErrClientDisconnected):
+		return &UnavailableError{Err: err}
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err):
+		return &TimeoutError{Err: err}
+	case errors.Is(err, context.Canceled), mongo.IsNetworkError(err):
+		return &UnavailableError{Err: err}
+	default:
+		return err
+	}
+}
+
+// duplicateIndexRX finds the name of the index in Mongo's duplicate key
+// message, like "login_1" in
+//
+//	E11000 duplicate key error collection: novye.users index: login_1 dup key: { login: "bob" }
+var duplicateIndexRX = regexp.MustCompile(`index: (\S+)`)
+
+// indexKeyRX finds the first key in the default name Mongo gives an index,
+// which is made of its keys and their directions.
+var indexKeyRX = regexp.MustCompile(`^(.+?)_-?1(?:_|$)`)
+
+// duplicateField returns the field of the unique index a duplicate key error
+// is about. The first key of a compound index stands for all of them.
+func duplicateField(err error) string {
+	m := duplicateIndexRX.FindStringSubmatch(err.Error())
+	if m == nil {
+		return ""
+	}
+	field := m[1]
+	if field == "_id_" {
+		return "_id"
+	}
+	if k := indexKeyRX.FindStringSubmatch(field); k != nil {
+		field = k[1]
+	}
+	if i := strings.Index(field, "."); i > 0 {
+		field = field[:i]
+	}
+	return field
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"math"
+
+	"app/internal/validator"
+)
+
+// Filters holds the paging parameters of a list query.
+type Filters struct {
+	Page     int
+	PageSize int
+}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Check(f.Page > 0, "page", "must be greater than zero")
+	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+}
+
+func (f Filters) limit() int64 {
+	return int64(f.PageSize)
+}
+
+func (f Filters) offset() int64 {
+	return int64((f.Page - 1) * f.PageSize)
+}
+
+// Metadata describes where a page of results sits in the whole result set.
+type Metadata struct {
+	CurrentPage  int   `json:"current_page,omitempty"`
+	PageSize     int   `json:"page_size,omitempty"`
+	FirstPage    int   `json:"first_page,omitempty"`
+	LastPage     int   `json:"last_page,omitempty"`
+	TotalRecords int64 `json:"total_records,omitempty"`
+}
+
+func calculateMetadata(totalRecords int64, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
+
+// PreviousPage and NextPage return the neighbouring page numbers, or 0 when
+// there is no such page.
+func (m Metadata) PreviousPage() int {
+	if m.CurrentPage <= m.FirstPage {
+		return 0
+	}
+	return m.CurrentPage - 1
+}
+
+func (m Metadata) NextPage() int {
+	if m.CurrentPage >= m.LastPage {
+		return 0
+	}
+	return m.CurrentPage + 1
+}
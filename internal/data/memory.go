@@ -0,0 +1,46 @@
+package data
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The memory backend keeps each collection in a slice in insertion order,
+// which is the order Mongo returns unsorted documents in. It answers like the
+// Mongo backend does: missing documents are ErrNotFound, clashes with a unique
+// index are an *ErrDuplicate, and documents go in and come out through BSON, so
+// fields tagged bson:"-" are dropped and nothing is shared with the caller.
+
+// clone copies src into dst through BSON, the way a round trip through Mongo
+// would. It only fails if the types can't be encoded at all, which is a bug.
+func clone(src, dst interface{}) {
+	raw, err := bson.Marshal(src)
+	if err != nil {
+		panic(fmt.Sprintf("data: can't encode %T: %v", src, err))
+	}
+	if err := bson.Unmarshal(raw, dst); err != nil {
+		panic(fmt.Sprintf("data: can't decode %T: %v", dst, err))
+	}
+}
+
+// page returns the part of a result of n documents that filters asks for.
+func page(n int, filters Filters) (start, end int) {
+	start = int(filters.offset())
+	if start > n {
+		start = n
+	}
+	end = start + int(filters.limit())
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// done returns the error a query made with ctx fails with if ctx is already
+// cancelled or past its deadline, so the memory backend honours contexts the
+// way the Mongo one does.
+func done(ctx context.Context) error {
+	return TranslateError(ctx.Err())
+}
@@ -1,20 +1,136 @@
 package data
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// Backends NewModels can store data in.
+const (
+	BackendMongo  = "mongo"
+	BackendMemory = "memory"
+)
+
+// Every repository method takes the context of the request it serves, and gives
+// up once it is done. A query that is cut short fails with a *TimeoutError if
+// its deadline passed, or an *UnavailableError if it was cancelled or the
+// database can't be reached.
+
+// UserRepository stores user accounts. Logins and emails are unique: adding or
+// changing a user to clash with another fails with an *ErrDuplicate, and
+// looking up a user who doesn't exist fails with ErrNotFound, whatever the
+// backend.
+type UserRepository interface {
+	Insert(ctx context.Context, user User) error
+	GetByLogin(ctx context.Context, login string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	GetByIdentity(ctx context.Context, provider, subject string) (User, error)
+	AddIdentity(ctx context.Context, login string, identity Identity) error
+	UpdatePassword(ctx context.Context, login string, passwordHash string) error
+	UpdateRole(ctx context.Context, login string, role string) error
+	UpdateTwoFactor(ctx context.Context, login string, secret string, enabled bool, recoveryCodes []string) error
+	UseTOTPStep(ctx context.Context, login string, step int64) error
+	UseRecoveryCode(ctx context.Context, login string, code string) error
+	GetAllUsers(ctx context.Context) ([]User, error)
+	Search(ctx context.Context, query string, filters Filters) ([]User, Metadata, error)
+	DeleteUserByLogin(ctx context.Context, login string) error
+	UpdateUserByLogin(ctx context.Context, login string, newUser User) error
+	SetActivated(ctx context.Context, login string, activated bool) error
+}
+
+// TokenRepository stores activation, password reset and session tokens.
+type TokenRepository interface {
+	New(ctx context.Context, login string, ttl time.Duration, scope string) (*Token, error)
+	NewForFamily(ctx context.Context, login string, ttl time.Duration, scope string, session Session, parent []byte) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteToken(ctx context.Context, tokenPlaintext string) error
+	DeleteAllForUser(ctx context.Context, scope string, login string) error
+	DeleteAllByLogin(ctx context.Context, login string) error
+	RenameUser(ctx context.Context, oldLogin, newLogin string) error
+	DeleteFamily(ctx context.Context, login, family string) error
+	DeleteSessionsByLogin(ctx context.Context, login string, keepFamily string) error
+	DeleteSession(ctx context.Context, login string, id primitive.ObjectID) error
+	GetSessions(ctx context.Context, login string) ([]Token, error)
+	Extend(ctx context.Context, login, family string, expiry time.Time) error
+	Rotate(ctx context.Context, tokenPlaintext string, ttl, grace time.Duration) (Token, *Token, error)
+	GetTokenDocumentByToken(ctx context.Context, scope, tokenPlaintext string) (Token, error)
+	GetTokenDocumentByLogin(ctx context.Context, login string) (Token, error)
+}
+
+// TicketRepository stores receipts.
+type TicketRepository interface {
+	Insert(ctx context.Context, ticket Ticket) (Ticket, error)
+	GetById(ctx context.Context, id string) (Ticket, error)
+	GetByLogin(ctx context.Context, login string) ([]Ticket, error)
+	RenameUser(ctx context.Context, oldLogin, newLogin string) error
+	AnonymizeUser(ctx context.Context, login string) error
+	GetLatest(ctx context.Context) ([]Ticket, error)
+}
+
+// AuditRepository stores the audit log. It can only be added to.
+type AuditRepository interface {
+	Insert(ctx context.Context, entry *AuditEntry) error
+	GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]AuditEntry, Metadata, error)
+	Export(ctx context.Context, filter AuditFilter, limit int) ([]AuditEntry, bool, error)
+	GetAllForUser(ctx context.Context, login string) ([]AuditEntry, error)
+}
+
+// APIKeyRepository stores API keys.
+type APIKeyRepository interface {
+	New(ctx context.Context, login, name string, scopes []string, expiry time.Time) (*APIKey, error)
+	GetByPlaintext(ctx context.Context, plaintext string) (APIKey, error)
+	GetAllForUser(ctx context.Context, login string) ([]APIKey, error)
+	Touch(ctx context.Context, id primitive.ObjectID) error
+	Delete(ctx context.Context, login string, id primitive.ObjectID) error
+	DeleteAllForUser(ctx context.Context, login string) error
+	RenameUser(ctx context.Context, oldLogin, newLogin string) error
+}
+
 // dependency injection pattern
 type Models struct {
-	Tokens  TokenModel
-	Users   UserModel
-	Tickets TicketModel
+	Tokens  TokenRepository
+	Users   UserRepository
+	Tickets TicketRepository
+	Audit   AuditRepository
+	APIKeys APIKeyRepository
+}
+
+// NewModels returns the repositories of the given backend. The Mongo backend
+// stores everything in db and gives each query the default deadline timeouts
+// sets for its kind; the memory backend ignores both and keeps everything in
+// memory until the process exits.
+func NewModels(backend string, db *mongo.Database, timeouts Timeouts) (Models, error) {
+	switch backend {
+	case BackendMongo:
+		if db == nil {
+			return Models{}, fmt.Errorf("the %s backend needs a database", backend)
+		}
+		return Models{
+			Tickets: &TicketModel{DB: db, Timeouts: timeouts},
+			Tokens:  &TokenModel{DB: db, Timeouts: timeouts},
+			Users:   &UserModel{DB: db, Timeouts: timeouts},
+			Audit:   &AuditModel{DB: db, Timeouts: timeouts},
+			APIKeys: &APIKeyModel{DB: db, Timeouts: timeouts},
+		}, nil
+	case BackendMemory:
+		return NewMemoryModels(), nil
+	default:
+		return Models{}, fmt.Errorf("unknown data backend %q", backend)
+	}
 }
 
-func NewModels(db *mongo.Database) Models {
+// NewMemoryModels returns empty in-memory repositories, for running the app
+// without a database.
+func NewMemoryModels() Models {
 	return Models{
-		Tickets: TicketModel{DB: db},
-		Tokens:  TokenModel{DB: db},
-		Users:   UserModel{DB: db},
+		Tickets: &MemoryTicketModel{},
+		Tokens:  &MemoryTokenModel{},
+		Users:   &MemoryUserModel{},
+		Audit:   &MemoryAuditModel{},
+		APIKeys: &MemoryAPIKeyModel{},
 	}
 }
@@ -0,0 +1,239 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// backends returns the models to run a test against: the memory backend, and
+// the Mongo one, with the indexes main creates, when TEST_MONGO_URI names a
+// database server to use. Both must behave the same.
+func backends(t *testing.T) map[string]Models {
+	t.Helper()
+
+	backends := map[string]Models{"memory": NewMemoryModels()}
+
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		return backends
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("data_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	users := &UserModel{DB: db, Timeouts: DefaultTimeouts}
+	if _, err := db.Collection("users").Indexes().CreateMany(context.Background(), users.Indexes()); err != nil {
+		t.Fatal(err)
+	}
+	models, err := NewModels(BackendMongo, db, DefaultTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends["mongo"] = models
+	return backends
+}
+
+// wantDuplicate fails the test unless err is an *ErrDuplicate for field.
+func wantDuplicate(t *testing.T, err error, field string) {
+	t.Helper()
+
+	var dup *ErrDuplicate
+	if !errors.As(err, &dup) {
+		t.Fatalf("got error %v; want a duplicate %s", err, field)
+	}
+	if dup.Field != field {
+		t.Errorf("got a duplicate %s; want %s", dup.Field, field)
+	}
+}
+
+func TestUsersUnique(t *testing.T) {
+	ctx := context.Background()
+
+	for name, models := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			users := models.Users
+			for _, user := range []User{
+				{Login: "alice", Email: "alice@example.com", Name: "Alice"},
+				{Login: "bob", Email: "bob@example.com", Name: "Bob"},
+			} {
+				if err := users.Insert(ctx, user); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := users.Insert(ctx, User{Login: "alice", Email: "other@example.com"})
+			wantDuplicate(t, err, "login")
+			err = users.Insert(ctx, User{Login: "carol", Email: "alice@example.com"})
+			wantDuplicate(t, err, "email")
+
+			// Changing a user to clash with another fails the same way, and
+			// leaves them as they were.
+			err = users.UpdateUserByLogin(ctx, "bob", User{Login: "alice"})
+			wantDuplicate(t, err, "login")
+			err = users.UpdateUserByLogin(ctx, "bob", User{Email: "alice@example.com"})
+			wantDuplicate(t, err, "email")
+			bob, err := users.GetByLogin(ctx, "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bob.Email != "bob@example.com" {
+				t.Errorf("got email %q after failed update; want bob@example.com", bob.Email)
+			}
+
+			// An account at a provider is linked to one user only.
+			identity := Identity{Provider: "google", Subject: "1234", Email: "alice@example.com", LinkedAt: time.Now()}
+			if err := users.AddIdentity(ctx, "alice", identity); err != nil {
+				t.Fatal(err)
+			}
+			err = users.AddIdentity(ctx, "bob", identity)
+			wantDuplicate(t, err, "identities")
+			user, err := users.GetByIdentity(ctx, "google", "1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Login != "alice" {
+				t.Errorf("identity belongs to %q; want alice", user.Login)
+			}
+
+			// Users without identities don't clash over the missing ones.
+			if err := users.Insert(ctx, User{Login: "carol", Email: "carol@example.com"}); err != nil {
+				t.Errorf("third user without identities: %v", err)
+			}
+
+			if _, err := users.GetByLogin(ctx, "nobody"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("unknown login: got error %v; want ErrNotFound", err)
+			}
+			if err := users.SetActivated(ctx, "nobody", true); !errors.Is(err, ErrNotFound) {
+				t.Errorf("activating unknown login: got error %v; want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestTickets(t *testing.T) {
+	ctx := context.Background()
+
+	for name, models := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			tickets := models.Tickets
+			// ids returns the sorted ids of the tickets a query found.
+			ids := func(found []Ticket, err error) []string {
+				t.Helper()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := make([]string, 0, len(found))
+				for _, ticket := range found {
+					ids = append(ids, ticket.ID)
+				}
+				sort.Strings(ids)
+				return ids
+			}
+
+			for _, ticket := range []Ticket{
+				{ID: "1", UserLogin: "alice", Total: 350, Products: []Product{{Name: "milk", Price: 175, Amount: 2}}},
+				{ID: "2", UserLogin: "bob", Total: 120, Products: []Product{{Name: "bread", Price: 120, Amount: 1}}},
+				{ID: "3", UserLogin: "alice", Total: 90, Products: []Product{{Name: "apple", Price: 30, Amount: 3}}},
+			} {
+				got, err := tickets.Insert(ctx, ticket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.ID != ticket.ID {
+					t.Errorf("inserted ticket got id %q; want %q", got.ID, ticket.ID)
+				}
+			}
+
+			_, err := tickets.Insert(ctx, Ticket{ID: "1", UserLogin: "carol"})
+			wantDuplicate(t, err, "_id")
+
+			ticket, err := tickets.GetById(ctx, "2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ticket.UserLogin != "bob" || len(ticket.Products) != 1 || ticket.Products[0].Name != "bread" {
+				t.Errorf("got ticket %+v; want bob's bread", ticket)
+			}
+			if _, err := tickets.GetById(ctx, "4"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("unknown id: got error %v; want ErrNotFound", err)
+			}
+
+			if got := ids(tickets.GetByLogin(ctx, "alice")); fmt.Sprint(got) != "[1 3]" {
+				t.Errorf("alice's tickets: got %v; want [1 3]", got)
+			}
+			if got := ids(tickets.GetLatest(ctx)); fmt.Sprint(got) != "[1 2 3]" {
+				t.Errorf("all tickets: got %v; want [1 2 3]", got)
+			}
+
+			if err := tickets.RenameUser(ctx, "alice", "alicia"); err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(tickets.GetByLogin(ctx, "alicia")); fmt.Sprint(got) != "[1 3]" {
+				t.Errorf("after renaming: got %v; want [1 3]", got)
+			}
+			if err := tickets.AnonymizeUser(ctx, "alicia"); err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(tickets.GetByLogin(ctx, "alicia")); len(got) != 0 {
+				t.Errorf("after anonymizing: got %v; want none", got)
+			}
+			// The receipts themselves are kept.
+			if got := ids(tickets.GetLatest(ctx)); len(got) != 3 {
+				t.Errorf("after anonymizing: got %v; want all three tickets", got)
+			}
+		})
+	}
+}
+
+func TestTokensRotate(t *testing.T) {
+	ctx := context.Background()
+
+	for name, models := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			tokens := models.Tokens
+			first, err := tokens.NewForFamily(ctx, "alice", time.Hour, ScopeRefresh, Session{Family: "family"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			old, second, err := tokens.Rotate(ctx, first.Plaintext, time.Hour, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if old.UserLogin != "alice" || second.Family != "family" || second.Plaintext == first.Plaintext {
+				t.Fatalf("got %+v replaced by %+v; want alice's token replaced within its family", old, second)
+			}
+
+			// Presenting the token again within the grace gives the same
+			// replacement, and doesn't revoke the family.
+			_, again, err := tokens.Rotate(ctx, first.Plaintext, time.Hour, time.Minute)
+			if err != nil {
+				t.Fatalf("rotating within the grace: %v", err)
+			}
+			if again.Plaintext != second.Plaintext {
+				t.Error("rotating within the grace gave a different replacement")
+			}
+
+			// Past it, the token counts as stolen.
+			if _, _, err := tokens.Rotate(ctx, first.Plaintext, time.Hour, 0); !errors.Is(err, ErrTokenReused) {
+				t.Fatalf("rotating past the grace: got error %v; want ErrTokenReused", err)
+			}
+			if _, _, err := tokens.Rotate(ctx, second.Plaintext, time.Hour, time.Minute); !errors.Is(err, ErrNotFound) {
+				t.Errorf("rotating the revoked replacement: got error %v; want ErrNotFound", err)
+			}
+		})
+	}
+}
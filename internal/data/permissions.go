@@ -0,0 +1,78 @@
+package data
+
+// Roles a user can have. Users created before roles existed have no role
+// stored and are treated as customers.
+const (
+	RoleCustomer = "customer"
+	RoleCashier  = "cashier"
+	RoleAdmin    = "admin"
+)
+
+// Permission codes, named "<resource>:<action>". Handlers are guarded by a
+// permission rather than by a role, so what a role may do is decided in one
+// place, rolePermissions.
+const (
+	PermissionTicketsReadOwn = "tickets:read_own"
+	PermissionTicketsReadAll = "tickets:read_all"
+	PermissionTicketsCreate  = "tickets:create"
+	PermissionUsersManage    = "users:manage"
+	PermissionAPIKeysManage  = "apikeys:manage"
+	PermissionAuditRead      = "audit:read"
+)
+
+// Permissions is the set of permission codes granted to a user.
+type Permissions []string
+
+// Include reports whether code is one of the permissions.
+func (p Permissions) Include(code string) bool {
+	for _, c := range p {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+var rolePermissions = map[string]Permissions{
+	RoleCustomer: {
+		PermissionTicketsReadOwn,
+	},
+	RoleCashier: {
+		PermissionTicketsReadOwn,
+		PermissionTicketsReadAll,
+		PermissionTicketsCreate,
+		PermissionAPIKeysManage,
+	},
+	RoleAdmin: {
+		PermissionTicketsReadOwn,
+		PermissionTicketsReadAll,
+		PermissionTicketsCreate,
+		PermissionUsersManage,
+		PermissionAPIKeysManage,
+		PermissionAuditRead,
+	},
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Roles returns the known roles, least privileged first.
+func Roles() []string {
+	return []string{RoleCustomer, RoleCashier, RoleAdmin}
+}
+
+// Permissions returns what the user's role allows them to do.
+func (u User) Permissions() Permissions {
+	if u.Role == "" {
+		return rolePermissions[RoleCustomer]
+	}
+	return rolePermissions[u.Role]
+}
+
+// Can reports whether the user has the permission code.
+func (u User) Can(code string) bool {
+	return u.Permissions().Include(code)
+}
@@ -10,12 +10,51 @@ type TemplateData struct {
 	// Form            *forms.Form
 	// Snippet         *models.Snippet
 	IsAuthenticated bool
+	HasPassword     bool // false for users who only log in through an OpenID provider
+	CSRFToken       string
 	Envelope        Envelope
 	CurrentYear     string
 	ErrorText       string
+	Flash           string
 	Code            int
 	User            User
 	Tickets         []Ticket
+	Users           []User
+	Metadata        Metadata
+	Query           string
+	Sessions        []Token
+	CurrentSession  string
+	Token           string
+	TwoFactor       TwoFactorSetup
+	Providers       []LoginProvider
+	APIKeys         []APIKey
+	NewAPIKey       *APIKey
+	Scopes          []string
+	AuditEntries    []AuditEntry
+	AuditFilter     AuditFilter
+	AuditActions    []string
+}
+
+// LoginProvider is an OpenID provider users can log in with.
+type LoginProvider struct {
+	Name        string
+	DisplayName string
+}
+
+// TwoFactorSetup is what the user needs to add their account to an
+// authenticator app. It is only shown once, during enrollment.
+type TwoFactorSetup struct {
+	QRCode        template.HTML // the provisioning URI, as an SVG to scan
+	Secret        string
+	RecoveryCodes []string
+}
+
+// Can reports whether the current user has the permission code, so pages can
+// show only the actions the user is allowed to take:
+//
+//	{{ if .Can "tickets:read_all" }}...{{ end }}
+func (td *TemplateData) Can(code string) bool {
+	return td.IsAuthenticated && td.User.Can(code)
 }
 
 type Envelope map[string]interface{}
@@ -25,6 +64,7 @@ type Envelope map[string]interface{}
 // functions and the functions themselves.
 var functions = template.FuncMap{
 	"humanDate": humanDate,
+	"roles":     Roles,
 }
 
 func NewTemplateCache(dir string) (map[string]*template.Template, error) {
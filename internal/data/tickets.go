@@ -24,35 +24,90 @@ type Product struct {
 }
 
 type TicketModel struct {
-	DB *mongo.Database
+	DB       *mongo.Database
+	Timeouts Timeouts
 }
 
-func (t *TicketModel) Insert(ticket Ticket) (Ticket, error) {
-	res, err := t.DB.Collection("tickets").InsertOne(context.TODO(), ticket)
-	ticket.ID = fmt.Sprint(res.InsertedID)
+func (t *TicketModel) Insert(ctx context.Context, ticket Ticket) (Ticket, error) {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	res, err := t.DB.Collection("tickets").InsertOne(ctx, ticket)
 	if err != nil {
-		return Ticket{}, err
+		return Ticket{}, TranslateError(err)
 	}
+	ticket.ID = fmt.Sprint(res.InsertedID)
 	return ticket, nil
 }
 
-func (t *TicketModel) GetById(id string) (Ticket, error) {
+func (t *TicketModel) GetById(ctx context.Context, id string) (Ticket, error) {
+	ctx, cancel := t.Timeouts.read(ctx)
+	defer cancel()
+
 	var ticket Ticket
-	err := t.DB.Collection("tickets").FindOne(context.TODO(), bson.M{"_id": id}).Decode(&ticket)
-	return ticket, err
+	err := t.DB.Collection("tickets").FindOne(ctx, bson.M{"_id": id}).Decode(&ticket)
+	return ticket, TranslateError(err)
 }
 
-func (t *TicketModel) GetLatest() ([]Ticket, error) {
+// GetByLogin returns the tickets of one user, oldest first.
+func (t *TicketModel) GetByLogin(ctx context.Context, login string) ([]Ticket, error) {
+	ctx, cancel := t.Timeouts.list(ctx)
+	defer cancel()
+
+	var tickets []Ticket
+	collection := t.DB.Collection("tickets")
+	options := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{"userlogin": login}, options)
+	if err != nil {
+		return []Ticket{}, TranslateError(err)
+	}
+
+	if err = cursor.All(ctx, &tickets); err != nil {
+		return []Ticket{}, TranslateError(err)
+	}
+	return tickets, nil
+}
+
+// RenameUser moves every ticket of a user over to their new login.
+func (t *TicketModel) RenameUser(ctx context.Context, oldLogin, newLogin string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tickets").UpdateMany(ctx,
+		bson.M{"userlogin": oldLogin},
+		bson.M{"$set": bson.M{"userlogin": newLogin}},
+	)
+	return TranslateError(err)
+}
+
+// AnonymizeUser clears the login on every ticket of a user whose account is
+// deleted. The tickets themselves are kept for accounting. No account can have
+// an empty login, so the tickets don't show up for anyone.
+func (t *TicketModel) AnonymizeUser(ctx context.Context, login string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tickets").UpdateMany(ctx,
+		bson.M{"userlogin": login},
+		bson.M{"$set": bson.M{"userlogin": ""}},
+	)
+	return TranslateError(err)
+}
+
+func (t *TicketModel) GetLatest(ctx context.Context) ([]Ticket, error) {
+	ctx, cancel := t.Timeouts.list(ctx)
+	defer cancel()
+
 	var tickets []Ticket
 	collection := t.DB.Collection("tickets")
-	options := options.Find().SetSort(bson.D{{"created", 1}})
-	cursor, err := collection.Find(context.Background(), bson.D{}, options)
+	options := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{}, options)
 	if err != nil {
-		return []Ticket{}, err
+		return []Ticket{}, TranslateError(err)
 	}
 
-	if err = cursor.All(context.TODO(), &tickets); err != nil {
-		return []Ticket{}, err
+	if err = cursor.All(ctx, &tickets); err != nil {
+		return []Ticket{}, TranslateError(err)
 	}
 	return tickets, nil
 }
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MemoryTicketModel is the in-memory TicketRepository.
+type MemoryTicketModel struct {
+	mu      sync.Mutex
+	tickets []Ticket
+}
+
+func (t *MemoryTicketModel) Insert(ctx context.Context, ticket Ticket) (Ticket, error) {
+	if err := done(ctx); err != nil {
+		return Ticket{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, other := range t.tickets {
+		if other.ID == ticket.ID {
+			return Ticket{}, &ErrDuplicate{Field: "_id"}
+		}
+	}
+	var stored Ticket
+	clone(ticket, &stored)
+	t.tickets = append(t.tickets, stored)
+	ticket.ID = fmt.Sprint(stored.ID)
+	return ticket, nil
+}
+
+func (t *MemoryTicketModel) GetById(ctx context.Context, id string) (Ticket, error) {
+	if err := done(ctx); err != nil {
+		return Ticket{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, stored := range t.tickets {
+		if stored.ID == id {
+			var ticket Ticket
+			clone(stored, &ticket)
+			return ticket, nil
+		}
+	}
+	return Ticket{}, ErrNotFound
+}
+
+func (t *MemoryTicketModel) GetByLogin(ctx context.Context, login string) ([]Ticket, error) {
+	if err := done(ctx); err != nil {
+		return nil, err
+	}
+	return t.getWhere(func(ticket Ticket) bool { return ticket.UserLogin == login }), nil
+}
+
+func (t *MemoryTicketModel) GetLatest(ctx context.Context) ([]Ticket, error) {
+	if err := done(ctx); err != nil {
+		return nil, err
+	}
+	return t.getWhere(func(Ticket) bool { return true }), nil
+}
+
+func (t *MemoryTicketModel) getWhere(match func(Ticket) bool) []Ticket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tickets := []Ticket{}
+	for _, stored := range t.tickets {
+		if match(stored) {
+			var ticket Ticket
+			clone(stored, &ticket)
+			tickets = append(tickets, ticket)
+		}
+	}
+	return tickets
+}
+
+func (t *MemoryTicketModel) RenameUser(ctx context.Context, oldLogin, newLogin string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.tickets {
+		if t.tickets[i].UserLogin == oldLogin {
+			t.tickets[i].UserLogin = newLogin
+		}
+	}
+	return nil
+}
+
+func (t *MemoryTicketModel) AnonymizeUser(ctx context.Context, login string) error {
+	return t.RenameUser(ctx, login, "")
+}
@@ -0,0 +1,45 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts are the default deadlines of the queries the Mongo models run, by
+// kind of query. They only ever shorten the deadline of the caller's context.
+// A zero duration leaves the caller's deadline as it is.
+type Timeouts struct {
+	// Read is for looking up single documents.
+	Read time.Duration
+	// Write is for inserts, updates and deletes.
+	Write time.Duration
+	// List is for queries that return many documents, like searches, the
+	// audit log and exports.
+	List time.Duration
+}
+
+// DefaultTimeouts are the deadlines used when none are configured.
+var DefaultTimeouts = Timeouts{
+	Read:  3 * time.Second,
+	Write: 5 * time.Second,
+	List:  10 * time.Second,
+}
+
+func (t Timeouts) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return WithTimeout(ctx, t.Read)
+}
+
+func (t Timeouts) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return WithTimeout(ctx, t.Write)
+}
+
+func (t Timeouts) list(ctx context.Context) (context.Context, context.CancelFunc) {
+	return WithTimeout(ctx, t.List)
+}
+
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -2,157 +2,445 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"app/internal/encrypt"
+	"app/internal/validator"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ScopeActivation     = "activation"
+	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
+	ScopePasswordReset  = "password-reset"
+	ScopeTwoFactor      = "two-factor"
 )
 
+// ErrTokenReused is returned by Rotate when a refresh token that has already
+// been rotated is presented again. By then the whole family has been revoked.
+var ErrTokenReused = errors.New("refresh token reused")
+
 type TokenModel struct {
-	DB *mongo.Database
+	DB       *mongo.Database
+	Timeouts Timeouts
 }
 
+// Token holds the data for an individual token. Only the SHA-256 hash of the
+// plaintext is stored in the tokens collection; the plaintext itself is handed
+// to the client once and never persisted. The collection has a TTL index on
+// expiry, so Mongo removes tokens on its own once they have expired.
 type Token struct {
-	UserLogin string `json:"userLogin"`
-	Token     string `json:"token"`
-	TTL       string `json:"ttl"`
+	Plaintext string    `bson:"-" json:"token"`
+	Hash      []byte    `bson:"hash" json:"-"`
+	UserLogin string    `bson:"userLogin" json:"userLogin"`
+	Expiry    time.Time `bson:"expiry" json:"expiry"`
+	Scope     string    `bson:"scope" json:"-"`
+	// Parent is the hash of the refresh token this one replaced.
+	Parent  []byte `bson:"parent,omitempty" json:"-"`
+	Rotated bool   `bson:"rotated" json:"-"`
+	// RotatedAt is when a refresh token was rotated, and Successor the
+	// plaintext of its replacement, sealed with a key derived from this
+	// token's plaintext. It lets a request that was racing the rotation get
+	// the same replacement, and can't be opened with the database alone.
+	RotatedAt time.Time `bson:"rotatedAt,omitempty" json:"-"`
+	Successor string    `bson:"successor,omitempty" json:"-"`
+	Session   `bson:",inline"`
+}
+
+// Session is the part of a token shared by its whole family. A family groups
+// every token issued from one login: the access and refresh tokens created
+// together, and all the tokens that descend from them by refresh. It records
+// the device the user logged in from, when the session was last used, and the
+// absolute deadline after which no token of the family is valid any more.
+type Session struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Family    string             `bson:"family,omitempty" json:"-"`
+	UserAgent string             `bson:"userAgent,omitempty" json:"userAgent"`
+	IP        string             `bson:"ip,omitempty" json:"ip"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	LastSeen  time.Time          `bson:"lastSeen" json:"lastSeen"`
+	MaxExpiry time.Time          `bson:"maxExpiry,omitempty" json:"maxExpiry"`
+}
+
+// NewFamily returns a random id for a new token family.
+func NewFamily() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func generateToken(login string, ttl time.Duration, scope string) (*Token, error) {
+	token := &Token{
+		UserLogin: login,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+	}
+	plaintext, err := generatePlaintext()
+	if err != nil {
+		return nil, err
+	}
+	token.Plaintext = plaintext
+	token.Hash = hashToken(token.Plaintext)
+	return token, nil
+}
+
+func generatePlaintext() (string, error) {
+	// Fill a 16 byte slice with random bytes from the operating system's CSPRNG.
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	// Encode the random bytes to a base-32 string without padding, giving a 26
+	// character token like Y3QMGX3PJ3WLRL2YRTQGQ6KRHU.
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// successor returns the refresh token with the given plaintext that replaces
+// old. It carries on old's session, and expires after ttl but not after the
+// session does.
+func successor(old Token, plaintext string, ttl time.Duration) *Token {
+	now := time.Now()
+	token := &Token{
+		Plaintext: plaintext,
+		Hash:      hashToken(plaintext),
+		UserLogin: old.UserLogin,
+		Expiry:    now.Add(ttl),
+		Scope:     ScopeRefresh,
+		Parent:    old.Hash,
+		Session:   old.Session,
+	}
+	token.ID = primitive.NilObjectID
+	token.LastSeen = now
+	if !token.MaxExpiry.IsZero() && token.MaxExpiry.Before(token.Expiry) {
+		token.Expiry = token.MaxExpiry
+	}
+	return token
+}
+
+// successorCipher returns the cipher that seals the replacement of the token
+// with plaintext tokenPlaintext.
+func successorCipher(tokenPlaintext string) (*encrypt.Cipher, error) {
+	key := sha256.Sum256([]byte("refresh-successor:" + tokenPlaintext))
+	return encrypt.New(key[:])
+}
+
+// sealSuccessor encrypts the plaintext of the token that replaces the one with
+// plaintext tokenPlaintext.
+func sealSuccessor(tokenPlaintext, next string) (string, error) {
+	c, err := successorCipher(tokenPlaintext)
+	if err != nil {
+		return "", err
+	}
+	return c.EncryptString(next)
+}
+
+// openSuccessor returns the plaintext of the replacement of token, which was
+// presented as tokenPlaintext, if it was rotated no longer than grace ago.
+func openSuccessor(token Token, tokenPlaintext string, grace time.Duration, now time.Time) (string, bool) {
+	if token.Successor == "" || now.Sub(token.RotatedAt) > grace {
+		return "", false
+	}
+	c, err := successorCipher(tokenPlaintext)
+	if err != nil {
+		return "", false
+	}
+	next, err := c.DecryptString(token.Successor)
+	if err != nil {
+		return "", false
+	}
+	return next, true
+}
+
+// hashToken returns the SHA-256 hash of a plaintext token as a slice, which is
+// the form the token is looked up by in the tokens collection.
+func hashToken(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
+// Check that the plaintext token has been provided and is exactly 26 bytes long.
+func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+}
+
+// New is a shortcut which creates a new Token and then inserts it in the tokens
+// collection.
+func (t *TokenModel) New(ctx context.Context, login string, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(login, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// NewForFamily creates and inserts a token that belongs to session.Family.
+// parent is the hash of the refresh token being replaced, or nil for the first
+// tokens of a family.
+func (t *TokenModel) NewForFamily(ctx context.Context, login string, ttl time.Duration, scope string, session Session, parent []byte) (*Token, error) {
+	token, err := generateToken(login, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	session.ID = primitive.NilObjectID
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = time.Now()
+	}
+	if session.LastSeen.IsZero() {
+		session.LastSeen = time.Now()
+	}
+	token.Session = session
+	token.Parent = parent
+	if err = t.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (t *TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tokens").InsertOne(ctx, token)
+	return TranslateError(err)
 }
 
-func (t *TokenModel) Insert(token Token) error {
-	_, err := t.DB.Collection("tokens").InsertOne(context.TODO(), token)
-	return err
+func (t *TokenModel) DeleteToken(ctx context.Context, tokenPlaintext string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tokens").DeleteOne(ctx, bson.M{"hash": hashToken(tokenPlaintext)})
+	return TranslateError(err)
+}
+
+// DeleteAllForUser deletes all tokens for a specific user and scope.
+func (t *TokenModel) DeleteAllForUser(ctx context.Context, scope string, login string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tokens").DeleteMany(ctx, bson.M{"scope": scope, "userLogin": login})
+	return TranslateError(err)
 }
 
-func (t *TokenModel) DeleteToken(token string) error {
-	_, err := t.DB.Collection("tokens").DeleteOne(context.TODO(), bson.M{"token": token})
-	return err
+// DeleteAllByLogin deletes every token of a user, whatever its scope.
+func (t *TokenModel) DeleteAllByLogin(ctx context.Context, login string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tokens").DeleteMany(ctx, bson.M{"userLogin": login})
+	return TranslateError(err)
+}
+
+// RenameUser moves every token of a user over to their new login.
+func (t *TokenModel) RenameUser(ctx context.Context, oldLogin, newLogin string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tokens").UpdateMany(ctx,
+		bson.M{"userLogin": oldLogin},
+		bson.M{"$set": bson.M{"userLogin": newLogin}},
+	)
+	return TranslateError(err)
 }
 
-func (t *TokenModel) GetTokenDocumentByToken(tok string) (Token, error) {
+// DeleteFamily revokes every token of a family.
+func (t *TokenModel) DeleteFamily(ctx context.Context, login, family string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := t.DB.Collection("tokens").DeleteMany(ctx, bson.M{"userLogin": login, "family": family})
+	return TranslateError(err)
+}
+
+// DeleteSessionsByLogin revokes all of a user's authentication and refresh
+// tokens, except those of the family given by keepFamily, if any.
+func (t *TokenModel) DeleteSessionsByLogin(ctx context.Context, login string, keepFamily string) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	filter := bson.M{
+		"userLogin": login,
+		"scope":     bson.M{"$in": []string{ScopeAuthentication, ScopeRefresh}},
+	}
+	if keepFamily != "" {
+		filter["family"] = bson.M{"$ne": keepFamily}
+	}
+	_, err := t.DB.Collection("tokens").DeleteMany(ctx, filter)
+	return TranslateError(err)
+}
+
+// DeleteSession revokes the session a token listed by GetSessions belongs to.
+func (t *TokenModel) DeleteSession(ctx context.Context, login string, id primitive.ObjectID) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := t.DB.Collection("tokens")
+
 	var token Token
-	err := t.DB.Collection("tokens").FindOne(context.TODO(), bson.M{"token": tok}).Decode(&token)
+	err := collection.FindOne(ctx, bson.M{"_id": id, "userLogin": login}).Decode(&token)
 	if err != nil {
-		return token, err
+		return TranslateError(err)
+	}
+	if token.Family == "" {
+		_, err = collection.DeleteOne(ctx, bson.M{"_id": id})
+		return TranslateError(err)
 	}
+	return t.DeleteFamily(ctx, login, token.Family)
+}
+
+// GetSessions returns one token per live session of the user, most recently
+// used first: the current refresh token of each family, plus any long-lived
+// authentication tokens issued before token families existed.
+func (t *TokenModel) GetSessions(ctx context.Context, login string) ([]Token, error) {
+	ctx, cancel := t.Timeouts.list(ctx)
+	defer cancel()
 
-	return token, err
+	filter := bson.M{
+		"userLogin": login,
+		"rotated":   bson.M{"$ne": true},
+		"expiry":    bson.M{"$gt": time.Now()},
+		"$or": []bson.M{
+			{"scope": ScopeRefresh},
+			{"scope": ScopeAuthentication, "family": bson.M{"$exists": false}},
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "lastSeen", Value: -1}})
+	cursor, err := t.DB.Collection("tokens").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, TranslateError(err)
+	}
+	var tokens []Token
+	if err = cursor.All(ctx, &tokens); err != nil {
+		return nil, TranslateError(err)
+	}
+	return tokens, nil
 }
-func (t *TokenModel) GetTokenDocumentByLogin(login string) (Token, error) {
+
+// Extend records that the session of family was used just now and pushes the
+// expiry of its live refresh token out to expiry, which the caller caps at the
+// session's MaxExpiry.
+func (t *TokenModel) Extend(ctx context.Context, login, family string, expiry time.Time) error {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := t.DB.Collection("tokens")
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"userLogin": login, "family": family},
+		bson.M{"$set": bson.M{"lastSeen": time.Now()}},
+	)
+	if err != nil {
+		return TranslateError(err)
+	}
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"userLogin": login, "family": family, "scope": ScopeRefresh, "rotated": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"expiry": expiry}},
+	)
+	return TranslateError(err)
+}
+
+// Rotate marks a live refresh token as used and returns it along with its
+// replacement, which expires after ttl but not after the session does. The
+// update is atomic, so a token can only be rotated once.
+//
+// Browsers send the refresh cookie with every request, so two requests made
+// together both try to rotate it. Within grace of the rotation the token
+// still gets the same replacement. Presenting a token that was rotated longer
+// ago means it has leaked: the whole family is revoked and ErrTokenReused is
+// returned.
+func (t *TokenModel) Rotate(ctx context.Context, tokenPlaintext string, ttl, grace time.Duration) (Token, *Token, error) {
+	ctx, cancel := t.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := t.DB.Collection("tokens")
+	hash := hashToken(tokenPlaintext)
+	next, err := generatePlaintext()
+	if err != nil {
+		return Token{}, nil, err
+	}
+	sealed, err := sealSuccessor(tokenPlaintext, next)
+	if err != nil {
+		return Token{}, nil, err
+	}
+
+	var token Token
+	now := time.Now()
+	filter := bson.M{
+		"hash":    hash,
+		"scope":   ScopeRefresh,
+		"rotated": bson.M{"$ne": true},
+		"expiry":  bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"rotated": true, "rotatedAt": now, "successor": sealed}}
+	err = collection.FindOneAndUpdate(ctx, filter, update).Decode(&token)
+	if err == nil {
+		refresh := successor(token, next, ttl)
+		if err := t.Insert(ctx, refresh); err != nil {
+			return Token{}, nil, err
+		}
+		return token, refresh, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return Token{}, nil, TranslateError(err)
+	}
+
+	err = collection.FindOne(ctx, bson.M{"hash": hash, "scope": ScopeRefresh, "rotated": true}).Decode(&token)
+	if err != nil {
+		return Token{}, nil, TranslateError(err)
+	}
+	if next, ok := openSuccessor(token, tokenPlaintext, grace, now); ok {
+		return token, successor(token, next, ttl), nil
+	}
+	if err := t.DeleteFamily(ctx, token.UserLogin, token.Family); err != nil {
+		return Token{}, nil, err
+	}
+	return Token{}, nil, ErrTokenReused
+}
+
+// GetTokenDocumentByToken looks up a token by the hash of its plaintext. Tokens
+// with a different scope or whose expiry has passed are treated as unknown.
+func (t *TokenModel) GetTokenDocumentByToken(ctx context.Context, scope, tokenPlaintext string) (Token, error) {
+	ctx, cancel := t.Timeouts.read(ctx)
+	defer cancel()
+
 	var token Token
-	err := t.DB.Collection("tokens").FindOne(context.TODO(), bson.M{"userLogin": login}).Decode(&token)
+	filter := bson.M{
+		"hash":    hashToken(tokenPlaintext),
+		"scope":   scope,
+		"rotated": bson.M{"$ne": true},
+		"expiry":  bson.M{"$gt": time.Now()},
+	}
+	err := t.DB.Collection("tokens").FindOne(ctx, filter).Decode(&token)
 	if err != nil {
-		return Token{}, err
+		return Token{}, TranslateError(err)
 	}
 	return token, nil
 }
 
-// import (
-// 	"crypto/rand"
-// 	"crypto/sha256"
-// 	"encoding/base32"
-// 	"time"
-
-// 	"app/internal/validator"
-
-// 	"go.mongodb.org/mongo-driver/mongo"
-// )
-
-// const (
-// 	ScopeActivation     = "activation"
-// 	ScopeAuthentication = "authentication"
-// )
-
-// // Define a Token struct to hold the data for an individual token. This includes the
-// // plaintext and hashed versions of the token, associated user ID, expiry time and scope.
-// type Token struct {
-// 	Plaintext string    `json:"token"`
-// 	Hash      []byte    `json:"-"`
-// 	UserID    int64     `json:"-"`
-// 	Expiry    time.Time `json:"expiry"`
-// 	Scope     string    `json:"-"`
-// }
-
-// func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
-// 	token := &Token{
-// 		UserID: userID,
-// 		Expiry: time.Now().Add(ttl),
-// 		Scope:  scope,
-// 	}
-// 	// Initialize a zero-valued byte slice with a length of 16 bytes.
-// 	randomBytes := make([]byte, 16)
-// 	// Use the Read() function from the crypto/rand package to fill the byte slice with
-// 	// random bytes from your operating system's CSPRNG. This will return an error if
-// 	// the CSPRNG fails to function correctly.
-// 	_, err := rand.Read(randomBytes)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	// Encode the byte slice to a base-32-encoded string and assign it to the token
-// 	// Plaintext field. This will be the token string that we send to the user in their
-// 	// welcome email. They will look similar to this: //
-// 	// Y3QMGX3PJ3WLRL2YRTQGQ6KRHU //
-// 	// Note that by default base-32 strings may be padded at the end with the =
-// 	// character. We don't need this padding character for the purpose of our tokens, so
-// 	// we use the WithPadding(base32.NoPadding) method in the line below to omit them.
-// 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-
-// 	// Generate a SHA-256 hash of the plaintext token string. This will be the value
-// 	// that we store in the `hash` field of our database table. Note that the
-// 	// sha256.Sum256() function returns an *array* of length 32, so to make it easier to
-// 	// work with we convert it to a slice using the [:] operator before storing it.
-// 	hash := sha256.Sum256([]byte(token.Plaintext))
-// 	token.Hash = hash[:]
-// 	return token, nil
-// }
-
-// // Check that the plaintext token has been provided and is exactly 52 bytes long.
-// func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-// 	v.Check(tokenPlaintext != "", "token", "must be provided")
-// 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
-// }
-
-// // Define the TokenModel type.
-// type TokenModel struct {
-// 	DB *mongo.Client
-// }
-
-// // The New() method is a shortcut which creates a new Token struct and then inserts the // data in the tokens table.
-// func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-// 	token, err := generateToken(userID, ttl, scope)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	if err = m.Insert(token); err != nil {
-// 		return nil, err
-// 	}
-// 	return token, err
-// }
-
-// // Insert() adds the data for a specific token to the tokens table.
-// func (m TokenModel) Insert(token *Token) error {
-// 	// TODO:
-// 	// query := `
-// 	// 		INSERT INTO tokens (hash, user_id, expiry, scope)
-// 	// 		VALUES ($1, $2, $3, $4)
-// 	// 	`
-// 	// args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
-// 	// ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-// 	// defer cancel()
-
-// 	// _, err := m.DB.ExecContext(ctx, query, args...)
-// 	// return err
-// 	return nil
-// }
-
-// // DeleteAllForUser() deletes all tokens for a specific user and scope.
-// func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
-// 	// query := `
-// 	// 	DELETE FROM tokens
-// 	// 	WHERE scope = $1 AND user_id = $2
-// 	// `
-// 	// ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-// 	// defer cancel()
-
-// 	// _, err := m.DB.ExecContext(ctx, query, scope, userID)
-// 	// return err
-// 	return nil
-// }
+func (t *TokenModel) GetTokenDocumentByLogin(ctx context.Context, login string) (Token, error) {
+	ctx, cancel := t.Timeouts.read(ctx)
+	defer cancel()
+
+	var token Token
+	err := t.DB.Collection("tokens").FindOne(ctx, bson.M{"userLogin": login}).Decode(&token)
+	if err != nil {
+		return Token{}, TranslateError(err)
+	}
+	return token, nil
+}
@@ -0,0 +1,329 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryTokenModel is the in-memory TokenRepository. Expired tokens are
+// dropped as new ones come in, as the TTL index on the tokens collection would.
+type MemoryTokenModel struct {
+	mu     sync.Mutex
+	tokens []Token
+}
+
+func (t *MemoryTokenModel) New(ctx context.Context, login string, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(login, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (t *MemoryTokenModel) NewForFamily(ctx context.Context, login string, ttl time.Duration, scope string, session Session, parent []byte) (*Token, error) {
+	token, err := generateToken(login, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	session.ID = primitive.NilObjectID
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = time.Now()
+	}
+	if session.LastSeen.IsZero() {
+		session.LastSeen = time.Now()
+	}
+	token.Session = session
+	token.Parent = parent
+	if err = t.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (t *MemoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stored Token
+	clone(token, &stored)
+	if stored.ID.IsZero() {
+		stored.ID = primitive.NewObjectID()
+	}
+	t.sweep(time.Now())
+	t.tokens = append(t.tokens, stored)
+	return nil
+}
+
+// sweep drops expired tokens. It must be called with the mutex held.
+func (t *MemoryTokenModel) sweep(now time.Time) {
+	t.deleteWhere(func(token Token) bool { return !token.Expiry.After(now) })
+}
+
+// deleteWhere deletes the tokens match returns true for. It must be called
+// with the mutex held.
+func (t *MemoryTokenModel) deleteWhere(match func(Token) bool) {
+	kept := t.tokens[:0]
+	for _, token := range t.tokens {
+		if !match(token) {
+			kept = append(kept, token)
+		}
+	}
+	t.tokens = kept
+}
+
+// live reports whether a token can still be used: it hasn't been rotated and
+// hasn't expired.
+func (token Token) live(now time.Time) bool {
+	return !token.Rotated && token.Expiry.After(now)
+}
+
+// inFamily is how Mongo matches {"family": family}: tokens without a family
+// have no family field, so they match no family at all.
+func (token Token) inFamily(family string) bool {
+	return token.Family != "" && token.Family == family
+}
+
+func (t *MemoryTokenModel) DeleteToken(ctx context.Context, tokenPlaintext string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hash := hashToken(tokenPlaintext)
+	for i, token := range t.tokens {
+		if bytes.Equal(token.Hash, hash) {
+			t.tokens = append(t.tokens[:i], t.tokens[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (t *MemoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, login string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deleteWhere(func(token Token) bool { return token.Scope == scope && token.UserLogin == login })
+	return nil
+}
+
+func (t *MemoryTokenModel) DeleteAllByLogin(ctx context.Context, login string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deleteWhere(func(token Token) bool { return token.UserLogin == login })
+	return nil
+}
+
+func (t *MemoryTokenModel) RenameUser(ctx context.Context, oldLogin, newLogin string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.tokens {
+		if t.tokens[i].UserLogin == oldLogin {
+			t.tokens[i].UserLogin = newLogin
+		}
+	}
+	return nil
+}
+
+func (t *MemoryTokenModel) DeleteFamily(ctx context.Context, login, family string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deleteFamily(login, family)
+	return nil
+}
+
+func (t *MemoryTokenModel) deleteFamily(login, family string) {
+	t.deleteWhere(func(token Token) bool { return token.UserLogin == login && token.inFamily(family) })
+}
+
+func (t *MemoryTokenModel) DeleteSessionsByLogin(ctx context.Context, login string, keepFamily string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deleteWhere(func(token Token) bool {
+		return token.UserLogin == login &&
+			(token.Scope == ScopeAuthentication || token.Scope == ScopeRefresh) &&
+			(keepFamily == "" || token.Family != keepFamily)
+	})
+	return nil
+}
+
+func (t *MemoryTokenModel) DeleteSession(ctx context.Context, login string, id primitive.ObjectID) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, token := range t.tokens {
+		if token.ID != id || token.UserLogin != login {
+			continue
+		}
+		if token.Family == "" {
+			t.tokens = append(t.tokens[:i], t.tokens[i+1:]...)
+		} else {
+			t.deleteFamily(login, token.Family)
+		}
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (t *MemoryTokenModel) GetSessions(ctx context.Context, login string) ([]Token, error) {
+	if err := done(ctx); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var tokens []Token
+	for _, stored := range t.tokens {
+		if stored.UserLogin != login || !stored.live(now) {
+			continue
+		}
+		if stored.Scope == ScopeRefresh || (stored.Scope == ScopeAuthentication && stored.Family == "") {
+			var token Token
+			clone(stored, &token)
+			tokens = append(tokens, token)
+		}
+	}
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].LastSeen.After(tokens[j].LastSeen) })
+	return tokens, nil
+}
+
+func (t *MemoryTokenModel) Extend(ctx context.Context, login, family string, expiry time.Time) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for i, token := range t.tokens {
+		if token.UserLogin != login || !token.inFamily(family) {
+			continue
+		}
+		t.tokens[i].LastSeen = now
+		if token.Scope == ScopeRefresh && !token.Rotated {
+			t.tokens[i].Expiry = expiry
+		}
+	}
+	return nil
+}
+
+func (t *MemoryTokenModel) Rotate(ctx context.Context, tokenPlaintext string, ttl, grace time.Duration) (Token, *Token, error) {
+	if err := done(ctx); err != nil {
+		return Token{}, nil, err
+	}
+	next, err := generatePlaintext()
+	if err != nil {
+		return Token{}, nil, err
+	}
+	sealed, err := sealSuccessor(tokenPlaintext, next)
+	if err != nil {
+		return Token{}, nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hash := hashToken(tokenPlaintext)
+	now := time.Now()
+	for i, stored := range t.tokens {
+		if !bytes.Equal(stored.Hash, hash) || stored.Scope != ScopeRefresh || !stored.live(now) {
+			continue
+		}
+		// Like FindOneAndUpdate, this returns the token as it was before.
+		var token Token
+		clone(stored, &token)
+		t.tokens[i].Rotated = true
+		t.tokens[i].RotatedAt = now
+		t.tokens[i].Successor = sealed
+
+		refresh := successor(token, next, ttl)
+		var inserted Token
+		clone(refresh, &inserted)
+		inserted.ID = primitive.NewObjectID()
+		t.tokens = append(t.tokens, inserted)
+		return token, refresh, nil
+	}
+
+	for _, stored := range t.tokens {
+		if bytes.Equal(stored.Hash, hash) && stored.Scope == ScopeRefresh && stored.Rotated {
+			if next, ok := openSuccessor(stored, tokenPlaintext, grace, now); ok {
+				var token Token
+				clone(stored, &token)
+				return token, successor(token, next, ttl), nil
+			}
+			t.deleteFamily(stored.UserLogin, stored.Family)
+			return Token{}, nil, ErrTokenReused
+		}
+	}
+	return Token{}, nil, ErrNotFound
+}
+
+func (t *MemoryTokenModel) GetTokenDocumentByToken(ctx context.Context, scope, tokenPlaintext string) (Token, error) {
+	if err := done(ctx); err != nil {
+		return Token{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hash := hashToken(tokenPlaintext)
+	now := time.Now()
+	for _, stored := range t.tokens {
+		if bytes.Equal(stored.Hash, hash) && stored.Scope == scope && stored.live(now) {
+			var token Token
+			clone(stored, &token)
+			return token, nil
+		}
+	}
+	return Token{}, ErrNotFound
+}
+
+func (t *MemoryTokenModel) GetTokenDocumentByLogin(ctx context.Context, login string) (Token, error) {
+	if err := done(ctx); err != nil {
+		return Token{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, stored := range t.tokens {
+		if stored.UserLogin == login {
+			var token Token
+			clone(stored, &token)
+			return token, nil
+		}
+	}
+	return Token{}, ErrNotFound
+}
@@ -2,15 +2,18 @@ package data
 
 import (
 	"context"
+	"regexp"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type UserModel struct {
-	DB *mongo.Database
+	DB       *mongo.Database
+	Timeouts Timeouts
 }
 
 type User struct {
@@ -20,42 +23,310 @@ type User struct {
 	Name       string             `json:"name"`
 	Password   string             `json:"password"`
 	CreateDate string             `json:"create_date"`
+	Activated  bool               `bson:"activated" json:"activated"`
+	Role       string             `bson:"role" json:"role"`
+	// The TOTP secret and the unused recovery codes are stored encrypted. The
+	// secret is kept while enrollment is pending, before TOTPEnabled is set.
+	TOTPSecret    string   `bson:"totpSecret,omitempty" json:"-"`
+	TOTPEnabled   bool     `bson:"totpEnabled" json:"totp_enabled"`
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty" json:"-"`
+	// LastTOTPStep is the time step of the last TOTP code accepted, so that a
+	// code can't be used twice (RFC 6238, section 5.2).
+	LastTOTPStep int64 `bson:"lastTotpStep,omitempty" json:"-"`
+	// Identities are the accounts at OpenID providers the user can log in with.
+	Identities []Identity `bson:"identities,omitempty" json:"identities,omitempty"`
 }
 
-func (u *UserModel) Insert(user User) error {
+// Identity links a user to their account at an OpenID provider, which is
+// identified by the provider's subject id rather than by email, since emails
+// can change.
+type Identity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"-"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedAt time.Time `bson:"linkedAt" json:"linked_at"`
+}
+
+func (u *UserModel) Insert(ctx context.Context, user User) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
 	user.CreateDate = humanDate(time.Now().Add(time.Hour * 6))
 
-	_, err := u.DB.Collection("users").InsertOne(context.TODO(), user)
+	_, err := u.DB.Collection("users").InsertOne(ctx, user)
+
+	return TranslateError(err)
+}
+
+func (u *UserModel) GetByLogin(ctx context.Context, login string) (User, error) {
+	ctx, cancel := u.Timeouts.read(ctx)
+	defer cancel()
 
-	return err
+	var user User
+	err := u.DB.Collection("users").FindOne(ctx, bson.M{"login": login}).Decode(&user)
+	return user, TranslateError(err)
+}
+
+func (u *UserModel) GetByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := u.Timeouts.read(ctx)
+	defer cancel()
+
+	var user User
+	err := u.DB.Collection("users").FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	return user, TranslateError(err)
 }
 
-func (u *UserModel) GetByLogin(login string) (User, error) {
+// GetByIdentity returns the user linked to the given account at an OpenID
+// provider.
+func (u *UserModel) GetByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	ctx, cancel := u.Timeouts.read(ctx)
+	defer cancel()
+
 	var user User
-	err := u.DB.Collection("users").FindOne(context.TODO(), bson.M{"login": login}).Decode(&user)
-	return user, err
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+	err := u.DB.Collection("users").FindOne(ctx, filter).Decode(&user)
+	return user, TranslateError(err)
 }
 
-func (u *UserModel) GetAllUsers() ([]User, error) {
-	cursor, err := u.DB.Collection("users").Find(context.Background(), bson.D{})
+// AddIdentity links an account at an OpenID provider to a user.
+func (u *UserModel) AddIdentity(ctx context.Context, login string, identity Identity) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := u.DB.Collection("users")
+	res, err := collection.UpdateOne(ctx, bson.M{"login": login}, bson.M{"$push": bson.M{"identities": identity}})
 	if err != nil {
-		return []User{}, err
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdatePassword replaces the password hash of a user.
+func (u *UserModel) UpdatePassword(ctx context.Context, login string, passwordHash string) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := u.DB.Collection("users")
+	res, err := collection.UpdateOne(ctx, bson.M{"login": login}, bson.M{"$set": bson.M{"password": passwordHash}})
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateRole changes the role of a user.
+func (u *UserModel) UpdateRole(ctx context.Context, login string, role string) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := u.DB.Collection("users")
+	res, err := collection.UpdateOne(ctx, bson.M{"login": login}, bson.M{"$set": bson.M{"role": role}})
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateTwoFactor stores the encrypted TOTP secret and recovery codes of a
+// user. An empty secret with enabled set to false turns two-factor off.
+func (u *UserModel) UpdateTwoFactor(ctx context.Context, login string, secret string, enabled bool, recoveryCodes []string) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := u.DB.Collection("users")
+	update := bson.M{"$set": bson.M{
+		"totpSecret":    secret,
+		"totpEnabled":   enabled,
+		"recoveryCodes": recoveryCodes,
+	}}
+	res, err := collection.UpdateOne(ctx, bson.M{"login": login}, update)
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UseTOTPStep records that the user has used the TOTP code of time step step.
+// It fails with ErrNotFound if the user doesn't exist or has already used a
+// code of that step or a later one.
+func (u *UserModel) UseTOTPStep(ctx context.Context, login string, step int64) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	// The check and the update are one operation, so of two requests racing
+	// with the same code only one gets in.
+	filter := bson.M{"login": login, "lastTotpStep": bson.M{"$not": bson.M{"$gte": step}}}
+	update := bson.M{"$set": bson.M{"lastTotpStep": step}}
+	res, err := u.DB.Collection("users").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UseRecoveryCode removes one of the user's encrypted recovery codes. It fails
+// with ErrNotFound if the user doesn't have that code (any more).
+func (u *UserModel) UseRecoveryCode(ctx context.Context, login string, code string) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	filter := bson.M{"login": login, "recoveryCodes": code}
+	update := bson.M{"$pull": bson.M{"recoveryCodes": code}}
+	res, err := u.DB.Collection("users").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (u *UserModel) GetAllUsers(ctx context.Context) ([]User, error) {
+	ctx, cancel := u.Timeouts.list(ctx)
+	defer cancel()
+
+	cursor, err := u.DB.Collection("users").Find(ctx, bson.D{})
+	if err != nil {
+		return []User{}, TranslateError(err)
 	}
 	var users []User
-	if err = cursor.All(context.TODO(), &users); err != nil {
-		return []User{}, err
+	if err = cursor.All(ctx, &users); err != nil {
+		return []User{}, TranslateError(err)
 	}
 	return users, nil
 }
 
-func (u *UserModel) DeleteUserByLogin(login string) error {
+// Search returns a page of the users whose login, email or name contains
+// query, ignoring case, ordered by login. An empty query matches everyone.
+func (u *UserModel) Search(ctx context.Context, query string, filters Filters) ([]User, Metadata, error) {
+	ctx, cancel := u.Timeouts.list(ctx)
+	defer cancel()
+
+	collection := u.DB.Collection("users")
+
+	filter := bson.M{}
+	if query != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(query), Options: "i"}
+		filter["$or"] = []bson.M{
+			{"login": pattern},
+			{"email": pattern},
+			{"name": pattern},
+		}
+	}
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, Metadata{}, TranslateError(err)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "login", Value: 1}}).
+		SetSkip(filters.offset()).
+		SetLimit(filters.limit())
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, Metadata{}, TranslateError(err)
+	}
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, Metadata{}, TranslateError(err)
+	}
+	return users, calculateMetadata(total, filters.Page, filters.PageSize), nil
+}
+
+func (u *UserModel) DeleteUserByLogin(ctx context.Context, login string) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
 	collection := u.DB.Collection("users")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"login": login})
-	return err
+	_, err := collection.DeleteOne(ctx, bson.M{"login": login})
+	return TranslateError(err)
 }
 
-func (u *UserModel) UpdateUserByLogin(login string, newUser User) error {
+// UpdateUserByLogin changes the login, email, name, password hash and role of
+// a user to those of newUser. Empty fields of newUser leave the stored values
+// as they are, so callers only fill in what changes. The other fields have
+// their own update methods.
+func (u *UserModel) UpdateUserByLogin(ctx context.Context, login string, newUser User) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	set := bson.M{}
+	for field, value := range map[string]string{
+		"login":    newUser.Login,
+		"email":    newUser.Email,
+		"name":     newUser.Name,
+		"password": newUser.Password,
+		"role":     newUser.Role,
+	} {
+		if value != "" {
+			set[field] = value
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+
 	collection := u.DB.Collection("users")
-	res := collection.FindOneAndUpdate(context.TODO(), bson.M{"login": login}, bson.M{"$set": newUser})
-	return res.Err()
+	res, err := collection.UpdateOne(ctx, bson.M{"login": login}, bson.M{"$set": set})
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetActivated activates or deactivates a user's account.
+func (u *UserModel) SetActivated(ctx context.Context, login string, activated bool) error {
+	ctx, cancel := u.Timeouts.write(ctx)
+	defer cancel()
+
+	collection := u.DB.Collection("users")
+	res, err := collection.UpdateOne(ctx, bson.M{"login": login}, bson.M{"$set": bson.M{"activated": activated}})
+	if err != nil {
+		return TranslateError(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Indexes returns the unique indexes of the users collection, which
+// MemoryUserModel mirrors: logins and emails are unique, and an account at a
+// provider can only be linked to one user.
+func (u *UserModel) Indexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "login", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+		},
+	}
 }
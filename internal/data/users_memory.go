@@ -0,0 +1,301 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryUserModel is the in-memory UserRepository. Like the users collection,
+// it has unique logins, emails and provider identities.
+type MemoryUserModel struct {
+	mu    sync.Mutex
+	users []User
+}
+
+func (u *MemoryUserModel) Insert(ctx context.Context, user User) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	user.CreateDate = humanDate(time.Now().Add(time.Hour * 6))
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	if err := u.checkUnique(user, -1); err != nil {
+		return err
+	}
+	var stored User
+	clone(user, &stored)
+	u.users = append(u.users, stored)
+	return nil
+}
+
+// checkUnique returns the *ErrDuplicate the users collection would for storing
+// user at index i, or -1 for a new user.
+func (u *MemoryUserModel) checkUnique(user User, i int) error {
+	for j, other := range u.users {
+		if j == i {
+			continue
+		}
+		if other.Login == user.Login {
+			return &ErrDuplicate{Field: "login"}
+		}
+		if other.Email == user.Email {
+			return &ErrDuplicate{Field: "email"}
+		}
+		for _, identity := range user.Identities {
+			if _, ok := other.identity(identity.Provider, identity.Subject); ok {
+				return &ErrDuplicate{Field: "identities"}
+			}
+		}
+	}
+	return nil
+}
+
+func (user User) identity(provider, subject string) (Identity, bool) {
+	for _, identity := range user.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+// find returns the index of the user with the login, or -1.
+func (u *MemoryUserModel) find(login string) int {
+	for i, user := range u.users {
+		if user.Login == login {
+			return i
+		}
+	}
+	return -1
+}
+
+func (u *MemoryUserModel) get(match func(User) bool) (User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, stored := range u.users {
+		if match(stored) {
+			var user User
+			clone(stored, &user)
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+// update applies change to the user with the login and stores the result if
+// it doesn't break a unique index.
+func (u *MemoryUserModel) update(login string, change func(*User)) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	i := u.find(login)
+	if i < 0 {
+		return ErrNotFound
+	}
+	var user User
+	clone(u.users[i], &user)
+	change(&user)
+	if err := u.checkUnique(user, i); err != nil {
+		return err
+	}
+	var stored User
+	clone(user, &stored)
+	u.users[i] = stored
+	return nil
+}
+
+func (u *MemoryUserModel) GetByLogin(ctx context.Context, login string) (User, error) {
+	if err := done(ctx); err != nil {
+		return User{}, err
+	}
+	return u.get(func(user User) bool { return user.Login == login })
+}
+
+func (u *MemoryUserModel) GetByEmail(ctx context.Context, email string) (User, error) {
+	if err := done(ctx); err != nil {
+		return User{}, err
+	}
+	return u.get(func(user User) bool { return user.Email == email })
+}
+
+func (u *MemoryUserModel) GetByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	if err := done(ctx); err != nil {
+		return User{}, err
+	}
+	return u.get(func(user User) bool {
+		_, ok := user.identity(provider, subject)
+		return ok
+	})
+}
+
+func (u *MemoryUserModel) AddIdentity(ctx context.Context, login string, identity Identity) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	return u.update(login, func(user *User) {
+		user.Identities = append(user.Identities, identity)
+	})
+}
+
+func (u *MemoryUserModel) UpdatePassword(ctx context.Context, login string, passwordHash string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	return u.update(login, func(user *User) {
+		user.Password = passwordHash
+	})
+}
+
+func (u *MemoryUserModel) UpdateRole(ctx context.Context, login string, role string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	return u.update(login, func(user *User) {
+		user.Role = role
+	})
+}
+
+func (u *MemoryUserModel) UpdateTwoFactor(ctx context.Context, login string, secret string, enabled bool, recoveryCodes []string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	return u.update(login, func(user *User) {
+		user.TOTPSecret = secret
+		user.TOTPEnabled = enabled
+		user.RecoveryCodes = recoveryCodes
+	})
+}
+
+func (u *MemoryUserModel) UseTOTPStep(ctx context.Context, login string, step int64) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	i := u.find(login)
+	if i < 0 || u.users[i].LastTOTPStep >= step {
+		return ErrNotFound
+	}
+	u.users[i].LastTOTPStep = step
+	return nil
+}
+
+func (u *MemoryUserModel) UseRecoveryCode(ctx context.Context, login string, code string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	i := u.find(login)
+	if i < 0 {
+		return ErrNotFound
+	}
+	codes := u.users[i].RecoveryCodes
+	for j, c := range codes {
+		if c == code {
+			u.users[i].RecoveryCodes = append(append([]string{}, codes[:j]...), codes[j+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (u *MemoryUserModel) SetActivated(ctx context.Context, login string, activated bool) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	return u.update(login, func(user *User) {
+		user.Activated = activated
+	})
+}
+
+func (u *MemoryUserModel) UpdateUserByLogin(ctx context.Context, login string, newUser User) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	if newUser.Login == "" && newUser.Email == "" && newUser.Name == "" && newUser.Password == "" && newUser.Role == "" {
+		return nil
+	}
+	return u.update(login, func(user *User) {
+		if newUser.Login != "" {
+			user.Login = newUser.Login
+		}
+		if newUser.Email != "" {
+			user.Email = newUser.Email
+		}
+		if newUser.Name != "" {
+			user.Name = newUser.Name
+		}
+		if newUser.Password != "" {
+			user.Password = newUser.Password
+		}
+		if newUser.Role != "" {
+			user.Role = newUser.Role
+		}
+	})
+}
+
+func (u *MemoryUserModel) GetAllUsers(ctx context.Context) ([]User, error) {
+	if err := done(ctx); err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	users := make([]User, len(u.users))
+	for i, stored := range u.users {
+		clone(stored, &users[i])
+	}
+	return users, nil
+}
+
+func (u *MemoryUserModel) Search(ctx context.Context, query string, filters Filters) ([]User, Metadata, error) {
+	if err := done(ctx); err != nil {
+		return nil, Metadata{}, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	query = strings.ToLower(query)
+	var matches []User
+	for _, stored := range u.users {
+		if strings.Contains(strings.ToLower(stored.Login), query) ||
+			strings.Contains(strings.ToLower(stored.Email), query) ||
+			strings.Contains(strings.ToLower(stored.Name), query) {
+			var user User
+			clone(stored, &user)
+			matches = append(matches, user)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Login < matches[j].Login })
+
+	start, end := page(len(matches), filters)
+	return matches[start:end], calculateMetadata(int64(len(matches)), filters.Page, filters.PageSize), nil
+}
+
+func (u *MemoryUserModel) DeleteUserByLogin(ctx context.Context, login string) error {
+	if err := done(ctx); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if i := u.find(login); i >= 0 {
+		u.users = append(u.users[:i], u.users[i+1:]...)
+	}
+	return nil
+}
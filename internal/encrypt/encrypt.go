@@ -0,0 +1,69 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+var ErrInvalidCiphertext = errors.New("encrypt: invalid ciphertext")
+
+// Cipher encrypts and authenticates small secrets, such as TOTP secrets, with
+// AES-256-GCM before they are stored.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// New returns a Cipher for a 32 byte key.
+func New(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, errors.New("encrypt: key must be 32 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns the base64url encoded nonce and ciphertext of plaintext.
+func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt, failing if the ciphertext was tampered with.
+func (c *Cipher) Decrypt(ciphertext string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrInvalidCiphertext
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+func (c *Cipher) EncryptString(plaintext string) (string, error) {
+	return c.Encrypt([]byte(plaintext))
+}
+
+func (c *Cipher) DecryptString(ciphertext string) (string, error) {
+	plaintext, err := c.Decrypt(ciphertext)
+	return string(plaintext), err
+}
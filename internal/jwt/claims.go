@@ -0,0 +1,124 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrExpired         = errors.New("jwt: token is expired")
+	ErrNotValidYet     = errors.New("jwt: token is not valid yet")
+	ErrIssuedInFuture  = errors.New("jwt: token is issued in the future")
+	ErrInvalidAudience = errors.New("jwt: invalid audience")
+	ErrInvalidIssuer   = errors.New("jwt: invalid issuer")
+)
+
+// Claims holds the registered claims from RFC 7519. Times are NumericDate
+// values, i.e. seconds since the Unix epoch; zero means the claim is absent.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Audience is the "aud" claim, which may be either a single string or an array
+// of strings on the wire.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// Contains reports whether aud is one of the audiences.
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Options controls how a token is validated.
+type Options struct {
+	// Algorithms lists the accepted "alg" header values. When empty every HMAC
+	// algorithm is accepted by ValidateToken, and the algorithm of the key named
+	// by "kid" by KeySet.Verify.
+	Algorithms []string
+	// Issuer and Audience, when set, must match the "iss" claim and be one of
+	// the "aud" claim values respectively.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat.
+	Leeway time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// allows reports whether alg is accepted, falling back to defaults when no
+// Algorithms were configured.
+func (o Options) allows(alg string, defaults ...string) bool {
+	accepted := o.Algorithms
+	if len(accepted) == 0 {
+		accepted = defaults
+	}
+	for _, a := range accepted {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Options) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
+// Valid checks the time based claims against the current time, allowing for
+// opts.Leeway of clock skew, and the issuer and audience against opts.
+func (c *Claims) Valid(opts Options) error {
+	now := opts.now()
+	leeway := opts.Leeway
+
+	if c.ExpiresAt != 0 && !now.Before(time.Unix(c.ExpiresAt, 0).Add(leeway)) {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return ErrNotValidYet
+	}
+	if c.IssuedAt != 0 && now.Add(leeway).Before(time.Unix(c.IssuedAt, 0)) {
+		return ErrIssuedInFuture
+	}
+	if opts.Issuer != "" && c.Issuer != opts.Issuer {
+		return ErrInvalidIssuer
+	}
+	if opts.Audience != "" && !c.Audience.Contains(opts.Audience) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
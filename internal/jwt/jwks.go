@@ -0,0 +1,116 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// PublicKey returns the public key the JWK describes. Only the key types this
+// package can verify are supported: RSA and Ed25519.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, ErrInvalidKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, ErrInvalidKey
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidKey
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, ErrInvalidKey
+	}
+}
+
+// algorithm returns the signing algorithm a JWK is meant for, which is its
+// "alg" member when present and otherwise follows from the key type.
+func (k JWK) algorithm() string {
+	if k.Alg != "" {
+		return k.Alg
+	}
+	switch k.Kty {
+	case "RSA":
+		return RS256
+	case "OKP":
+		return EdDSA
+	default:
+		return ""
+	}
+}
+
+// Verify checks a token signed by someone else, such as an OpenID provider,
+// against the public keys they publish. The key is picked by the token's "kid"
+// header, or is the only signing key of the set when the token has none. The
+// claims are then validated according to opts.
+func (s JWKS) Verify(token string, opts Options) (*Claims, error) {
+	header, claims, signingInput, signature, err := decode(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := s.lookup(header.Kid)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	alg := key.algorithm()
+	if header.Alg != alg || !opts.allows(header.Alg, RS256, EdDSA) {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(header.Alg, pub, signingInput, signature); err != nil {
+		return nil, err
+	}
+	if err := claims.Valid(opts); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (s JWKS) lookup(kid string) (JWK, bool) {
+	var signing []JWK
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if kid != "" && k.Kid == kid {
+			return k, true
+		}
+		signing = append(signing, k)
+	}
+	if kid == "" && len(signing) == 1 {
+		return signing[0], true
+	}
+	return JWK{}, false
+}
+
+// DecodeClaims decodes the claims segment of a token into dst, for reading the
+// claims beyond the registered ones. It doesn't check the signature, so it must
+// only be called on a token that has already been verified.
+func DecodeClaims(token string, dst interface{}) error {
+	parts := splitToken(token)
+	if parts == nil {
+		return ErrMalformed
+	}
+	return decodeSegment(parts[1], dst)
+}
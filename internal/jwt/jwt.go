@@ -1,77 +1,217 @@
 package jwt
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"hash"
 	"strings"
 )
 
-// Function for generating the tokens.
-func GenerateToken(header string, payload map[string]string, secret string) (string, error) {
-	// create a new hash of type sha256. We pass the secret key to it
-	// sha256 is a symmetric cryptographic algorithm
-	h := hmac.New(sha256.New, []byte(secret))
-
-	// We base encode the header which is a normal string
-	header64 := base64.StdEncoding.EncodeToString([]byte(header))
-	// We then Marshal the payload which is a map. This converts it to a string of JSON.
-	// Now we base encode this string
-	payloadstr, err := json.Marshal(payload)
+// Supported signing algorithms, named as in RFC 7518.
+const (
+	HS256 = "HS256"
+	HS384 = "HS384"
+	HS512 = "HS512"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrMalformed            = errors.New("jwt: malformed token")
+	ErrUnsupportedAlgorithm = errors.New("jwt: unsupported signing algorithm")
+	ErrInvalidSignature     = errors.New("jwt: invalid signature")
+	ErrInvalidKey           = errors.New("jwt: key does not match signing algorithm")
+)
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// GenerateToken encodes the claims as a compact JWS signed with the given
+// HMAC algorithm and secret.
+func GenerateToken(alg string, claims Claims, secret []byte) (string, error) {
+	return encode(Header{Alg: alg, Typ: "JWT"}, claims, secret)
+}
+
+// ValidateToken checks the signature of a token produced by GenerateToken (or by
+// any other RFC 7519 implementation using the same secret) and then validates
+// its registered claims according to opts.
+func ValidateToken(token string, secret []byte, opts Options) (*Claims, error) {
+	header, claims, signingInput, signature, err := decode(token)
 	if err != nil {
-		fmt.Println("Error generating Token")
-		return string(payloadstr), err
+		return nil, err
+	}
+	if !opts.allows(header.Alg, HS256, HS384, HS512) {
+		return nil, ErrUnsupportedAlgorithm
 	}
-	payload64 := base64.StdEncoding.EncodeToString(payloadstr)
+	if err := verify(header.Alg, secret, signingInput, signature); err != nil {
+		return nil, err
+	}
+	if err := claims.Valid(opts); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
 
-	// Now add the encoded string.
-	message := header64 + "." + payload64
+func encode(header Header, claims Claims, key interface{}) (string, error) {
+	headerSegment, err := encodeSegment(header)
+	if err != nil {
+		return "", err
+	}
+	claimsSegment, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
 
-	// We have the unsigned message ready. This is simply concat of header and payload
-	unsignedStr := header + string(payloadstr)
+	// The signature is computed over the encoded segments, not the raw JSON.
+	signingInput := headerSegment + "." + claimsSegment
+	signature, err := sign(header.Alg, key, signingInput)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
 
-	// we write this to the SHA256 to hash it. We can use this to generate the signature now
-	h.Write([]byte(unsignedStr))
-	signature := base64.StdEncoding.EncodeToString(h.Sum(nil))
+// decode splits a compact token into its parts without checking the signature.
+func decode(token string) (*Header, *Claims, string, []byte, error) {
+	parts := splitToken(token)
+	if parts == nil {
+		return nil, nil, "", nil, ErrMalformed
+	}
 
-	//Finally we have the token
-	tokenStr := message + "." + signature
-	return tokenStr, nil
+	var header Header
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, "", nil, err
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, "", nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, "", nil, ErrMalformed
+	}
+	return &header, &claims, parts[0] + "." + parts[1], signature, nil
 }
 
-// This helps in validating the token
-func ValidateToken(token string, secret string) (bool, error) {
-	// JWT has 3 parts separated by '.'
-	splitToken := strings.Split(token, ".")
-	// if length is not 3, we know that the token is corrupt
-	if len(splitToken) != 3 {
-		return false, nil
+// splitToken returns the three segments of a compact token, or nil.
+func splitToken(token string) []string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
 	}
+	return parts
+}
 
-	// decode the header and payload back to strings
-	header, err := base64.StdEncoding.DecodeString(splitToken[0])
+func encodeSegment(v interface{}) (string, error) {
+	js, err := json.Marshal(v)
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	payload, err := base64.StdEncoding.DecodeString(splitToken[1])
+	return base64.RawURLEncoding.EncodeToString(js), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	js, err := base64.RawURLEncoding.DecodeString(segment)
 	if err != nil {
-		return false, err
+		return ErrMalformed
 	}
+	if err := json.Unmarshal(js, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
 
-	//again create the signature
-	unsignedStr := string(header) + string(payload)
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(unsignedStr))
+func hashFor(alg string) (func() hash.Hash, bool) {
+	switch alg {
+	case HS256:
+		return sha256.New, true
+	case HS384:
+		return sha512.New384, true
+	case HS512:
+		return sha512.New, true
+	default:
+		return nil, false
+	}
+}
 
-	signature := base64.StdEncoding.EncodeToString(h.Sum(nil))
-	// fmt.Println(signature)
+// sign signs the input with key, which is a []byte secret for the HMAC
+// algorithms, an *rsa.PrivateKey for RS256 and an ed25519.PrivateKey for EdDSA.
+func sign(alg string, key interface{}, signingInput string) ([]byte, error) {
+	switch alg {
+	case HS256, HS384, HS512:
+		secret, ok := key.([]byte)
+		if !ok {
+			return nil, ErrInvalidKey
+		}
+		newHash, _ := hashFor(alg)
+		h := hmac.New(newHash, secret)
+		h.Write([]byte(signingInput))
+		return h.Sum(nil), nil
+	case RS256:
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, ErrInvalidKey
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	case EdDSA:
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, ErrInvalidKey
+		}
+		return ed25519.Sign(priv, []byte(signingInput)), nil
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+}
 
-	// if both the signature dont match, this means token is wrong
-	if signature != splitToken[2] {
-		return false, nil
+// verify checks the signature with key, which is the HMAC secret or the public
+// half of the signing key.
+func verify(alg string, key interface{}, signingInput string, signature []byte) error {
+	switch alg {
+	case HS256, HS384, HS512:
+		expected, err := sign(alg, key, signingInput)
+		if err != nil {
+			return err
+		}
+		// hmac.Equal compares in constant time so the signature can't be guessed
+		// byte by byte from response timings.
+		if !hmac.Equal(expected, signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case RS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidKey
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case EdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrInvalidKey
+		}
+		if !ed25519.Verify(pub, []byte(signingInput), signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		return ErrUnsupportedAlgorithm
 	}
-	// This means the token matches
-	return true, nil
 }
@@ -0,0 +1,121 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestValidateToken(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	opts := Options{Issuer: "https://example.com", Audience: "api", Now: func() time.Time { return now }}
+	valid := Claims{
+		Issuer:    "https://example.com",
+		Subject:   "alice",
+		Audience:  Audience{"api"},
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Claims)
+		opts   Options
+		want   error
+	}{
+		{"valid", func(c *Claims) {}, opts, nil},
+		{"expired", func(c *Claims) { c.ExpiresAt = now.Unix() }, opts, ErrExpired},
+		{"expired within leeway", func(c *Claims) { c.ExpiresAt = now.Add(-time.Second).Unix() }, Options{Leeway: time.Minute, Now: opts.Now}, nil},
+		{"not valid yet", func(c *Claims) { c.NotBefore = now.Add(time.Minute).Unix() }, opts, ErrNotValidYet},
+		{"issued in the future", func(c *Claims) { c.IssuedAt = now.Add(time.Minute).Unix() }, opts, ErrIssuedInFuture},
+		{"wrong issuer", func(c *Claims) { c.Issuer = "https://evil.example.com" }, opts, ErrInvalidIssuer},
+		{"wrong audience", func(c *Claims) { c.Audience = Audience{"other"} }, opts, ErrInvalidAudience},
+		{"one of several audiences", func(c *Claims) { c.Audience = Audience{"other", "api"} }, opts, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid
+			tt.modify(&claims)
+			token, err := GenerateToken(HS256, claims, testSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ValidateToken(token, testSecret, tt.opts)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v; want %v", err, tt.want)
+			}
+			if err == nil && got.Subject != "alice" {
+				t.Errorf("got subject %q; want %q", got.Subject, "alice")
+			}
+		})
+	}
+}
+
+func TestValidateTokenSignature(t *testing.T) {
+	token, err := GenerateToken(HS256, Claims{Subject: "alice"}, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ValidateToken(token, []byte("another secret"), Options{}); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("wrong secret: got error %v; want %v", err, ErrInvalidSignature)
+	}
+
+	// Swapping the claims for others keeps the old signature.
+	parts := strings.Split(token, ".")
+	forged, _ := encodeSegment(Claims{Subject: "admin"})
+	tampered := parts[0] + "." + forged + "." + parts[2]
+	if _, err := ValidateToken(tampered, testSecret, Options{}); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered claims: got error %v; want %v", err, ErrInvalidSignature)
+	}
+
+	if _, err := ValidateToken(token, testSecret, Options{Algorithms: []string{HS512}}); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("algorithm not allowed: got error %v; want %v", err, ErrUnsupportedAlgorithm)
+	}
+
+	if _, err := ValidateToken("not.a-token", testSecret, Options{}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("malformed: got error %v; want %v", err, ErrMalformed)
+	}
+}
+
+func TestValidateTokenRejectsNone(t *testing.T) {
+	header, _ := encodeSegment(Header{Alg: "none", Typ: "JWT"})
+	claims, _ := encodeSegment(Claims{Subject: "admin"})
+
+	_, err := ValidateToken(header+"."+claims+".", testSecret, Options{})
+	if !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("got error %v; want %v", err, ErrUnsupportedAlgorithm)
+	}
+}
+
+func TestAudienceJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want Audience
+	}{
+		{`"api"`, Audience{"api"}},
+		{`["api","web"]`, Audience{"api", "web"}},
+	}
+
+	for _, tt := range tests {
+		var got Audience
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v; want %v", tt.json, got, tt.want)
+		}
+		js, err := json.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(js) != tt.json {
+			t.Errorf("got %s back; want %s", js, tt.json)
+		}
+	}
+}
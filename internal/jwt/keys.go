@@ -0,0 +1,370 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownKey = errors.New("jwt: unknown key id")
+	ErrNoKeys     = errors.New("jwt: no private keys found")
+	// ErrNextKeyPending is returned by Rotate when the next key hasn't been in
+	// the published key set for long enough for verifiers to have fetched it.
+	ErrNextKeyPending = errors.New("jwt: next signing key hasn't been published long enough")
+)
+
+// Key is an asymmetric signing key tagged with a key id ("kid") so verifiers
+// can tell which key of a set signed a token.
+type Key struct {
+	ID        string
+	Algorithm string
+	CreatedAt time.Time
+	// RetiredAt is set once a newer key has taken over signing. A retired key is
+	// still accepted for verification until it is pruned from the set.
+	RetiredAt time.Time
+
+	private crypto.Signer
+}
+
+// Public returns the public half of the key.
+func (k *Key) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// newKey wraps a private key. Its algorithm follows from the key type and its
+// id is the RFC 7638 thumbprint of the public key, so the same key gets the
+// same id on every instance and across restarts.
+func newKey(private crypto.Signer) (*Key, error) {
+	var alg string
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		alg = RS256
+	case ed25519.PrivateKey:
+		alg = EdDSA
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	key := &Key{Algorithm: alg, CreatedAt: time.Now(), private: private}
+	kid, err := key.jwk().thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = kid
+	return key, nil
+}
+
+func generateKey(alg string) (*Key, error) {
+	switch alg {
+	case RS256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(priv)
+	case EdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(priv)
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+}
+
+// ParsePrivateKeys decodes every private key in PEM data, in order. Keys may be
+// PKCS #8 ("PRIVATE KEY") or, for RSA, PKCS #1 ("RSA PRIVATE KEY") blocks, as
+// written by openssl genpkey and openssl genrsa; other blocks are skipped.
+func ParsePrivateKeys(data []byte) ([]*Key, error) {
+	var keys []*Key
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var private interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		key, err := newKey(signer)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return keys, nil
+}
+
+// KeySet holds the current signing key, the retired keys that are still valid
+// for verification and the key that will sign next. It is safe for concurrent
+// use.
+//
+// Verifiers cache the published set, so a key must be published before it
+// signs anything: the next key is part of JWKS from the moment it is created,
+// and Rotate only promotes it once it has been published for the publish
+// period.
+type KeySet struct {
+	mu      sync.RWMutex
+	alg     string
+	publish time.Duration
+	retain  time.Duration
+	// keys is ordered newest first; keys[0] is the signing key.
+	keys []*Key
+	next *Key
+}
+
+// NewKeySet returns a key set with freshly generated keys for alg (RS256 or
+// EdDSA). The keys only live as long as the process, so this is meant for
+// development; production uses LoadKeySet.
+//
+// publish should be at least as long as verifiers cache the JWKS document, and
+// retain, how long keys retired by Rotate stay valid for verification, at least
+// as long as the lifetime of the tokens being signed.
+func NewKeySet(alg string, publish, retain time.Duration) (*KeySet, error) {
+	signing, err := generateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	return newKeySet([]*Key{signing}, publish, retain)
+}
+
+// LoadKeySet returns a key set signing with the first of keys. The other keys
+// are published and accepted for verification too, which lets operators rotate
+// by hand: add the new key behind the current one, and move it to the front
+// once the publish period has passed.
+func LoadKeySet(keys []*Key, publish, retain time.Duration) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return newKeySet(keys, publish, retain)
+}
+
+func newKeySet(keys []*Key, publish, retain time.Duration) (*KeySet, error) {
+	next, err := generateKey(keys[0].Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &KeySet{
+		alg:     keys[0].Algorithm,
+		publish: publish,
+		retain:  retain,
+		keys:    keys,
+		next:    next,
+	}, nil
+}
+
+// Rotate makes the next key the signing key, retires the current one, prunes
+// the keys that have been retired for longer than the retention period and
+// generates a new next key. It fails with ErrNextKeyPending if the next key
+// hasn't been published for the publish period yet.
+func (ks *KeySet) Rotate() error {
+	next, err := generateKey(ks.alg)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ks.next.CreatedAt) < ks.publish {
+		return ErrNextKeyPending
+	}
+
+	keys := []*Key{ks.next}
+	for _, k := range ks.keys {
+		if k.RetiredAt.IsZero() {
+			k.RetiredAt = now
+		}
+		if now.Sub(k.RetiredAt) < ks.retain {
+			keys = append(keys, k)
+		}
+	}
+	ks.keys = keys
+	ks.next = next
+	return nil
+}
+
+// StartRotation rotates the keys every interval in a background goroutine until
+// the returned stop function is called. Rotation errors are passed to onError
+// when it is not nil; the current key keeps signing in that case. An interval
+// of zero or less disables rotation.
+func (ks *KeySet) StartRotation(interval time.Duration, onError func(error)) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := ks.Rotate(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Sign encodes the claims as a token signed by the current key, with the key's
+// id in the "kid" header.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	ks.mu.RLock()
+	key := ks.keys[0]
+	ks.mu.RUnlock()
+
+	return encode(Header{Alg: key.Algorithm, Typ: "JWT", Kid: key.ID}, claims, key.private)
+}
+
+// Verify checks the signature of token against the key named by its "kid"
+// header and then validates its claims according to opts.
+func (ks *KeySet) Verify(token string, opts Options) (*Claims, error) {
+	header, claims, signingInput, signature, err := decode(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := ks.lookup(header.Kid)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	// The algorithm is pinned to the key so a token can't pick a weaker one.
+	if header.Alg != key.Algorithm || !opts.allows(header.Alg, key.Algorithm) {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	if err := verify(header.Alg, key.Public(), signingInput, signature); err != nil {
+		return nil, err
+	}
+	if err := claims.Valid(opts); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (ks *KeySet) lookup(kid string) (*Key, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, k := range ks.keys {
+		if k.ID == kid {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// JWK is the JSON Web Key representation (RFC 7517) of a public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	// RSA public key members.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP (Ed25519) public key members, see RFC 8037.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set document as served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of every key in the set: the next key, the
+// signing key and the retired keys that are still valid for verification.
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{ks.next.jwk()}}
+	for _, k := range ks.keys {
+		set.Keys = append(set.Keys, k.jwk())
+	}
+	return set
+}
+
+func (k *Key) jwk() JWK {
+	jwk := JWK{Use: "sig", Alg: k.Algorithm, Kid: k.ID}
+	switch pub := k.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the key: the SHA-256 hash of
+// its required members, serialized in lexicographic order.
+func (k JWK) thumbprint() (string, error) {
+	var members interface{}
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		return "", ErrInvalidKey
+	}
+	js, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(js)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,206 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+// The example key of RFC 7638, section 3.1.
+func TestThumbprint(t *testing.T) {
+	jwk := JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Alg: "RS256",
+		Kid: "2011-04-29",
+	}
+
+	got, err := jwk.thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestKeySetSignVerify(t *testing.T) {
+	for _, alg := range []string{RS256, EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			ks, err := NewKeySet(alg, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := ks.Sign(Claims{Subject: "alice", Issuer: "app", Audience: Audience{"app"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := ks.Verify(token, Options{Issuer: "app", Audience: "app"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "alice" {
+				t.Errorf("got subject %q; want %q", claims.Subject, "alice")
+			}
+
+			// Other parties verify against the published keys.
+			if _, err := ks.JWKS().Verify(token, Options{Issuer: "app", Audience: "app"}); err != nil {
+				t.Errorf("JWKS: %v", err)
+			}
+
+			other, err := NewKeySet(alg, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := other.Verify(token, Options{}); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("other key set: got error %v; want %v", err, ErrUnknownKey)
+			}
+		})
+	}
+}
+
+// An HMAC token that names one of the key set's kids mustn't be checked with
+// the public key as the secret.
+func TestKeySetPinsAlgorithm(t *testing.T) {
+	ks, err := NewKeySet(EdDSA, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ks.keys[0]
+
+	token, err := encode(Header{Alg: HS256, Kid: key.ID}, Claims{Subject: "admin"}, []byte(key.Public().(ed25519.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Verify(token, Options{}); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("got error %v; want %v", err, ErrUnsupportedAlgorithm)
+	}
+}
+
+func TestKeySetRotate(t *testing.T) {
+	ks, err := NewKeySet(EdDSA, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, next := ks.keys[0], ks.next
+
+	// The next key is published straight away, but can't sign or be
+	// promoted before the publish period is over.
+	jwks := ks.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != next.ID || jwks.Keys[1].Kid != current.ID {
+		t.Fatalf("got JWKS %+v; want the next and the current key", jwks.Keys)
+	}
+	early, err := encode(Header{Alg: EdDSA, Kid: next.ID}, Claims{Subject: "alice"}, next.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Verify(early, Options{}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token signed by the next key: got error %v; want %v", err, ErrUnknownKey)
+	}
+	if err := ks.Rotate(); !errors.Is(err, ErrNextKeyPending) {
+		t.Fatalf("got error %v; want %v", err, ErrNextKeyPending)
+	}
+
+	old, err := ks.Sign(Claims{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next.CreatedAt = next.CreatedAt.Add(-time.Hour)
+	if err := ks.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := ks.Sign(Claims{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, _, _, err := decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Kid != next.ID {
+		t.Errorf("signed with key %q; want the former next key %q", header.Kid, next.ID)
+	}
+	if current.RetiredAt.IsZero() {
+		t.Error("former signing key isn't retired")
+	}
+	if _, err := ks.Verify(old, Options{}); err != nil {
+		t.Errorf("token signed by the retired key: %v", err)
+	}
+
+	// Once the retention period is over the retired key is dropped.
+	current.RetiredAt = current.RetiredAt.Add(-time.Hour)
+	ks.next.CreatedAt = ks.next.CreatedAt.Add(-time.Hour)
+	if err := ks.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Verify(old, Options{}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token signed by a pruned key: got error %v; want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestParsePrivateKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("skipped")})...)
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})...)
+
+	keys, err := ParsePrivateKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Algorithm != EdDSA || keys[1].Algorithm != RS256 {
+		t.Fatalf("got %d keys; want an EdDSA and an RS256 key", len(keys))
+	}
+
+	// The ids only depend on the keys, so every instance agrees on them.
+	again, err := ParsePrivateKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if keys[i].ID != again[i].ID {
+			t.Errorf("key %d: got id %q, then %q", i, keys[i].ID, again[i].ID)
+		}
+	}
+
+	ks, err := LoadKeySet(keys, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ks.Sign(Claims{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, _, _, err := decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Kid != keys[0].ID || header.Alg != EdDSA {
+		t.Errorf("signed with %s key %q; want the first key %q", header.Alg, header.Kid, keys[0].ID)
+	}
+
+	if _, err := ParsePrivateKeys([]byte("no keys here")); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("got error %v; want %v", err, ErrNoKeys)
+	}
+}
@@ -0,0 +1,52 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileDrop writes every email as an .eml file into Dir instead of sending it,
+// which is handy for development: the files open in any mail client.
+type FileDrop struct {
+	Dir    string
+	Sender string
+}
+
+func NewFileDrop(dir, sender string) (*FileDrop, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileDrop{Dir: dir, Sender: sender}, nil
+}
+
+func (m *FileDrop) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := NewMessage(m.Sender, recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s-%s.eml",
+		msg.Date.Format("20060102T150405.000000000"),
+		strings.TrimSuffix(templateFile, filepath.Ext(templateFile)),
+		sanitize(recipient),
+	)
+	return os.WriteFile(filepath.Join(m.Dir, name), body, 0o644)
+}
+
+// sanitize keeps a recipient address safe for use in a file name.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '@', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,119 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+
+	htmltemplate "html/template"
+)
+
+// Below we declare a new variable with the type embed.FS (embedded file system)
+// to hold our email templates. The comment directive in the format
+// `//go:embed <path>` IMMEDIATELY ABOVE it indicates to Go that we want to
+// store the contents of the ./templates directory in the templateFS variable.
+//
+//go:embed "templates"
+var templateFS embed.FS
+
+// Mailer sends the email described by one of the templates in ./templates.
+// Each template file defines a "subject", a "plainBody" and an "htmlBody".
+type Mailer interface {
+	Send(recipient, templateFile string, data interface{}) error
+}
+
+// Message is a rendered email.
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	Date      time.Time
+}
+
+// NewMessage renders templateFile with data into a message from sender to
+// recipient.
+func NewMessage(sender, recipient, templateFile string, data interface{}) (*Message, error) {
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	if err = tmpl.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+	plainBody := new(bytes.Buffer)
+	if err = tmpl.ExecuteTemplate(plainBody, "plainBody", data); err != nil {
+		return nil, err
+	}
+
+	// The HTML part is parsed again with html/template so that the data is
+	// escaped properly.
+	htmlTmpl, err := htmltemplate.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+	htmlBody := new(bytes.Buffer)
+	if err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		From:      sender,
+		To:        recipient,
+		Subject:   strings.TrimSpace(subject.String()),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+		Date:      time.Now(),
+	}, nil
+}
+
+// Bytes formats the message as a multipart/alternative MIME email.
+func (m *Message) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", m.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=UTF-8", m.PlainBody},
+		{"text/html; charset=UTF-8", m.HTMLBody},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import "sync"
+
+// Memory keeps every email in memory instead of sending it, so that tests can
+// inspect what would have been sent.
+type Memory struct {
+	Sender string
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemory(sender string) *Memory {
+	return &Memory{Sender: sender}
+}
+
+func (m *Memory) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := NewMessage(m.Sender, recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of every email sent so far, oldest first.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Last returns the most recent email sent to recipient.
+func (m *Memory) Last(recipient string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == recipient {
+			return m.messages[i], true
+		}
+	}
+	return Message{}, false
+}
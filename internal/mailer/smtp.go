@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTP sends emails through an SMTP server.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Sender   string
+
+	// envelope is the bare address of Sender, which is what MAIL FROM takes;
+	// the display name only belongs in the From header.
+	envelope string
+}
+
+func NewSMTP(host string, port int, username, password, sender string) (*SMTP, error) {
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		return nil, err
+	}
+	return &SMTP{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		Sender:   sender,
+		envelope: from.Address,
+	}, nil
+}
+
+func (m *SMTP) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := NewMessage(m.Sender, recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, m.envelope, []string{recipient}, body)
+}
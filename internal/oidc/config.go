@@ -0,0 +1,90 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Config describes one OpenID provider. Providers are listed in a JSON file:
+//
+//	{"providers": [{
+//		"name": "google",
+//		"display_name": "Google",
+//		"issuer": "https://accounts.google.com",
+//		"client_id": "$GOOGLE_CLIENT_ID",
+//		"client_secret": "$GOOGLE_CLIENT_SECRET"
+//	}]}
+//
+// The client id and secret may refer to environment variables, so the file
+// itself doesn't have to hold secrets.
+type Config struct {
+	// Name identifies the provider in URLs and in the users' linked identities.
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	// RedirectURL is where the provider sends the user back to. It is set by
+	// the app rather than read from the file.
+	RedirectURL string `json:"-"`
+}
+
+var nameRX = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// LoadConfig reads the provider list from the JSON file at path.
+func LoadConfig(path string) ([]Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct {
+		Providers []Config `json:"providers"`
+	}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("oidc: %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Providers {
+		cfg := &file.Providers[i]
+		cfg.ClientID = os.ExpandEnv(cfg.ClientID)
+		cfg.ClientSecret = os.ExpandEnv(cfg.ClientSecret)
+
+		if !nameRX.MatchString(cfg.Name) {
+			return nil, fmt.Errorf("oidc: provider %d: name %q must be lowercase letters, digits, - and _", i+1, cfg.Name)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("oidc: provider %q is listed twice", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("oidc: provider %q needs an issuer and a client_id", cfg.Name)
+		}
+		if cfg.DisplayName == "" {
+			cfg.DisplayName = cfg.Name
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+		if !contains(cfg.Scopes, "openid") {
+			cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+		}
+	}
+	return file.Providers, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+// Package oidc implements the OpenID Connect authorization code flow with PKCE
+// (RFC 7636) against any provider that supports discovery.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"app/internal/jwt"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("oidc: invalid id token")
+	ErrNonceMismatch  = errors.New("oidc: id token nonce does not match")
+)
+
+// maxResponseSize caps what is read from a provider.
+const maxResponseSize = 1 << 20
+
+// jwksRefreshInterval is how often the provider's keys may be fetched again
+// when a token is signed by a key we don't know, which happens after the
+// provider rotates its keys.
+const jwksRefreshInterval = time.Minute
+
+// metadata is the part of the provider's discovery document that we use.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID provider. Its endpoints are discovered on first use
+// and cached; if discovery fails it is tried again on the next login.
+type Provider struct {
+	Config
+
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *metadata
+	keys        jwt.JWKS
+	keysFetched time.Time
+}
+
+// NewProvider returns a provider for cfg. The client is used for every request
+// to the provider; nil means http.DefaultClient.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Provider{Config: cfg, client: client}
+}
+
+// IDToken holds the claims of a verified ID token that identify the user.
+type IDToken struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+// AuthCodeURL returns the URL of the provider's login page. The provider
+// redirects back to RedirectURL with the state and an authorization code.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades an authorization code for the user's ID token, which is
+// verified before it is returned: its signature against the provider's keys,
+// its issuer, audience and expiry, and that it carries the nonce of the login.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDToken, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", p.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// Confidential clients authenticate with HTTP Basic, with the id and secret
+	// form encoded first as RFC 6749 section 2.3.1 requires.
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("oidc: token request failed with status %d: %s %s", status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token response has no id_token")
+	}
+
+	return p.verifyIDToken(ctx, meta, tokens.IDToken, nonce)
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, meta *metadata, raw, nonce string) (*IDToken, error) {
+	keys, err := p.jwks(ctx, meta, false)
+	if err != nil {
+		return nil, err
+	}
+	opts := jwt.Options{
+		Issuer:   meta.Issuer,
+		Audience: p.ClientID,
+		Leeway:   time.Minute,
+	}
+	claims, err := keys.Verify(raw, opts)
+	if errors.Is(err, jwt.ErrUnknownKey) {
+		keys, err = p.jwks(ctx, meta, true)
+		if err != nil {
+			return nil, err
+		}
+		claims, err = keys.Verify(raw, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if claims.ExpiresAt == 0 || claims.Subject == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	var token IDToken
+	if err := jwt.DecodeClaims(raw, &token); err != nil {
+		return nil, err
+	}
+	// A token issued to several clients names the one it is meant for in azp,
+	// and a token that names one at all must name us (OpenID Connect Core,
+	// section 3.1.3.7).
+	var azp struct {
+		AuthorizedParty string `json:"azp"`
+	}
+	if err := jwt.DecodeClaims(raw, &azp); err != nil {
+		return nil, err
+	}
+	if (len(claims.Audience) > 1 || azp.AuthorizedParty != "") && azp.AuthorizedParty != p.ClientID {
+		return nil, ErrInvalidIDToken
+	}
+	if token.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+	return &token, nil
+}
+
+// discover fetches and caches the provider's discovery document.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	var meta metadata
+	status, err := p.do(req, &meta)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery for %s failed with status %d", p.Name, status)
+	}
+	// The issuer must be exactly the one configured, so one provider can't
+	// pass off its tokens as another's.
+	if meta.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: %s reports issuer %q, expected %q", p.Name, meta.Issuer, p.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: discovery document of %s is incomplete", p.Name)
+	}
+
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// jwks returns the provider's signing keys, fetching them when they haven't
+// been yet, or when refresh is set and they weren't fetched just now.
+func (p *Provider) jwks(ctx context.Context, meta *metadata, refresh bool) (jwt.JWKS, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keysFetched.IsZero() || (refresh && time.Since(p.keysFetched) > jwksRefreshInterval) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+		if err != nil {
+			return jwt.JWKS{}, err
+		}
+		var keys jwt.JWKS
+		status, err := p.do(req, &keys)
+		if err != nil {
+			return jwt.JWKS{}, err
+		}
+		if status != http.StatusOK {
+			return jwt.JWKS{}, fmt.Errorf("oidc: fetching keys of %s failed with status %d", p.Name, status)
+		}
+		p.keys = keys
+		p.keysFetched = time.Now()
+	}
+	return p.keys, nil
+}
+
+// do sends req and decodes the JSON response into dst, returning the status.
+func (p *Provider) do(req *http.Request, dst interface{}) (int, error) {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, dst); err != nil {
+		return res.StatusCode, fmt.Errorf("oidc: bad response from %s: %w", req.URL.Host, err)
+	}
+	return res.StatusCode, nil
+}
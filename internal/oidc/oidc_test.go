@@ -0,0 +1,354 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider is an OpenID provider served by an httptest.Server. It issues
+// an ID token for every code it handed out through its authorization
+// endpoint, provided the client proves it started the login with the code
+// verifier matching the challenge.
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+	// signWith, when set, signs the ID tokens instead of key, which is still
+	// the one published.
+	signWith *rsa.PrivateKey
+
+	mu sync.Mutex
+	// challenges maps the codes handed out to their PKCE challenges.
+	challenges map[string]string
+	// claims returns the claims of the ID token issued for a code; it
+	// defaults to validClaims.
+	claims func(p *testProvider, nonce string) map[string]interface{}
+	nonces map[string]string
+	// auth is the Authorization header of the last token request.
+	auth string
+}
+
+const (
+	testClientID     = "grocery-store"
+	testClientSecret = "s3cret"
+)
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key, kid: "test-key", challenges: map[string]string{}, nonces: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": p.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		p.auth = r.Header.Get("Authorization")
+		challenge, ok := p.challenges[r.PostForm.Get("code")]
+		nonce := p.nonces[r.PostForm.Get("code")]
+		p.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || r.PostForm.Get("grant_type") != "authorization_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		if CodeChallenge(r.PostForm.Get("code_verifier")) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+		claims, key := validClaims, p.key
+		if p.claims != nil {
+			claims = p.claims
+		}
+		if p.signWith != nil {
+			key = p.signWith
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     p.sign(t, key, claims(p, nonce)),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// validClaims are the claims of a good ID token for alice.
+func validClaims(p *testProvider, nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            p.URL,
+		"sub":            "alice-at-provider",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice Liddell",
+	}
+}
+
+// sign returns claims as an RS256 ID token signed by key.
+func (p *testProvider) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize stands in for the user logging in at the provider: it takes the
+// login URL the app sent them to and returns the code the provider would
+// redirect them back with.
+func (p *testProvider) authorize(t *testing.T, loginURL string) string {
+	t.Helper()
+
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("got code_challenge_method %q; want S256", q.Get("code_challenge_method"))
+	}
+	code := "code-" + q.Get("state")
+	p.mu.Lock()
+	p.challenges[code] = q.Get("code_challenge")
+	p.nonces[code] = q.Get("nonce")
+	p.mu.Unlock()
+	return code
+}
+
+func (p *testProvider) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "test",
+		Issuer:       p.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		Scopes:       []string{"openid", "email"},
+		RedirectURL:  "https://app.example.com/oidc/test/callback",
+	}, p.Client())
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := newTestProvider(t)
+
+	loginURL, err := p.provider().AuthCodeURL(context.Background(), "the-state", "the-nonce", CodeChallenge("verifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loginURL, p.URL+"/authorize?") {
+		t.Fatalf("got %q; want the authorization endpoint", loginURL)
+	}
+
+	u, _ := url.Parse(loginURL)
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          "https://app.example.com/oidc/test/callback",
+		"scope":                 "openid email",
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        CodeChallenge("verifier"),
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if got := u.Query().Get(k); got != v {
+			t.Errorf("%s: got %q; want %q", k, got, v)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.provider()
+	ctx := context.Background()
+
+	verifier, _ := RandomString()
+	loginURL, err := provider.AuthCodeURL(ctx, "state", "nonce-1", CodeChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := p.authorize(t, loginURL)
+
+	token, err := provider.Exchange(ctx, code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject != "alice-at-provider" || token.Email != "alice@example.com" || !token.EmailVerified || token.Name != "Alice Liddell" {
+		t.Errorf("got %+v; want alice's claims", token)
+	}
+
+	// The client authenticates with its secret.
+	wantAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(testClientID+":"+testClientSecret))
+	if p.auth != wantAuth {
+		t.Errorf("got Authorization %q; want %q", p.auth, wantAuth)
+	}
+}
+
+// A code intercepted on its way back to the app is no use without the
+// verifier, which never leaves the app.
+func TestExchangePKCE(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.provider()
+	ctx := context.Background()
+
+	verifier, _ := RandomString()
+	loginURL, err := provider.AuthCodeURL(ctx, "state", "nonce-1", CodeChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := p.authorize(t, loginURL)
+
+	other, _ := RandomString()
+	_, err = provider.Exchange(ctx, code, other, "nonce-1")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("got error %v; want the provider to refuse the code", err)
+	}
+}
+
+func TestExchangeRejectsBadIDTokens(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(claims map[string]interface{})
+		want   error
+	}{
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, ErrInvalidIDToken},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "another-client" }, ErrInvalidIDToken},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }, ErrNonceMismatch},
+		{"no nonce", func(c map[string]interface{}) { delete(c, "nonce") }, ErrNonceMismatch},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, ErrInvalidIDToken},
+		{"no expiry", func(c map[string]interface{}) { delete(c, "exp") }, ErrInvalidIDToken},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, ErrInvalidIDToken},
+		{"several audiences without azp", func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "another-client"}
+		}, ErrInvalidIDToken},
+		{"several audiences, azp another client", func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "another-client"}
+			c["azp"] = "another-client"
+		}, ErrInvalidIDToken},
+		{"azp another client", func(c map[string]interface{}) { c["azp"] = "another-client" }, ErrInvalidIDToken},
+		{"several audiences, azp us", func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "another-client"}
+			c["azp"] = testClientID
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t)
+			p.claims = func(p *testProvider, nonce string) map[string]interface{} {
+				c := validClaims(p, nonce)
+				tt.modify(c)
+				return c
+			}
+
+			_, err := exchange(t, p)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v; want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("signed by another key", func(t *testing.T) {
+		// The token names the provider's key, but is signed by another.
+		p := newTestProvider(t)
+		p.signWith = otherKey
+
+		_, err := exchange(t, p)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("got error %v; want %v", err, ErrInvalidIDToken)
+		}
+	})
+}
+
+// exchange runs a whole login against p and returns what Exchange made of the
+// ID token.
+func exchange(t *testing.T, p *testProvider) (*IDToken, error) {
+	t.Helper()
+
+	provider := p.provider()
+	ctx := context.Background()
+	verifier, _ := RandomString()
+	loginURL, err := provider.AuthCodeURL(ctx, "state", "nonce-1", CodeChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.Exchange(ctx, p.authorize(t, loginURL), verifier, "nonce-1")
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.provider()
+	provider.Issuer = p.URL + "/"
+
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "challenge")
+	if err == nil || !strings.Contains(err.Error(), "reports issuer") {
+		t.Errorf("got error %v; want an issuer mismatch", err)
+	}
+}
+
+// The example of RFC 7636, appendix B.
+func TestCodeChallenge(t *testing.T) {
+	got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
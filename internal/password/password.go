@@ -0,0 +1,90 @@
+// Package password hashes and verifies user passwords. Hashes are stored in a
+// self-describing format that names the algorithm and its parameters, so the
+// algorithm or its cost can be changed while old hashes keep working and are
+// upgraded the next time their owner logs in.
+package password
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownFormat is returned for a hash none of the hashers recognises.
+var ErrUnknownFormat = errors.New("password: unknown hash format")
+
+// Hasher is one password hashing algorithm with its parameters.
+type Hasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Identifies reports whether hash is in this hasher's format.
+	Identifies(hash string) bool
+	// Matches reports whether password matches hash.
+	Matches(password, hash string) (bool, error)
+	// Outdated reports whether hash was made with parameters other than the
+	// hasher's current ones.
+	Outdated(hash string) bool
+}
+
+// Manager hashes new passwords with its Current hasher and verifies hashes
+// made by any of its hashers.
+type Manager struct {
+	Current Hasher
+	// Legacy are the hashers of hashes that may still be stored, but that new
+	// passwords aren't hashed with any more.
+	Legacy []Hasher
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// NewManager returns a manager hashing with current and also accepting hashes
+// made by legacy.
+func NewManager(current Hasher, legacy ...Hasher) *Manager {
+	return &Manager{Current: current, Legacy: legacy}
+}
+
+// Hash hashes password with the current hasher.
+func (m *Manager) Hash(password string) (string, error) {
+	return m.Current.Hash(password)
+}
+
+// Verify reports whether password matches hash, and if it does, whether the
+// hash should be replaced by m.Hash(password) because it was made by another
+// hasher or with outdated parameters. An empty hash matches no password; it
+// is what accounts without a password have.
+func (m *Manager) Verify(password, hash string) (match bool, rehash bool, err error) {
+	if hash == "" {
+		return false, false, nil
+	}
+	hasher := m.hasherFor(hash)
+	if hasher == nil {
+		return false, false, ErrUnknownFormat
+	}
+	match, err = hasher.Matches(password, hash)
+	if err != nil || !match {
+		return false, false, err
+	}
+	return true, hasher != m.Current || m.Current.Outdated(hash), nil
+}
+
+// Dummy spends as long as verifying a password with the current hasher does,
+// so a login for an account that doesn't exist can't be told apart from one
+// with a wrong password by its response time.
+func (m *Manager) Dummy(password string) {
+	m.dummyOnce.Do(func() {
+		m.dummy, _ = m.Current.Hash("not a real password")
+	})
+	m.Current.Matches(password, m.dummy)
+}
+
+func (m *Manager) hasherFor(hash string) Hasher {
+	if m.Current.Identifies(hash) {
+		return m.Current
+	}
+	for _, h := range m.Legacy {
+		if h.Identifies(hash) {
+			return h
+		}
+	}
+	return nil
+}
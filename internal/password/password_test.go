@@ -0,0 +1,193 @@
+package password
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, so the tests don't spend their time hashing.
+var (
+	testArgon2id = Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	testBcrypt   = Bcrypt{Cost: bcrypt.MinCost}
+)
+
+func TestHashers(t *testing.T) {
+	hashers := map[string]Hasher{"argon2id": testArgon2id, "bcrypt": testBcrypt}
+
+	for name, h := range hashers {
+		t.Run(name, func(t *testing.T) {
+			hash, err := h.Hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !h.Identifies(hash) {
+				t.Errorf("doesn't identify its own hash %q", hash)
+			}
+			if h.Outdated(hash) {
+				t.Errorf("own hash %q is outdated", hash)
+			}
+
+			match, err := h.Matches("correct horse battery staple", hash)
+			if err != nil || !match {
+				t.Errorf("right password: got %t, %v; want a match", match, err)
+			}
+			match, err = h.Matches("Correct horse battery staple", hash)
+			if err != nil || match {
+				t.Errorf("wrong password: got %t, %v; want no match", match, err)
+			}
+
+			// Every hash has a salt of its own.
+			other, err := h.Hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == hash {
+				t.Error("got the same hash twice")
+			}
+		})
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	hash, err := testArgon2id.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("got %q; want the PHC string format", hash)
+	}
+
+	stronger := testArgon2id
+	stronger.Iterations = 2
+	if !stronger.Outdated(hash) {
+		t.Error("hash with fewer iterations isn't outdated")
+	}
+
+	for _, bad := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2id$v=19$m=1024,t=1,p=1$not base64$c2FsdA",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$c2FsdA",
+	} {
+		if _, err := testArgon2id.Matches("secret", bad); err == nil {
+			t.Errorf("%q: got no error", bad)
+		}
+	}
+}
+
+func TestManagerVerify(t *testing.T) {
+	m := NewManager(testArgon2id, testBcrypt)
+
+	current, err := m.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := testBcrypt.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weaker := testArgon2id
+	weaker.Iterations = 2
+	outdated, err := weaker.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		password   string
+		hash       string
+		wantMatch  bool
+		wantRehash bool
+		wantErr    error
+	}{
+		{"current hash", "secret", current, true, false, nil},
+		{"wrong password", "guess", current, false, false, nil},
+		{"legacy hash", "secret", legacy, true, true, nil},
+		{"wrong password for legacy hash", "guess", legacy, false, false, nil},
+		{"outdated parameters", "secret", outdated, true, true, nil},
+		{"no password", "", "", false, false, nil},
+		{"unknown format", "secret", "$1$md5crypt", false, false, ErrUnknownFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, rehash, err := m.Verify(tt.password, tt.hash)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if match != tt.wantMatch || rehash != tt.wantRehash {
+				t.Errorf("got match %t, rehash %t; want %t, %t", match, rehash, tt.wantMatch, tt.wantRehash)
+			}
+		})
+	}
+}
+
+func TestManagerDummy(t *testing.T) {
+	m := NewManager(testBcrypt)
+	m.Dummy("secret")
+	if !testBcrypt.Identifies(m.dummy) {
+		t.Errorf("dummy hash %q isn't made by the current hasher", m.dummy)
+	}
+}
+
+func TestPwned(t *testing.T) {
+	// The range of "password", whose SHA-1 is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8,
+	// and one where "12345678" only turns up as padding, which doesn't count.
+	var asked []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.URL.Path)
+		if r.Header.Get("Add-Padding") != "true" {
+			t.Error("request without padding")
+		}
+		switch r.URL.Path {
+		case "/range/5BAA6":
+			fmt.Fprint(w, "003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n")
+		case "/range/7C222":
+			fmt.Fprint(w, "FB2927D828AF22F592134E8932480637C0D:0\r\n")
+		default:
+			fmt.Fprint(w, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n")
+		}
+	}))
+	defer ts.Close()
+	p := NewPwned(ts.URL+"/range/", ts.Client())
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"12345678", false}, // only in the padding
+		{"Tr0ub4dor&3xQ!", false},
+	}
+	for _, tt := range tests {
+		got, err := p.Breached(context.Background(), tt.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: got breached %v; want %v", tt.password, got, tt.want)
+		}
+	}
+	// Only the prefix of the hash leaves the server.
+	for _, path := range asked {
+		if len(strings.TrimPrefix(path, "/range/")) != 5 {
+			t.Errorf("asked for %s; want a five digit prefix", path)
+		}
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	if _, err := NewPwned(down.URL+"/range/", down.Client()).Breached(context.Background(), "password"); err == nil {
+		t.Error("unavailable service: got no error")
+	}
+}
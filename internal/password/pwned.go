@@ -0,0 +1,63 @@
+package password
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultPwnedURL is the range endpoint of the Pwned Passwords service.
+const DefaultPwnedURL = "https://api.pwnedpasswords.com/range/"
+
+// Pwned checks passwords against the Pwned Passwords corpus of breached
+// passwords through its k-anonymity range API: only the first five hex digits
+// of a password's SHA-1 hash are sent, and the service answers with the
+// suffixes of every breached hash that starts with them.
+type Pwned struct {
+	// URL is the range endpoint; the prefix is appended to it.
+	URL    string
+	Client *http.Client
+}
+
+// NewPwned returns a checker that asks the range endpoint at url.
+func NewPwned(url string, client *http.Client) *Pwned {
+	return &Pwned{URL: url, Client: client}
+}
+
+// Breached reports whether password appears in the corpus.
+func (p *Pwned) Breached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding hides how many suffixes the prefix really has, and so which
+	// prefix was asked for, from anyone watching the response sizes. The
+	// padding entries have a count of 0.
+	req.Header.Set("Add-Padding", "true")
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("password: pwned passwords range request: %s", res.Status)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		s, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if ok && strings.EqualFold(s, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,257 @@
+package qr
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRSRemainder(t *testing.T) {
+	// "HELLO WORLD" as 1-M, from the worked example at thonky.com.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	tests := []struct {
+		level Level
+		want  string
+	}{
+		{L, "111011111000100"},
+		{M, "101010000010010"},
+		{Q, "011010101011111"},
+		{H, "001011010001001"},
+	}
+
+	for _, tt := range tests {
+		got := strconv.FormatInt(int64(formatBits(tt.level, 0)), 2)
+		if len(got) < 15 {
+			got = strings.Repeat("0", 15-len(got)) + got
+		}
+		if got != tt.want {
+			t.Errorf("level %d, mask 0: got %s; want %s", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	// Bytes each version holds, from the tables of the standard.
+	tests := []struct {
+		version int
+		level   Level
+		want    int
+	}{
+		{1, L, 17},
+		{1, M, 14},
+		{1, Q, 11},
+		{1, H, 7},
+		{7, M, 122},
+		{10, M, 213},
+		{25, Q, 715},
+		{40, L, 2953},
+		{40, H, 1273},
+	}
+
+	for _, tt := range tests {
+		got := (dataCodewords(tt.version, tt.level)*8 - 4 - countBits(tt.version)) / 8
+		if got != tt.want {
+			t.Errorf("%d-%d: got %d bytes; want %d", tt.version, tt.level, got, tt.want)
+		}
+	}
+
+	if _, err := Encode(strings.Repeat("x", 2954), L); err != ErrTooLong {
+		t.Errorf("too long text: got error %v; want ErrTooLong", err)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	uri := "otpauth://totp/Grocery%20Store:alice?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Grocery%20Store&algorithm=SHA1&digits=6&period=30"
+	tests := []struct {
+		text    string
+		level   Level
+		version int
+	}{
+		{"", M, 1},
+		{"hello", H, 1},
+		{strings.Repeat("a", 14), M, 1},
+		{strings.Repeat("a", 15), M, 2},
+		{uri, M, 8},
+		{strings.Repeat("groceries ", 40), Q, 19},
+		{strings.Repeat("€", 400), L, 25},
+	}
+
+	for _, tt := range tests {
+		c, err := Encode(tt.text, tt.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.version*4 + 17; c.Size != want {
+			t.Errorf("%.20q: got size %d; want %d (version %d)", tt.text, c.Size, want, tt.version)
+			continue
+		}
+		if got := read(t, c, tt.level); got != tt.text {
+			t.Errorf("read back %.20q; want %.20q", got, tt.text)
+		}
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	c, err := Encode(strings.Repeat("a", 120), M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size != 45 {
+		t.Fatalf("got size %d; want 45 (version 7)", c.Size)
+	}
+	// The version 7 information from the standard, 000111 110010010100, is in
+	// the 6x3 blocks next to the top right and bottom left finders, least
+	// significant bit first.
+	want := 0x07C94
+	for i := 0; i < 18; i++ {
+		if c.Black(c.Size-11+i%3, i/3) != bit(want, i) || c.Black(i/3, c.Size-11+i%3) != bit(want, i) {
+			t.Fatalf("version bit %d is wrong", i)
+		}
+	}
+}
+
+func TestSVG(t *testing.T) {
+	c, err := Encode("hello", M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := c.SVG()
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `viewBox="0 0 29 29"`) {
+		t.Errorf("got %.80s; want a 29 module square svg", svg)
+	}
+	// The top left module of the top left finder is dark.
+	if !strings.Contains(svg, "M4,4h1v1h-1z") {
+		t.Error("finder pattern missing")
+	}
+}
+
+// read decodes c the way a scanner would once it has found the modules: from
+// its format bits, codewords and error correction.
+func read(t *testing.T, c *Code, level Level) string {
+	t.Helper()
+
+	// Both copies of the format hold the level and the mask.
+	var first, second int
+	positions := [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8}, {5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}}
+	for i, p := range positions {
+		if c.Black(p[0], p[1]) {
+			first |= 1 << i
+		}
+		x, y := c.Size-1-i, 8
+		if i >= 8 {
+			x, y = 8, c.Size-15+i
+		}
+		if c.Black(x, y) {
+			second |= 1 << i
+		}
+	}
+	if first != second {
+		t.Fatalf("format copies differ: %015b and %015b", first, second)
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if formatBits(level, m) == first {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("format %015b isn't level %d", first, level)
+	}
+
+	version := (c.Size - 17) / 4
+	plain := newCode(version, level)
+	for i := range plain.modules {
+		if !plain.function[i] {
+			plain.modules[i] = c.modules[i]
+		}
+	}
+	plain.applyMask(mask)
+
+	// Read the data modules in order: column pairs from the right, going up
+	// first, skipping the timing column.
+	var bits bitBuffer
+	up := true
+	for right := c.Size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for i := 0; i < c.Size; i++ {
+			y := i
+			if up {
+				y = c.Size - 1 - i
+			}
+			for _, x := range []int{right, right - 1} {
+				if !plain.function[y*c.Size+x] {
+					bits = append(bits, plain.Black(x, y))
+				}
+			}
+		}
+		up = !up
+	}
+	codewords := bits.bytes()[:rawDataModules(version)/8]
+
+	// Undo the interleaving and check every block's error correction.
+	numBlocks := eccBlocks[level][version]
+	eccLen := eccCodewordsPerBlock[level][version]
+	numShort := numBlocks - len(codewords)%numBlocks
+	shortData := len(codewords)/numBlocks - eccLen
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortData; i++ {
+		for j := range blocks {
+			if i < shortData || j >= numShort {
+				blocks[j] = append(blocks[j], codewords[k])
+				k++
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for j := range blocks {
+			blocks[j] = append(blocks[j], codewords[k])
+			k++
+		}
+	}
+	var data []byte
+	for j, block := range blocks {
+		n := len(block) - eccLen
+		if !bytes.Equal(rsRemainder(block[:n], rsDivisor(eccLen)), block[n:]) {
+			t.Fatalf("block %d fails error correction", j)
+		}
+		data = append(data, block[:n]...)
+	}
+
+	// Byte mode header, then the text.
+	var header bitBuffer
+	for _, b := range data[:3] {
+		header.append(int(b), 8)
+	}
+	value := func(bits bitBuffer) int {
+		v := 0
+		for _, b := range bits {
+			v <<= 1
+			if b {
+				v |= 1
+			}
+		}
+		return v
+	}
+	if mode := value(header[:4]); mode != 0x4 {
+		t.Fatalf("got mode %04b; want byte mode", mode)
+	}
+	n := value(header[4 : 4+countBits(version)])
+	var text bitBuffer
+	for _, b := range data {
+		text.append(int(b), 8)
+	}
+	start := 4 + countBits(version)
+	return string(text[start : start+8*n].bytes())
+}
@@ -0,0 +1,65 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"app/internal/encrypt"
+)
+
+// maxCookieSize is what browsers are guaranteed to store for a cookie,
+// including its name and attributes, which are left some room.
+const maxCookieSize = 4096 - 256
+
+// CookieStore keeps the values in the session cookie, encrypted and
+// authenticated so the browser can neither read nor change them. Nothing is
+// stored on the server, so a session can't be ended before it expires, only
+// replaced.
+type CookieStore struct {
+	Cipher *encrypt.Cipher
+}
+
+func NewCookieStore(cipher *encrypt.Cipher) *CookieStore {
+	return &CookieStore{Cipher: cipher}
+}
+
+type cookieSession struct {
+	Values map[string]string `json:"v"`
+	Expiry time.Time         `json:"e"`
+}
+
+func (s *CookieStore) Load(ctx context.Context, token string) (map[string]string, error) {
+	js, err := s.Cipher.Decrypt(token)
+	if err != nil {
+		return nil, err
+	}
+	var cs cookieSession
+	if err := json.Unmarshal(js, &cs); err != nil {
+		return nil, err
+	}
+	// The cookie's own expiry is up to the browser, so it is checked here too.
+	if time.Now().After(cs.Expiry) {
+		return nil, nil
+	}
+	return cs.Values, nil
+}
+
+func (s *CookieStore) Save(ctx context.Context, token string, values map[string]string, expiry time.Time) (string, error) {
+	js, err := json.Marshal(cookieSession{Values: values, Expiry: expiry})
+	if err != nil {
+		return "", err
+	}
+	token, err = s.Cipher.Encrypt(js)
+	if err != nil {
+		return "", err
+	}
+	if len(token) > maxCookieSize {
+		return "", ErrTooLarge
+	}
+	return token, nil
+}
+
+func (s *CookieStore) Delete(ctx context.Context, token string) error {
+	return nil
+}
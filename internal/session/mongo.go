@@ -0,0 +1,101 @@
+package session
+
+import (
+	"app/internal/data"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore keeps the values in a collection and only a random token in the
+// cookie. Like other tokens, only its SHA-256 hash is stored. The collection
+// should have a TTL index on expiry; see Indexes.
+type MongoStore struct {
+	Collection *mongo.Collection
+	Timeouts   data.Timeouts
+}
+
+func NewMongoStore(db *mongo.Database, timeouts data.Timeouts) *MongoStore {
+	return &MongoStore{Collection: db.Collection("sessions"), Timeouts: timeouts}
+}
+
+// Indexes are the indexes the collection needs.
+func (s *MongoStore) Indexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expiry", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+}
+
+type mongoSession struct {
+	Hash   []byte            `bson:"_id"`
+	Values map[string]string `bson:"values"`
+	Expiry time.Time         `bson:"expiry"`
+}
+
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func (s *MongoStore) Load(ctx context.Context, token string) (map[string]string, error) {
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Read)
+	defer cancel()
+
+	var ms mongoSession
+	err := s.Collection.FindOne(ctx, bson.M{
+		"_id":    hashToken(token),
+		"expiry": bson.M{"$gt": time.Now()},
+	}).Decode(&ms)
+	err = data.TranslateError(err)
+	if errors.Is(err, data.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ms.Values == nil {
+		ms.Values = map[string]string{}
+	}
+	return ms.Values, nil
+}
+
+func (s *MongoStore) Save(ctx context.Context, token string, values map[string]string, expiry time.Time) (string, error) {
+	if token == "" {
+		randomBytes := make([]byte, 32)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return "", err
+		}
+		token = base64.RawURLEncoding.EncodeToString(randomBytes)
+	}
+
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Write)
+	defer cancel()
+
+	_, err := s.Collection.ReplaceOne(ctx,
+		bson.M{"_id": hashToken(token)},
+		mongoSession{Hash: hashToken(token), Values: values, Expiry: expiry},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return "", data.TranslateError(err)
+	}
+	return token, nil
+}
+
+func (s *MongoStore) Delete(ctx context.Context, token string) error {
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Write)
+	defer cancel()
+
+	_, err := s.Collection.DeleteOne(ctx, bson.M{"_id": hashToken(token)})
+	return data.TranslateError(err)
+}
@@ -0,0 +1,201 @@
+// Package session keeps small values, such as flash messages, between the
+// requests of one browser. The values live in a Store: either in the session
+// cookie itself, encrypted, or in the database with only a random token in the
+// cookie.
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrTooLarge is returned by a store that can't hold that many values.
+var ErrTooLarge = errors.New("session: too much data")
+
+// Store saves the values of sessions. Each call gets the context of the
+// request the session belongs to.
+type Store interface {
+	// Load returns the values of the session the token refers to, or nil if
+	// there is no such session or it has expired.
+	Load(ctx context.Context, token string) (map[string]string, error)
+	// Save stores the values until expiry and returns the token the cookie
+	// should hold from now on. An empty token starts a new session.
+	Save(ctx context.Context, token string, values map[string]string, expiry time.Time) (string, error)
+	// Delete forgets the session the token refers to.
+	Delete(ctx context.Context, token string) error
+}
+
+// Manager loads the session of each request and saves it if it was changed.
+type Manager struct {
+	Store    Store
+	Lifetime time.Duration
+	// Cookie is the template of the session cookie. Its value and expiry are
+	// filled in by the manager.
+	Cookie http.Cookie
+	// ErrorFunc is called with the errors of loading and saving sessions. The
+	// request goes on without its session rather than failing.
+	ErrorFunc func(error)
+}
+
+// New returns a manager keeping sessions in store for lifetime after their
+// last change.
+func New(store Store, lifetime time.Duration) *Manager {
+	return &Manager{
+		Store:    store,
+		Lifetime: lifetime,
+		Cookie: http.Cookie{
+			Name:     "session",
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		ErrorFunc: func(error) {},
+	}
+}
+
+type contextKey struct{}
+
+type sessionData struct {
+	mu       sync.Mutex
+	token    string
+	values   map[string]string
+	modified bool
+}
+
+// LoadAndSave is the middleware that makes the session available to Put, Get
+// and Pop. Changes are saved just before the response header is written, so
+// changes made after that are lost.
+func (m *Manager) LoadAndSave(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sd := &sessionData{}
+		if cookie, err := r.Cookie(m.Cookie.Name); err == nil && cookie.Value != "" {
+			values, err := m.Store.Load(r.Context(), cookie.Value)
+			if err != nil {
+				// Drop the cookie, so a bad one isn't reported on every
+				// request.
+				m.ErrorFunc(err)
+				sd.modified = true
+			}
+			// A token that refers to nothing isn't reused, so a session can't
+			// be planted in a browser by setting its cookie.
+			if values != nil {
+				sd.token = cookie.Value
+				sd.values = values
+			}
+		}
+		if sd.values == nil {
+			sd.values = map[string]string{}
+		}
+
+		sw := &sessionWriter{ResponseWriter: w, ctx: r.Context(), manager: m, session: sd}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), contextKey{}, sd)))
+		sw.commit()
+	})
+}
+
+func (m *Manager) save(ctx context.Context, w http.ResponseWriter, sd *sessionData) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if !sd.modified {
+		return
+	}
+
+	cookie := m.Cookie
+	if len(sd.values) == 0 {
+		if sd.token != "" {
+			if err := m.Store.Delete(ctx, sd.token); err != nil {
+				m.ErrorFunc(err)
+			}
+		}
+		cookie.MaxAge = -1
+		http.SetCookie(w, &cookie)
+		return
+	}
+
+	expiry := time.Now().Add(m.Lifetime)
+	token, err := m.Store.Save(ctx, sd.token, sd.values, expiry)
+	if err != nil {
+		m.ErrorFunc(err)
+		return
+	}
+	cookie.Value = token
+	cookie.Expires = expiry
+	cookie.MaxAge = int(m.Lifetime.Seconds())
+	http.SetCookie(w, &cookie)
+}
+
+// sessionWriter saves the session before the first byte of the response goes
+// out, while cookies can still be set.
+type sessionWriter struct {
+	http.ResponseWriter
+	ctx       context.Context
+	manager   *Manager
+	session   *sessionData
+	committed bool
+}
+
+func (sw *sessionWriter) commit() {
+	if sw.committed {
+		return
+	}
+	sw.committed = true
+	sw.manager.save(sw.ctx, sw.ResponseWriter, sw.session)
+}
+
+func (sw *sessionWriter) WriteHeader(status int) {
+	sw.commit()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *sessionWriter) Write(b []byte) (int, error) {
+	sw.commit()
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *sessionWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (m *Manager) data(r *http.Request) *sessionData {
+	sd, ok := r.Context().Value(contextKey{}).(*sessionData)
+	if !ok {
+		panic("session: no session in request context, is LoadAndSave missing?")
+	}
+	return sd
+}
+
+// Put sets key to value in the session of the request.
+func (m *Manager) Put(r *http.Request, key, value string) {
+	sd := m.data(r)
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.values[key] = value
+	sd.modified = true
+}
+
+// Get returns the value of key, or "" if it isn't set.
+func (m *Manager) Get(r *http.Request, key string) string {
+	sd := m.data(r)
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.values[key]
+}
+
+// Pop returns the value of key and removes it from the session, which makes it
+// the way to show a message once.
+func (m *Manager) Pop(r *http.Request, key string) string {
+	sd := m.data(r)
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	value, ok := sd.values[key]
+	if ok {
+		delete(sd.values, key)
+		sd.modified = true
+	}
+	return value
+}
@@ -0,0 +1,125 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the counters in the memory of a single instance.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+	done    chan struct{}
+	once    sync.Once
+}
+
+// sweepInterval is how often a MemoryStore drops its expired records.
+const sweepInterval = time.Minute
+
+// NewMemoryStore returns an empty store. Expired records are dropped in the
+// background until Close is called.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{records: make(map[string]Record), done: make(chan struct{})}
+	go s.sweepEvery(sweepInterval)
+	return s
+}
+
+// Close stops dropping expired records.
+func (s *MemoryStore) Close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(key, time.Now()), nil
+}
+
+// get returns the record for key, or a zero Record if there is none or it has
+// expired. It must be called with the mutex held.
+func (s *MemoryStore) get(key string, now time.Time) Record {
+	rec, ok := s.records[key]
+	if !ok || now.After(rec.ExpiresAt) {
+		return Record{}
+	}
+	return rec
+}
+
+func (s *MemoryStore) Attempt(ctx context.Context, key string, now, expiresAt time.Time, check func(Record) time.Duration) (Record, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := s.get(key, now)
+	if wait := check(rec); wait > 0 {
+		return rec, wait, nil
+	}
+	rec.Key = key
+	rec.Failures++
+	rec.LastFailure = now
+	if expiresAt.After(rec.ExpiresAt) {
+		rec.ExpiresAt = expiresAt
+	}
+	s.records[key] = rec
+	return rec, 0, nil
+}
+
+func (s *MemoryStore) Forgive(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[key]
+	if ok && rec.Failures > 0 {
+		rec.Failures--
+		s.records[key] = rec
+	}
+	return nil
+}
+
+func (s *MemoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := s.records[key]
+	rec.Key = key
+	rec.LockedUntil = until
+	if until.After(rec.ExpiresAt) {
+		rec.ExpiresAt = until
+	}
+	s.records[key] = rec
+	return nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryStore) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweep(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sweep drops expired records so the map doesn't grow without bound.
+func (s *MemoryStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, rec := range s.records {
+		if now.After(rec.ExpiresAt) {
+			delete(s.records, key)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package throttle
+
+import (
+	"app/internal/data"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore keeps the counters in a collection so that every instance of the
+// app sees the same failures. The collection should have a TTL index on
+// expiresAt; see Indexes.
+type MongoStore struct {
+	Collection *mongo.Collection
+	Timeouts   data.Timeouts
+}
+
+func NewMongoStore(db *mongo.Database, timeouts data.Timeouts) *MongoStore {
+	return &MongoStore{Collection: db.Collection("login_attempts"), Timeouts: timeouts}
+}
+
+// Indexes are the indexes the collection needs.
+func (s *MongoStore) Indexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+}
+
+func (s *MongoStore) Get(ctx context.Context, key string) (Record, error) {
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Read)
+	defer cancel()
+
+	var rec Record
+	err := s.Collection.FindOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&rec)
+	err = data.TranslateError(err)
+	if errors.Is(err, data.ErrNotFound) {
+		return Record{}, nil
+	}
+	return rec, err
+}
+
+// attemptRetries is how many times Attempt starts over when another attempt
+// for the same key changed the record between reading and counting.
+const attemptRetries = 5
+
+func (s *MongoStore) Attempt(ctx context.Context, key string, now, expiresAt time.Time, check func(Record) time.Duration) (Record, time.Duration, error) {
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Write)
+	defer cancel()
+
+	for i := 0; i < attemptRetries; i++ {
+		rec, err := s.Get(ctx, key)
+		if err != nil {
+			return Record{}, 0, err
+		}
+		if wait := check(rec); wait > 0 {
+			return rec, wait, nil
+		}
+
+		// The update only applies to the record that was checked: one that
+		// is still the same, or, if there was none, no record at all, in
+		// which case it is inserted. Had another attempt got in first, the
+		// filter no longer matches (or the insert clashes with its record),
+		// and the check is made again on the new record.
+		var filter bson.M
+		if rec.Key == "" {
+			// A record past its expiry may still be around until the TTL
+			// monitor gets to it, so start it over first.
+			_, err = s.Collection.DeleteOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$lte": now}})
+			if err != nil {
+				return Record{}, 0, data.TranslateError(err)
+			}
+			filter = bson.M{"_id": key, "failures": bson.M{"$exists": false}}
+		} else {
+			filter = bson.M{"_id": key, "failures": rec.Failures, "lastFailure": rec.LastFailure}
+		}
+
+		var after Record
+		err = s.Collection.FindOneAndUpdate(ctx,
+			filter,
+			bson.M{
+				"$inc": bson.M{"failures": 1},
+				"$set": bson.M{"lastFailure": now},
+				"$max": bson.M{"expiresAt": expiresAt},
+			},
+			options.FindOneAndUpdate().SetUpsert(rec.Key == "").SetReturnDocument(options.After),
+		).Decode(&after)
+		err = data.TranslateError(err)
+		var dup *data.ErrDuplicate
+		if errors.Is(err, data.ErrNotFound) || errors.As(err, &dup) {
+			continue
+		}
+		if err != nil {
+			return Record{}, 0, err
+		}
+		return after, 0, nil
+	}
+	return Record{}, 0, data.ErrConflict
+}
+
+func (s *MongoStore) Forgive(ctx context.Context, key string) error {
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Write)
+	defer cancel()
+
+	_, err := s.Collection.UpdateOne(ctx,
+		bson.M{"_id": key, "failures": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"failures": -1}},
+	)
+	return data.TranslateError(err)
+}
+
+func (s *MongoStore) Lock(ctx context.Context, key string, until time.Time) error {
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Write)
+	defer cancel()
+
+	_, err := s.Collection.UpdateOne(ctx,
+		bson.M{"_id": key},
+		bson.M{"$set": bson.M{"lockedUntil": until}, "$max": bson.M{"expiresAt": until}},
+		options.Update().SetUpsert(true),
+	)
+	return data.TranslateError(err)
+}
+
+func (s *MongoStore) Reset(ctx context.Context, key string) error {
+	ctx, cancel := data.WithTimeout(ctx, s.Timeouts.Write)
+	defer cancel()
+
+	_, err := s.Collection.DeleteOne(ctx, bson.M{"_id": key})
+	return data.TranslateError(err)
+}
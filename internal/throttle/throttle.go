@@ -0,0 +1,122 @@
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+// Record is what a Store keeps about the failed attempts for one key, such as
+// "ip:203.0.113.7" or "login:bob".
+type Record struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	LastFailure time.Time `bson:"lastFailure"`
+	LockedUntil time.Time `bson:"lockedUntil,omitempty"`
+	// ExpiresAt is when the record is forgotten if there are no more failures.
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// Store keeps failure counters. Implementations must update them atomically,
+// so that limits hold when several instances of the app share a store. The
+// context of the request is passed along, so a store stops waiting for its
+// database when the client has gone.
+type Store interface {
+	// Get returns the record for key, or a zero Record if there is none.
+	Get(ctx context.Context, key string) (Record, error)
+	// Attempt passes the record for key to check, and unless check returns a
+	// wait, counts an attempt at now as a failure and keeps the record until at
+	// least expiresAt. The check and the count are one atomic step, so
+	// concurrent attempts each see the ones before. It returns the record as
+	// it is afterwards and the wait.
+	Attempt(ctx context.Context, key string, now, expiresAt time.Time, check func(Record) time.Duration) (Record, time.Duration, error)
+	// Forgive takes back a failure counted by Attempt.
+	Forgive(ctx context.Context, key string) error
+	// Lock locks key until the given time.
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Reset forgets everything about key.
+	Reset(ctx context.Context, key string) error
+}
+
+// Limiter slows down guessing with exponential backoff. The first FreeAttempts
+// failures cost nothing; after that each failure doubles the wait before the
+// next attempt, from BaseDelay up to MaxDelay. Every time another LockAfter
+// failures have piled up the key is locked for LockFor. Failures are forgotten after Window
+// without new ones.
+//
+// An attempt counts as a failure from the moment Attempt lets it go ahead, so
+// that a burst of guesses sent at once can't all get past the check before the
+// first of them has failed. Attempts that turn out not to have failed are taken
+// back with Forgive or Reset.
+type Limiter struct {
+	Store        Store
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// LockAfter is the number of failures that locks the key; zero disables
+	// locking.
+	LockAfter int
+	LockFor   time.Duration
+	Window    time.Duration
+}
+
+// Attempt returns how long the caller must wait before an attempt for key is
+// allowed. Zero means the attempt may go ahead, and it has been counted as a
+// failure; the returned record is to be passed to Fail if it does fail.
+func (l *Limiter) Attempt(ctx context.Context, key string) (Record, time.Duration, error) {
+	now := time.Now()
+	return l.Store.Attempt(ctx, key, now, now.Add(l.Window), func(rec Record) time.Duration {
+		return l.wait(rec, now)
+	})
+}
+
+// wait returns how long after now the next attempt is allowed, given the
+// record of the failures so far.
+func (l *Limiter) wait(rec Record, now time.Time) time.Duration {
+	if now.Before(rec.LockedUntil) {
+		return rec.LockedUntil.Sub(now)
+	}
+	next := rec.LastFailure.Add(l.delay(rec.Failures))
+	if now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// Fail confirms that the attempt Attempt returned rec for failed. locked is
+// true when this failure is the one that locked the key. Since every attempt
+// has a count of its own, only one of them can be that one.
+func (l *Limiter) Fail(ctx context.Context, rec Record) (Record, bool, error) {
+	// Lock again for every further LockAfter failures.
+	if l.LockAfter > 0 && rec.Failures%l.LockAfter == 0 {
+		rec.LockedUntil = time.Now().Add(l.LockFor)
+		if err := l.Store.Lock(ctx, rec.Key, rec.LockedUntil); err != nil {
+			return Record{}, false, err
+		}
+		return rec, true, nil
+	}
+	return rec, false, nil
+}
+
+// Forgive takes back an attempt for key that didn't fail.
+func (l *Limiter) Forgive(ctx context.Context, key string) error {
+	return l.Store.Forgive(ctx, key)
+}
+
+// Reset clears the failures for key after a successful attempt.
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.Store.Reset(ctx, key)
+}
+
+func (l *Limiter) delay(failures int) time.Duration {
+	if failures < l.FreeAttempts {
+		return 0
+	}
+	delay := l.BaseDelay
+	for i := l.FreeAttempts; i < failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	return delay
+}
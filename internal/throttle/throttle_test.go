@@ -0,0 +1,272 @@
+package throttle
+
+import (
+	"app/internal/data"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// stores returns the stores to run a test against: a MemoryStore, and a
+// MongoStore when TEST_MONGO_URI names a database server to use.
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	memory := NewMemoryStore()
+	t.Cleanup(memory.Close)
+	stores := map[string]Store{"memory": memory}
+
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		return stores
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("throttle_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	stores["mongo"] = NewMongoStore(db, data.DefaultTimeouts)
+	return stores
+}
+
+func TestLimiterDelay(t *testing.T) {
+	l := &Limiter{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+
+	want := []time.Duration{0, 0, 0, 1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for failures, w := range want {
+		if got := l.delay(failures); got != w {
+			t.Errorf("%d failures: got %s; want %s", failures, got, w)
+		}
+	}
+}
+
+func TestLimiterAttempt(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			l := &Limiter{Store: store, FreeAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: time.Hour}
+
+			for i := 1; i <= 2; i++ {
+				rec, wait, err := l.Attempt(ctx, "login:alice")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wait != 0 {
+					t.Fatalf("attempt %d: got wait %s; want none", i, wait)
+				}
+				// An attempt counts as a failure straight away.
+				if rec.Failures != i {
+					t.Errorf("attempt %d: got %d failures; want %d", i, rec.Failures, i)
+				}
+			}
+
+			_, wait, err := l.Attempt(ctx, "login:alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wait <= 0 || wait > time.Hour {
+				t.Errorf("got wait %s; want up to an hour", wait)
+			}
+			// A refused attempt isn't counted.
+			rec, err := store.Get(ctx, "login:alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Failures != 2 {
+				t.Errorf("got %d failures; want 2", rec.Failures)
+			}
+
+			// Other keys are counted separately.
+			if _, wait, _ := l.Attempt(ctx, "login:bob"); wait != 0 {
+				t.Errorf("other key: got wait %s; want none", wait)
+			}
+		})
+	}
+}
+
+// Attempts made at the same time mustn't all get past the check before any
+// of them is counted.
+func TestLimiterConcurrentAttempts(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			l := &Limiter{Store: store, FreeAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: time.Hour}
+
+			var (
+				wg      sync.WaitGroup
+				mu      sync.Mutex
+				allowed int
+			)
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// Losing the race too often is an error, which refuses the
+					// attempt as well.
+					_, wait, err := l.Attempt(ctx, "login:alice")
+					if err == nil && wait == 0 {
+						mu.Lock()
+						allowed++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			// A MongoStore may give up on an attempt that keeps losing the race
+			// before all five have gone through, but never lets more through.
+			if allowed > 5 || (name == "memory" && allowed != 5) {
+				t.Errorf("%d attempts got through; want 5", allowed)
+			}
+		})
+	}
+}
+
+func TestLimiterLock(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			l := &Limiter{Store: store, FreeAttempts: 100, LockAfter: 3, LockFor: time.Hour, Window: time.Hour}
+
+			// Every attempt has its own count, so of the failures that reach
+			// the limit together exactly one locks the key.
+			var recs []Record
+			for i := 0; i < 3; i++ {
+				rec, wait, err := l.Attempt(ctx, "login:alice")
+				if err != nil || wait != 0 {
+					t.Fatalf("attempt %d: got wait %s, error %v", i+1, wait, err)
+				}
+				recs = append(recs, rec)
+			}
+			var (
+				wg    sync.WaitGroup
+				mu    sync.Mutex
+				locks int
+			)
+			for _, rec := range recs {
+				wg.Add(1)
+				go func(rec Record) {
+					defer wg.Done()
+					_, locked, err := l.Fail(ctx, rec)
+					if err != nil {
+						t.Error(err)
+					}
+					if locked {
+						mu.Lock()
+						locks++
+						mu.Unlock()
+					}
+				}(rec)
+			}
+			wg.Wait()
+			if locks != 1 {
+				t.Fatalf("got %d locks; want 1", locks)
+			}
+
+			_, wait, err := l.Attempt(ctx, "login:alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wait <= 59*time.Minute {
+				t.Errorf("got wait %s; want the lock of an hour", wait)
+			}
+
+			if err := l.Reset(ctx, "login:alice"); err != nil {
+				t.Fatal(err)
+			}
+			if _, wait, _ := l.Attempt(ctx, "login:alice"); wait != 0 {
+				t.Errorf("after reset: got wait %s; want none", wait)
+			}
+		})
+	}
+}
+
+func TestLimiterForgive(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			l := &Limiter{Store: store, FreeAttempts: 1, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: time.Hour}
+
+			// An attempt that didn't fail after all makes room for another.
+			for i := 0; i < 3; i++ {
+				_, wait, err := l.Attempt(ctx, "ip:203.0.113.7")
+				if err != nil || wait != 0 {
+					t.Fatalf("attempt %d: got wait %s, error %v", i+1, wait, err)
+				}
+				if err := l.Forgive(ctx, "ip:203.0.113.7"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Forgiving more than was counted doesn't go below zero.
+			if err := l.Forgive(ctx, "ip:203.0.113.7"); err != nil {
+				t.Fatal(err)
+			}
+			rec, err := store.Get(ctx, "ip:203.0.113.7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Failures != 0 {
+				t.Errorf("got %d failures; want 0", rec.Failures)
+			}
+		})
+	}
+}
+
+func TestLimiterWindow(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			// A record expiring straight away is forgotten by the next
+			// attempt, which starts counting over.
+			l := &Limiter{Store: store, FreeAttempts: 1, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: -time.Second}
+
+			for i := 0; i < 2; i++ {
+				rec, wait, err := l.Attempt(ctx, "login:alice")
+				if err != nil || wait != 0 {
+					t.Fatalf("attempt %d: got wait %s, error %v", i+1, wait, err)
+				}
+				if rec.Failures != 1 {
+					t.Errorf("attempt %d: got %d failures; want 1", i+1, rec.Failures)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	check := func(Record) time.Duration { return 0 }
+	s.Attempt(ctx, "old", now, now.Add(time.Minute), check)
+	s.Attempt(ctx, "new", now, now.Add(time.Hour), check)
+
+	s.sweep(now.Add(30 * time.Minute))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records["old"]; ok {
+		t.Error("expired record wasn't swept")
+	}
+	if _, ok := s.records["new"]; !ok {
+		t.Error("live record was swept")
+	}
+}
@@ -0,0 +1,116 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters of the codes, as expected by Google Authenticator and friends:
+// SHA-1, 6 digits and a 30 second step (RFC 6238 defaults).
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is the number of steps before and after the current one that are
+	// still accepted, to allow for clock drift and slow typing.
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160-bit secret, base-32 encoded as it is
+// shown to users and put in provisioning URIs.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix()/int64(Period/time.Second))), nil
+}
+
+// Validate reports whether code is valid for secret at time t, within Skew
+// steps either side, and if so returns the time step it belongs to. Callers
+// must remember the step and refuse codes of that step or earlier ones from
+// then on, so a code can't be replayed (RFC 6238, section 5.2).
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+
+	counter := t.Unix() / int64(Period/time.Second)
+	var step int64
+	valid := 0
+	for i := -Skew; i <= Skew; i++ {
+		// Check every step without returning early, and compare in constant
+		// time, so timings don't reveal anything about the code.
+		match := subtle.ConstantTimeCompare([]byte(hotp(key, uint64(counter+int64(i)))), []byte(code))
+		step = int64(subtle.ConstantTimeSelect(match, int(counter)+i, int(step)))
+		valid |= match
+	}
+	return step, valid == 1
+}
+
+// hotp computes an RFC 4226 HOTP value.
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	// Dynamic truncation, see section 5.3 of RFC 4226.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
+
+// ProvisioningURI returns the otpauth:// URI authenticator apps scan from a QR
+// code to add the account.
+func ProvisioningURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// GenerateRecoveryCodes returns n random one-time recovery codes of the form
+// XXXXX-XXXXX.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := encoding.EncodeToString(b)[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
@@ -0,0 +1,156 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The secret of the SHA-1 test vectors in RFC 6238, appendix B: the ASCII
+// string "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The RFC lists 8 digit codes; ours are their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("at %d: got %q; want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / int64(Period/time.Second)
+
+	code := func(t *testing.T, at time.Time) string {
+		c, err := Code(rfcSecret, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantOK   bool
+		wantStep int64
+	}{
+		{"current step", code(t, now), true, step},
+		{"previous step", code(t, now.Add(-Period)), true, step - 1},
+		{"next step", code(t, now.Add(Period)), true, step + 1},
+		{"too old", code(t, now.Add(-2*Period)), false, 0},
+		{"too new", code(t, now.Add(2*Period)), false, 0},
+		{"wrong code", "000000", false, 0},
+		{"too short", code(t, now)[:5], false, 0},
+		{"empty", "", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %t; want %t", ok, tt.wantOK)
+			}
+			if ok && gotStep != tt.wantStep {
+				t.Errorf("got step %d; want %d", gotStep, tt.wantStep)
+			}
+		})
+	}
+
+	if _, ok := Validate("not base32!", code(t, now), now); ok {
+		t.Error("invalid secret accepted")
+	}
+	// Secrets are shown in upper case, but typing them in lower case works.
+	if _, ok := Validate(strings.ToLower(rfcSecret), code(t, now), now); !ok {
+		t.Error("lower case secret rejected")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 {
+		t.Errorf("got a %d byte secret; want 20", len(key))
+	}
+
+	other, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == secret {
+		t.Error("got the same secret twice")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(ProvisioningURI("Grocery Store", "alice", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("got %s://%s; want otpauth://totp", uri.Scheme, uri.Host)
+	}
+	if uri.Path != "/Grocery Store:alice" {
+		t.Errorf("got label %q; want %q", uri.Path, "/Grocery Store:alice")
+	}
+
+	q := uri.Query()
+	want := map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Grocery Store",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s: got %q; want %q", k, q.Get(k), v)
+		}
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("got %d codes; want 10", len(codes))
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' {
+			t.Errorf("code %q isn't of the form XXXXX-XXXXX", c)
+		}
+		if seen[c] {
+			t.Errorf("code %q generated twice", c)
+		}
+		seen[c] = true
+	}
+}
@@ -0,0 +1,62 @@
+package validator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultLanguage is used when none of the client's languages is supported.
+const DefaultLanguage = "en"
+
+// messages holds the validation messages that are translated, by language and
+// then by message code.
+var messages = map[string]map[string]string{
+	"en": {
+		"password.required":       "must be provided",
+		"password.too_short":      "must be at least %d bytes long",
+		"password.too_long":       "must not be more than %d bytes long",
+		"password.contains_login": "must not contain your login",
+		"password.contains_email": "must not contain your email address",
+		"password.contains_name":  "must not contain your name",
+		"password.common":         "is too common, it appears in lists of breached passwords",
+		"password.too_weak":       "is too easy to guess, make it longer or mix in other kinds of characters",
+	},
+	"ru": {
+		"password.required":       "обязателен",
+		"password.too_short":      "должен быть не короче %d байт",
+		"password.too_long":       "должен быть не длиннее %d байт",
+		"password.contains_login": "не должен содержать ваш логин",
+		"password.contains_email": "не должен содержать ваш адрес электронной почты",
+		"password.contains_name":  "не должен содержать ваше имя",
+		"password.common":         "слишком распространён, он встречается в списках утёкших паролей",
+		"password.too_weak":       "слишком легко подобрать, сделайте его длиннее или добавьте другие виды символов",
+	},
+}
+
+// Message returns the message for code in the validator's language, falling
+// back to English.
+func (v *Validator) Message(code string, args ...interface{}) string {
+	format, ok := messages[v.Lang][code]
+	if !ok {
+		format, ok = messages[DefaultLanguage][code]
+	}
+	if !ok {
+		return code
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Language picks the first supported language from an Accept-Language header,
+// such as "ru-RU,ru;q=0.9,en;q=0.8". Quality values are not weighed; browsers
+// list languages in order of preference anyway.
+func Language(acceptLanguage string) string {
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ = strings.Cut(tag, ";")
+		primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+		primary = strings.ToLower(primary)
+		if _, ok := messages[primary]; ok {
+			return primary
+		}
+	}
+	return DefaultLanguage
+}
@@ -0,0 +1,140 @@
+package validator
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy limits. The maximum length comes from bcrypt, which ignores
+// everything after the 72nd byte.
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+	// MinPasswordEntropy is the least estimated strength, in bits, a new
+	// password needs. It leaves length to the length rule and only catches
+	// patterns: eight random lowercase letters are about 37 bits, or down to
+	// 30 with the repeats and neighbouring letters random picks often have,
+	// while "aaaaaaaa" or "abcd1234" are under 20.
+	MinPasswordEntropy = 30
+)
+
+//go:embed common_passwords.txt
+var commonPasswordsFile []byte
+
+var commonPasswords = loadCommonPasswords(commonPasswordsFile)
+
+func loadCommonPasswords(file []byte) map[string]struct{} {
+	passwords := map[string]struct{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = struct{}{}
+	}
+	return passwords
+}
+
+// IsCommonPassword reports whether password is on the embedded list of common
+// and breached passwords.
+func IsCommonPassword(password string) bool {
+	_, ok := commonPasswords[strings.ToLower(password)]
+	return ok
+}
+
+// PasswordEntropy estimates the strength of a password in bits. Each character
+// is worth log2 of the size of the character classes the password draws from,
+// except that a character repeating or continuing a sequence from the one
+// before it (aa, ab, 21) is worth one bit, and one used earlier in the
+// password is worth half. It is a rough estimate meant to catch passwords like
+// "aaaaaaaa" or "abcd1234", not a substitute for the common password list.
+func PasswordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	perChar := math.Log2(float64(pool))
+
+	var bits float64
+	seen := map[rune]bool{}
+	prev := rune(-1)
+	for _, r := range password {
+		c := unicode.ToLower(r)
+		switch {
+		case prev >= 0 && (c == prev || c == prev+1 || c == prev-1):
+			bits++
+		case seen[c]:
+			bits += perChar / 2
+		default:
+			bits += perChar
+		}
+		seen[c] = true
+		prev = c
+	}
+	return bits
+}
+
+// PersonalInfo is what a password must not contain.
+type PersonalInfo struct {
+	Login string
+	Email string
+	Name  string
+}
+
+// CheckPassword applies the password policy to a new password, adding an
+// error message in the validator's language for the first rule it breaks.
+func (v *Validator) CheckPassword(password string, info PersonalInfo) {
+	const key = "password"
+	v.Check(password != "", key, v.Message("password.required"))
+	v.Check(len(password) >= MinPasswordLength, key, v.Message("password.too_short", MinPasswordLength))
+	v.Check(len(password) <= MaxPasswordLength, key, v.Message("password.too_long", MaxPasswordLength))
+	if _, exists := v.Errors[key]; exists {
+		return
+	}
+
+	lower := strings.ToLower(password)
+	v.Check(!containsPart(lower, info.Login), key, v.Message("password.contains_login"))
+	localPart, _, _ := strings.Cut(info.Email, "@")
+	v.Check(!containsPart(lower, info.Email) && !containsPart(lower, localPart), key, v.Message("password.contains_email"))
+	for _, part := range strings.Fields(info.Name) {
+		v.Check(!containsPart(lower, part), key, v.Message("password.contains_name"))
+	}
+	v.Check(!IsCommonPassword(password), key, v.Message("password.common"))
+	v.Check(PasswordEntropy(password) >= MinPasswordEntropy, key, v.Message("password.too_weak"))
+}
+
+// containsPart reports whether the lowercased password contains part, ignoring
+// parts so short they would turn up in passwords by chance.
+func containsPart(lowerPassword, part string) bool {
+	part = strings.ToLower(strings.TrimSpace(part))
+	return utf8.RuneCountInString(part) >= 3 && strings.Contains(lowerPassword, part)
+}
@@ -0,0 +1,132 @@
+package validator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	info := PersonalInfo{Login: "alice42", Email: "wonderland@example.com", Name: "Alice Liddell"}
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+		args     []interface{}
+	}{
+		{"strong", "Tr0ub4dor&3xQ!", "", nil},
+		// Whatever the length rule allows passes unless it has a pattern.
+		{"random lowercase", "qzmwxkvj", "", nil},
+		{"random lowercase with repeats", "kqzkmwqj", "", nil},
+		{"random lowercase with neighbours", "rstkqwzm", "", nil},
+		{"empty", "", "password.required", nil},
+		{"too short", "x7#Kq", "password.too_short", []interface{}{MinPasswordLength}},
+		{"too long", strings.Repeat("x7#Kq", 15), "password.too_long", []interface{}{MaxPasswordLength}},
+		{"contains login", "my-ALICE42-pw!", "password.contains_login", nil},
+		{"contains email", "Wonderland!2024", "password.contains_email", nil},
+		{"contains name", "liddell#Rocks9", "password.contains_name", nil},
+		{"common", "Password1", "password.common", nil},
+		{"repeated characters", "aaaaaaaaaaaa", "password.too_weak", nil},
+		{"sequence", "mnopqrst", "password.too_weak", nil},
+		{"sequence with digits", "defg5678", "password.too_weak", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New()
+			v.CheckPassword(tt.password, info)
+
+			if tt.want == "" {
+				if !v.Valid() {
+					t.Fatalf("got errors %v; want none", v.Errors)
+				}
+				return
+			}
+			want := v.Message(tt.want, tt.args...)
+			if got := v.Errors["password"]; got != want {
+				t.Errorf("got %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+// Parts of the personal info so short they'd turn up by chance don't count.
+func TestCheckPasswordShortInfo(t *testing.T) {
+	v := New()
+	v.CheckPassword("Tr0ub4dor&3xQ!", PersonalInfo{Login: "tr", Name: "Q"})
+	if !v.Valid() {
+		t.Errorf("got errors %v; want none", v.Errors)
+	}
+}
+
+func TestIsCommonPassword(t *testing.T) {
+	for _, p := range []string{"password", "PASSWORD", "12345678"} {
+		if !IsCommonPassword(p) {
+			t.Errorf("%q isn't common", p)
+		}
+	}
+	if IsCommonPassword("Tr0ub4dor&3xQ!") {
+		t.Error("random password is common")
+	}
+}
+
+func TestPasswordEntropy(t *testing.T) {
+	if got := PasswordEntropy(""); got != 0 {
+		t.Errorf("empty password: got %v bits; want 0", got)
+	}
+
+	// Repeats and sequences are worth less than the same number of unrelated
+	// characters.
+	weak, strong := PasswordEntropy("aaaaaaaa"), PasswordEntropy("qzmwxkvj")
+	if weak >= strong {
+		t.Errorf("got %v bits for aaaaaaaa and %v for qzmwxkvj; want fewer for aaaaaaaa", weak, strong)
+	}
+	seq := PasswordEntropy("abcdefgh")
+	if seq >= strong {
+		t.Errorf("got %v bits for abcdefgh and %v for qzmwxkvj; want fewer for abcdefgh", seq, strong)
+	}
+
+	// More kinds of characters make a bigger pool.
+	if mixed := PasswordEntropy("qZmW4k#j"); mixed <= strong {
+		t.Errorf("got %v bits for qZmW4k#j and %v for qzmwxkvj; want more for qZmW4k#j", mixed, strong)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	v := New()
+	if got, want := v.Message("password.too_short", 8), "must be at least 8 bytes long"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	v.Lang = "ru"
+	if got, want := v.Message("password.too_short", 8), "должен быть не короче 8 байт"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	v.Lang = "fr"
+	if got, want := v.Message("password.required"), "must be provided"; got != want {
+		t.Errorf("unsupported language: got %q; want %q", got, want)
+	}
+	if got := v.Message("no.such.code"); got != "no.such.code" {
+		t.Errorf("unknown code: got %q; want the code", got)
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", DefaultLanguage},
+		{"ru-RU,ru;q=0.9,en;q=0.8", "ru"},
+		{"fr-FR, RU;q=0.5", "ru"},
+		{"de, fr", DefaultLanguage},
+		{"en-GB", "en"},
+	}
+
+	for _, tt := range tests {
+		if got := Language(tt.header); got != tt.want {
+			t.Errorf("%q: got %q; want %q", tt.header, got, tt.want)
+		}
+	}
+}
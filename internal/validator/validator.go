@@ -9,6 +9,9 @@ var (
 // map of validation errors.
 type Validator struct {
 	Errors map[string]string
+	// Lang is the language of the messages the validator writes itself, such
+	// as those of CheckPassword. The empty string means DefaultLanguage.
+	Lang string
 }
 
 // new Validator instance with an empty errors map.